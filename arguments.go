@@ -36,8 +36,9 @@ func (ca CommandArgument) String() string {
 }
 
 // Parse the values from a given pkt-line
+// The trailing LF is optional, git sends it but it is omitted by Append
 func (ca *CommandArgument) Parse(line []byte) error {
-	key, value, ok := bytes.Cut(line, []byte(" "))
+	key, value, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
 	if len(key) == 0 {
 		return fmt.Errorf("invalid argument: %q", string(line))
 	}
@@ -91,6 +92,17 @@ func (cas CommandArguments) Get(key string) (value string, ok bool) {
 	return "", false
 }
 
+// GetAll returns the values of every occurrence of the given key (ex: each "want")
+func (cas CommandArguments) GetAll(key string) []string {
+	var values []string
+	for _, arg := range cas {
+		if arg.Key == key {
+			values = append(values, arg.Value)
+		}
+	}
+	return values
+}
+
 // Has returns true if the given key is present in the capabilities
 func (cas CommandArguments) Has(key string) bool {
 	for _, arg := range cas {
@@ -20,6 +20,10 @@ func TestCommandArgument(t *testing.T) {
 			input: "key value",
 			want:  CommandArgument{Key: "key", Value: "value"},
 		},
+		"key value LF": {
+			input: "key value\n",
+			want:  CommandArgument{Key: "key", Value: "value"},
+		},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
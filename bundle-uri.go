@@ -0,0 +1,124 @@
+package protocolv2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+// BundleURIOptions are the typed arguments for a bundle-uri command-request
+type BundleURIOptions struct {
+	// Capabilities to include in the command-request
+	Capabilities Capabilities
+}
+
+// BuildBundleURIRequest constructs a bundle-uri command-request, which has no arguments
+func BuildBundleURIRequest(opts BundleURIOptions) *CommandRequest {
+	return &CommandRequest{
+		Command:      CapabilityBundleURI,
+		Capabilities: opts.Capabilities,
+	}
+}
+
+// Bundle is a single bundle of a bundle list (ex: bundle.<id>.uri)
+type Bundle struct {
+	ID  string
+	URI string
+	// Attributes are the other bundle.<id>.<key> values (ex: "creationtoken" or "filter")
+	Attributes map[string]string
+}
+
+// https://git-scm.com/docs/protocol-v2#_bundle_uri
+// output = bundle-list flush-pkt
+// bundle-list = *bundle-list-entry
+// bundle-list-entry = PKT-LINE(config-key "=" config-val)
+type BundleURIResponse struct {
+	// Attributes are the bundle.<key> values describing the list itself (ex: "version" or "mode")
+	Attributes map[string]string
+	// Bundles in the order they were first listed
+	Bundles []Bundle
+}
+
+// appendBundleListEntry appends a bundle-list-entry pkt-line to the given slice
+func appendBundleListEntry(b []byte, key string, value string) []byte {
+	return pktline.AppendString(b, key+"="+value+"\n")
+}
+
+// Append the response pkt-lines to the given slice
+// The attributes are sorted by key as their original order is not preserved
+func (bur BundleURIResponse) Append(b []byte) []byte {
+	for _, key := range slices.Sorted(maps.Keys(bur.Attributes)) {
+		b = appendBundleListEntry(b, "bundle."+key, bur.Attributes[key])
+	}
+	for _, bundle := range bur.Bundles {
+		b = appendBundleListEntry(b, "bundle."+bundle.ID+".uri", bundle.URI)
+		for _, key := range slices.Sorted(maps.Keys(bundle.Attributes)) {
+			b = appendBundleListEntry(b, "bundle."+bundle.ID+"."+key, bundle.Attributes[key])
+		}
+	}
+	b = pktline.AppendFlushPkt(b)
+	return b
+}
+
+// Bytes returns the response pkt-lines as a slice
+func (bur BundleURIResponse) Bytes() []byte {
+	return bur.Append(nil)
+}
+
+// Parse populates the fields from a given pkt-line scanner
+// The trailing LF of each pkt-line is optional, git omits it
+func (bur *BundleURIResponse) Parse(scanner *pktline.Scanner) error {
+	for {
+		line, err := scanner.Scan()
+		if err != nil {
+			if errors.Is(err, pktline.ErrFlushPkt) {
+				return nil
+			}
+			return truncated("bundle-uri", err)
+		}
+		key, value, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte("="))
+		if !ok || len(value) == 0 {
+			return fmt.Errorf("invalid bundle-list-entry: %q", string(line))
+		}
+		name, ok := strings.CutPrefix(string(key), "bundle.")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid bundle-list-entry: %q", string(line))
+		}
+		// The <id> of bundle.<id>.<key> is a config subsection so it may itself contain dots
+		idx := strings.LastIndexByte(name, '.')
+		if idx == 0 || idx == len(name)-1 {
+			return fmt.Errorf("invalid bundle-list-entry: %q", string(line))
+		} else if idx == -1 {
+			if bur.Attributes == nil {
+				bur.Attributes = make(map[string]string)
+			}
+			bur.Attributes[name] = string(value)
+			continue
+		}
+		bundle := bur.bundle(name[:idx])
+		if name[idx+1:] == "uri" {
+			bundle.URI = string(value)
+		} else {
+			if bundle.Attributes == nil {
+				bundle.Attributes = make(map[string]string)
+			}
+			bundle.Attributes[name[idx+1:]] = string(value)
+		}
+	}
+}
+
+// bundle returns the bundle with the given ID, adding it if not already present
+func (bur *BundleURIResponse) bundle(id string) *Bundle {
+	for idx := range bur.Bundles {
+		if bur.Bundles[idx].ID == id {
+			return &bur.Bundles[idx]
+		}
+	}
+	bur.Bundles = append(bur.Bundles, Bundle{ID: id})
+	return &bur.Bundles[len(bur.Bundles)-1]
+}
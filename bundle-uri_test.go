@@ -0,0 +1,134 @@
+package protocolv2
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func TestBuildBundleURIRequest(t *testing.T) {
+	req := BuildBundleURIRequest(BundleURIOptions{
+		Capabilities: Capabilities{{Key: CapabilityAgent, Value: "git/1.0"}},
+	})
+	want := "0017command=bundle-uri\n0012agent=git/1.0\n" + "00010000"
+	if got := string(req.Bytes()); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestBundleURIResponse(t *testing.T) {
+	tests := map[string]struct {
+		lines   []string
+		want    BundleURIResponse
+		wantErr string
+	}{
+		"empty": {},
+		"bundle list": {
+			lines: []string{
+				"bundle.version=1",
+				"bundle.mode=all",
+				"bundle.heuristic=creationToken",
+				"bundle.base.uri=https://cdn.example.com/base.bundle",
+				"bundle.base.creationToken=1",
+				"bundle.daily.2024-01-01.uri=https://cdn.example.com/daily.bundle",
+				"bundle.daily.2024-01-01.creationToken=2",
+				"bundle.base.filter=blob:none",
+			},
+			want: BundleURIResponse{
+				Attributes: map[string]string{
+					"version":   "1",
+					"mode":      "all",
+					"heuristic": "creationToken",
+				},
+				Bundles: []Bundle{
+					{
+						ID:  "base",
+						URI: "https://cdn.example.com/base.bundle",
+						Attributes: map[string]string{
+							"creationToken": "1",
+							"filter":        "blob:none",
+						},
+					},
+					{
+						ID:  "daily.2024-01-01",
+						URI: "https://cdn.example.com/daily.bundle",
+						Attributes: map[string]string{
+							"creationToken": "2",
+						},
+					},
+				},
+			},
+		},
+		"trailing LF": {
+			lines: []string{"bundle.version=1\n", "bundle.base.uri=https://cdn.example.com/base.bundle\n"},
+			want: BundleURIResponse{
+				Attributes: map[string]string{"version": "1"},
+				Bundles:    []Bundle{{ID: "base", URI: "https://cdn.example.com/base.bundle"}},
+			},
+		},
+		"missing value": {
+			lines:   []string{"bundle.version"},
+			wantErr: "invalid bundle-list-entry: \"bundle.version\"",
+		},
+		"unexpected section": {
+			lines:   []string{"core.bare=true"},
+			wantErr: "invalid bundle-list-entry: \"core.bare=true\"",
+		},
+		"empty id": {
+			lines:   []string{"bundle..uri=https://cdn.example.com/base.bundle"},
+			wantErr: "invalid bundle-list-entry: \"bundle..uri=https://cdn.example.com/base.bundle\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var b []byte
+			for _, line := range tc.lines {
+				b = pktline.AppendString(b, line)
+			}
+			b = pktline.AppendFlushPkt(b)
+			var bur BundleURIResponse
+			err := bur.Parse(pktline.NewScanner(bytes.NewReader(b)))
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(bur, tc.want) {
+				t.Fatalf("expected %+v, got %+v", tc.want, bur)
+			}
+			// Append sorts the attributes so only the parsed result is compared
+			var roundTrip BundleURIResponse
+			if err := roundTrip.Parse(pktline.NewScanner(bytes.NewReader(bur.Bytes()))); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(roundTrip, tc.want) {
+				t.Fatalf("expected round-trip %+v, got %+v", tc.want, roundTrip)
+			}
+		})
+	}
+}
+
+func TestBundleURIResponseAppend(t *testing.T) {
+	bur := BundleURIResponse{
+		Attributes: map[string]string{"version": "1", "mode": "all"},
+		Bundles:    []Bundle{{ID: "base", URI: "https://cdn.example.com/base.bundle", Attributes: map[string]string{"filter": "blob:none"}}},
+	}
+	want := []string{
+		"0014bundle.mode=all\n",
+		"0015bundle.version=1\n",
+		"0038bundle.base.uri=https://cdn.example.com/base.bundle\n",
+		"0021bundle.base.filter=blob:none\n",
+		"0000",
+	}
+	if got := string(bur.Bytes()); got != strings.Join(want, "") {
+		t.Fatalf("expected %q, got %q", strings.Join(want, ""), got)
+	}
+}
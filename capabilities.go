@@ -3,6 +3,7 @@ package protocolv2
 import (
 	"bytes"
 	"fmt"
+	"slices"
 	"strings"
 
 	pktline "github.com/bored-engineer/git-pkt-line"
@@ -56,9 +57,17 @@ const (
 	// information without having to fully fetch objects. Object size is the only
 	// information that is currently supported.
 	CapabilityObjectInfo = "object-info"
+	// bundle-uri is the command to request a bundle list, which advertises bundle
+	// files the client can download (ex: from a CDN) to bootstrap a clone before
+	// fetching the remaining objects.
+	CapabilityBundleURI = "bundle-uri"
 )
 
 // capability = PKT-LINE(key[=value] LF)
+//
+// There are only two forms, "key" and "key=value". An explicit empty value ("key=") is
+// rejected by Parse since the grammar requires at least one character of value and git
+// itself never emits it, a capability without parameters is advertised as just "key".
 type Capability struct {
 	// key = 1*(ALPHA | DIGIT | "-_")
 	Key string
@@ -145,6 +154,8 @@ func (cs Capabilities) String() string {
 }
 
 // Get returns the value of the given key in the capabilities
+// If the key is duplicated the first occurrence is returned, as git does when looking up a
+// capability of the server (see Dedup for last-wins semantics)
 func (cc Capabilities) Get(key string) (value string, ok bool) {
 	for _, c := range cc {
 		if c.Key == key {
@@ -164,6 +175,70 @@ func (cs Capabilities) Has(key string) bool {
 	return false
 }
 
+// Dedup returns the capabilities with only the last occurrence of each duplicated key (at its position)
+// which is the config-like semantics of a key advertised more than once (ex: by a buggy proxy)
+func (cs Capabilities) Dedup() Capabilities {
+	var deduped Capabilities
+	for idx, c := range cs {
+		if !slices.ContainsFunc(cs[idx+1:], func(later Capability) bool {
+			return later.Key == c.Key
+		}) {
+			deduped = append(deduped, c)
+		}
+	}
+	return deduped
+}
+
+// Intersect returns only the capabilities whose keys are in the supported set (in their original order)
+// This permits building a request's capability-list from an advertisement without echoing unknown capabilities
+func (cs Capabilities) Intersect(supported []string) Capabilities {
+	var intersection Capabilities
+	for _, c := range cs {
+		if slices.Contains(supported, c.Key) {
+			intersection = append(intersection, c)
+		}
+	}
+	return intersection
+}
+
+// Sort orders the capabilities by key in place, except agent is first and object-format is last
+// The sort is stable so duplicated keys (ex: multiple object-format capabilities) keep their order
+// This canonical order makes generated capabilities deterministic (ex: for tests or caching keys)
+func (cs Capabilities) Sort() {
+	rank := func(key string) int {
+		switch key {
+		case CapabilityAgent:
+			return -1
+		case CapabilityObjectFormat:
+			return 1
+		default:
+			return 0
+		}
+	}
+	slices.SortStableFunc(cs, func(a, b Capability) int {
+		if cmp := rank(a.Key) - rank(b.Key); cmp != 0 {
+			return cmp
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+}
+
+// Equal returns true if both contain the same key/value pairs regardless of order
+func (cs Capabilities) Equal(other Capabilities) bool {
+	set := make(map[Capability]struct{}, len(cs))
+	for _, c := range cs {
+		set[c] = struct{}{}
+	}
+	otherSet := make(map[Capability]struct{}, len(other))
+	for _, c := range other {
+		if _, ok := set[c]; !ok {
+			return false
+		}
+		otherSet[c] = struct{}{}
+	}
+	return len(set) == len(otherSet)
+}
+
 // Parse the capabilities from a given pkt-line
 func (cs *Capabilities) Parse(scanner *pktline.Scanner) error {
 	for {
@@ -1,6 +1,15 @@
 package protocolv2
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
 
 func TestCapability(t *testing.T) {
 	tests := map[string]struct {
@@ -20,6 +29,15 @@ func TestCapability(t *testing.T) {
 			input: "key=value\n",
 			want:  Capability{Key: "key", Value: "value"},
 		},
+		"key=": {
+			input:   "key=\n",
+			want:    Capability{Key: "key"},
+			wantErr: "invalid capability: \"key=\\n\"",
+		},
+		"=value": {
+			input:   "=value\n",
+			wantErr: "invalid capability: \"=value\\n\"",
+		},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -35,6 +53,183 @@ func TestCapability(t *testing.T) {
 			if c != tc.want {
 				t.Fatalf("expected %v, got %v", tc.want, c)
 			}
+			if tc.wantErr == "" && string(c.Bytes()) != fmt.Sprintf("%04x%s", len(tc.input)+4, tc.input) {
+				t.Fatalf("expected round-trip of %q, got %q", tc.input, string(c.Bytes()))
+			}
 		})
 	}
 }
+
+func TestCapabilitiesEqual(t *testing.T) {
+	agent := Capability{Key: "agent", Value: "git/2.45.0"}
+	lsRefs := Capability{Key: "ls-refs", Value: "unborn"}
+	fetch := Capability{Key: "fetch", Value: "shallow"}
+	tests := map[string]struct {
+		a, b Capabilities
+		want bool
+	}{
+		"empty": {
+			want: true,
+		},
+		"same order": {
+			a:    Capabilities{agent, lsRefs, fetch},
+			b:    Capabilities{agent, lsRefs, fetch},
+			want: true,
+		},
+		"reordered": {
+			a:    Capabilities{agent, lsRefs, fetch},
+			b:    Capabilities{fetch, agent, lsRefs},
+			want: true,
+		},
+		"missing": {
+			a:    Capabilities{agent, lsRefs, fetch},
+			b:    Capabilities{agent, lsRefs},
+			want: false,
+		},
+		"extra": {
+			a:    Capabilities{agent, lsRefs},
+			b:    Capabilities{agent, lsRefs, fetch},
+			want: false,
+		},
+		"different value": {
+			a:    Capabilities{agent, lsRefs},
+			b:    Capabilities{agent, {Key: "ls-refs"}},
+			want: false,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.a.Equal(tc.b); got != tc.want {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesDedup(t *testing.T) {
+	tests := map[string]struct {
+		caps Capabilities
+		want Capabilities
+	}{
+		"no duplicates": {
+			caps: Capabilities{{Key: CapabilityAgent, Value: "git/2.45.0"}, {Key: CapabilityFetch}},
+			want: Capabilities{{Key: CapabilityAgent, Value: "git/2.45.0"}, {Key: CapabilityFetch}},
+		},
+		"duplicate object-format": {
+			caps: Capabilities{
+				{Key: CapabilityObjectFormat, Value: "sha1"},
+				{Key: CapabilityFetch},
+				{Key: CapabilityObjectFormat, Value: "sha256"},
+			},
+			want: Capabilities{
+				{Key: CapabilityFetch},
+				{Key: CapabilityObjectFormat, Value: "sha256"},
+			},
+		},
+		"empty": {},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := tc.caps.Dedup()
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesSort(t *testing.T) {
+	tests := map[string]struct {
+		caps Capabilities
+		want Capabilities
+	}{
+		"git order": {
+			caps: Capabilities{
+				{Key: CapabilityAgent, Value: "git/2.39.5"},
+				{Key: CapabilityListReferences, Value: "unborn"},
+				{Key: CapabilityFetch, Value: "shallow wait-for-done"},
+				{Key: CapabilityServerOption},
+				{Key: CapabilityObjectFormat, Value: "sha256"},
+				{Key: CapabilityObjectInfo},
+			},
+			want: Capabilities{
+				{Key: CapabilityAgent, Value: "git/2.39.5"},
+				{Key: CapabilityFetch, Value: "shallow wait-for-done"},
+				{Key: CapabilityListReferences, Value: "unborn"},
+				{Key: CapabilityObjectInfo},
+				{Key: CapabilityServerOption},
+				{Key: CapabilityObjectFormat, Value: "sha256"},
+			},
+		},
+		"agent after session-id": {
+			caps: Capabilities{{Key: CapabilitySessionID, Value: "1"}, {Key: CapabilityAgent, Value: "git/2.45.0"}},
+			want: Capabilities{{Key: CapabilityAgent, Value: "git/2.45.0"}, {Key: CapabilitySessionID, Value: "1"}},
+		},
+		"duplicate object-format": {
+			caps: Capabilities{
+				{Key: CapabilityObjectFormat, Value: "sha256"},
+				{Key: CapabilityFetch},
+				{Key: CapabilityObjectFormat, Value: "sha1"},
+			},
+			want: Capabilities{
+				{Key: CapabilityFetch},
+				{Key: CapabilityObjectFormat, Value: "sha256"},
+				{Key: CapabilityObjectFormat, Value: "sha1"},
+			},
+		},
+		"empty": {},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc.caps.Sort()
+			if !reflect.DeepEqual(tc.caps, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, tc.caps)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesIntersect(t *testing.T) {
+	payload, err := os.ReadFile(filepath.Join("testdata", "github.advertisement"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ca CapabilityAdvertisement
+	if err := ca.Parse(pktline.NewScanner(bytes.NewReader(payload))); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		supported []string
+		want      Capabilities
+	}{
+		"subset": {
+			supported: []string{CapabilityObjectFormat, CapabilityAgent, "bundle-uri"},
+			want: Capabilities{
+				{Key: CapabilityAgent, Value: "git/github-8e2ff7c5586f"},
+				{Key: CapabilityObjectFormat, Value: "sha1"},
+			},
+		},
+		"none": {
+			supported: []string{"session-id"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := ca.Capabilities.Intersect(tc.supported); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func FuzzCapabilityParse(f *testing.F) {
+	f.Add([]byte("agent=git/2.45.0\n"))
+	f.Add([]byte("server-option\n"))
+	f.Fuzz(func(t *testing.T, line []byte) {
+		var c Capability
+		if err := c.Parse(line); err != nil {
+			return
+		}
+		_ = c.Bytes()
+	})
+}
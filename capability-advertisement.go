@@ -4,20 +4,152 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	pktline "github.com/bored-engineer/git-pkt-line"
 )
 
+// ErrUnsupportedProtocolVersion is returned when the server does not respond with protocol-v2
+var ErrUnsupportedProtocolVersion = errors.New("unsupported protocol version")
+
+// GitProtocolV2 requests protocol-v2 via the Git-Protocol HTTP header (or GIT_PROTOCOL environment variable)
+const GitProtocolV2 = "version=2"
+
+// GitProtocolHeader returns the value of the Git-Protocol HTTP header (or GIT_PROTOCOL environment
+// variable) requesting protocol-v2, the colon-separated parameters include the preferred
+// object-format (ex: "sha256") if non-empty
+func GitProtocolHeader(objectFormat string) string {
+	if objectFormat == "" {
+		return GitProtocolV2
+	}
+	return GitProtocolV2 + ":" + CapabilityObjectFormat + "=" + objectFormat
+}
+
+// DetectProtocolVersion reads the protocol-version line (after the optional smart-HTTP preamble)
+// Returns 0 for a protocol-v0 reference advertisement which lacks a version line (the first
+// reference is consumed), otherwise the scanner is positioned at the start of the advertisement.
+func DetectProtocolVersion(scanner *pktline.Scanner) (int, error) {
+	line, err := scanner.Scan()
+	if err != nil {
+		return 0, truncated("protocol-version", asServerError(err))
+	}
+	if bytes.HasPrefix(line, []byte("# service=")) {
+		if line, err := scanner.Scan(); !errors.Is(err, pktline.ErrFlushPkt) {
+			if err != nil {
+				return 0, fmt.Errorf("%w: %w", ErrMissingFlushPkt, err)
+			}
+			return 0, fmt.Errorf("%w: %q", ErrMissingFlushPkt, string(line))
+		}
+		line, err = scanner.Scan()
+		if err != nil {
+			return 0, truncated("protocol-version", asServerError(err))
+		}
+	}
+	switch {
+	case bytes.Equal(line, []byte("version 2\n")):
+		return 2, nil
+	case bytes.Equal(line, []byte("version 1\n")):
+		return 1, nil
+	case isObjectID(bytes.SplitN(line, []byte(" "), 2)[0]):
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("invalid protocol-version: %q", string(line))
+	}
+}
+
+// isObjectID returns true if the value is a hex-encoded SHA-1 or SHA-256 object ID
+func isObjectID(b []byte) bool {
+	if len(b) != 40 && len(b) != 64 {
+		return false
+	}
+	for _, c := range b {
+		if _, ok := unhex(c); !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // capability-advertisement = protocol-version capability-list flush-pkt
 // protocol-version = PKT-LINE("version 2" LF)
 // capability-list = *capability
 type CapabilityAdvertisement struct {
+	// Version is the protocol-version emitted by Append and expected by Parse, defaults to 2
+	// Other versions are only useful for testing (ex: a "version 1" line for DetectProtocolVersion)
+	Version      int
 	Capabilities Capabilities
 }
 
+// protocolVersion returns the Version, defaulting to 2
+func (ca CapabilityAdvertisement) protocolVersion() int {
+	if ca.Version == 0 {
+		return 2
+	}
+	return ca.Version
+}
+
+// AdvertisementOptions are the typed features of a server's capability-advertisement
+type AdvertisementOptions struct {
+	// Agent (if non-empty) is advertised as the agent capability (ex: git/2.45.0)
+	Agent string
+	// SupportsLsRefs advertises the ls-refs command, with the LsRefsFeatures (ex: "unborn")
+	SupportsLsRefs bool
+	LsRefsFeatures []string
+	// SupportsFetch advertises the fetch command, with the FetchFeatures (ex: "shallow", "filter")
+	SupportsFetch bool
+	FetchFeatures []string
+	// ServerOption advertises the server-option capability
+	ServerOption bool
+	// ObjectFormats are each advertised as an object-format capability (ex: "sha256")
+	ObjectFormats []string
+	// SessionID (if non-empty) is advertised as the session-id capability
+	SessionID string
+	// SupportsObjectInfo advertises the object-info command
+	SupportsObjectInfo bool
+	// SupportsBundleURI advertises the bundle-uri command
+	SupportsBundleURI bool
+	// Sorted emits the capabilities in the canonical order of Capabilities.Sort instead of git's order
+	Sorted bool
+}
+
+// NewCapabilityAdvertisement assembles the capability-advertisement from the options, in the order
+// git advertises them (agent, ls-refs, fetch, server-option, object-format, session-id, object-info, bundle-uri)
+func NewCapabilityAdvertisement(opts AdvertisementOptions) *CapabilityAdvertisement {
+	var ca CapabilityAdvertisement
+	if opts.Agent != "" {
+		ca.Capabilities = append(ca.Capabilities, Capability{Key: CapabilityAgent, Value: opts.Agent})
+	}
+	if opts.SupportsLsRefs {
+		ca.Capabilities = append(ca.Capabilities, Capability{Key: CapabilityListReferences, Value: strings.Join(opts.LsRefsFeatures, " ")})
+	}
+	if opts.SupportsFetch {
+		ca.Capabilities = append(ca.Capabilities, Capability{Key: CapabilityFetch, Value: strings.Join(opts.FetchFeatures, " ")})
+	}
+	if opts.ServerOption {
+		ca.Capabilities = append(ca.Capabilities, Capability{Key: CapabilityServerOption})
+	}
+	for _, objectFormat := range opts.ObjectFormats {
+		ca.Capabilities = append(ca.Capabilities, Capability{Key: CapabilityObjectFormat, Value: objectFormat})
+	}
+	if opts.SessionID != "" {
+		ca.Capabilities = append(ca.Capabilities, Capability{Key: CapabilitySessionID, Value: opts.SessionID})
+	}
+	if opts.SupportsObjectInfo {
+		ca.Capabilities = append(ca.Capabilities, Capability{Key: CapabilityObjectInfo})
+	}
+	if opts.SupportsBundleURI {
+		ca.Capabilities = append(ca.Capabilities, Capability{Key: CapabilityBundleURI})
+	}
+	if opts.Sorted {
+		ca.Capabilities.Sort()
+	}
+	return &ca
+}
+
 // Bytes returns the advertisement pkt-lines to the given slice
 func (ca CapabilityAdvertisement) Append(b []byte) []byte {
-	b = pktline.AppendString(b, "version 2\n")
+	b = pktline.AppendString(b, "version "+strconv.Itoa(ca.protocolVersion())+"\n")
 	b = ca.Capabilities.Append(b)
 	b = pktline.AppendFlushPkt(b)
 	return b
@@ -28,17 +160,46 @@ func (ca CapabilityAdvertisement) Bytes() []byte {
 	return ca.Append(nil)
 }
 
+// SupportsCommand returns true if the advertisement contains the given command (ex: fetch)
+func (ca CapabilityAdvertisement) SupportsCommand(command string) bool {
+	return ca.Capabilities.Has(command)
+}
+
+// Features returns the features the command was advertised with (ex: fetch=shallow filter)
+func (ca CapabilityAdvertisement) Features(command string) []string {
+	features, _ := ca.Capabilities.Get(command)
+	return strings.Fields(features)
+}
+
+// SupportsFeature returns true if the command was advertised with the given feature (ex: fetch=shallow filter)
+func (ca CapabilityAdvertisement) SupportsFeature(command string, feature string) bool {
+	for _, f := range ca.Features(command) {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
 // Parse populates the fields from a given scanner
+// If the server sent an error-line instead (ex: "ERR access denied") a *ServerError is returned
+// If the protocol-version is not the expected Version an ErrUnsupportedProtocolVersion is returned
 func (ca *CapabilityAdvertisement) Parse(scanner *pktline.Scanner) error {
-	version, err := scanner.Scan()
+	line, err := scanner.Scan()
 	if err != nil {
-		return err
+		return truncated("protocol-version", asServerError(err))
+	}
+	value, ok := bytes.CutPrefix(line, []byte("version "))
+	value, lf := bytes.CutSuffix(value, []byte("\n"))
+	version, err := strconv.Atoi(string(value))
+	if !ok || !lf || err != nil || version <= 0 {
+		return fmt.Errorf("invalid protocol-version: %q", string(line))
 	}
-	if !bytes.Equal(version, []byte("version 2\n")) {
-		return fmt.Errorf("invalid protocol-version: %q", string(version))
+	if expected := ca.protocolVersion(); version != expected {
+		return fmt.Errorf("%w: expected version %d, got version %d", ErrUnsupportedProtocolVersion, expected, version)
 	}
 	if err := ca.Capabilities.Parse(scanner); err != nil && !errors.Is(err, pktline.ErrFlushPkt) {
-		return err
+		return truncated("capability-list", err)
 	}
 	return nil
 }
@@ -2,6 +2,9 @@ package protocolv2
 
 import (
 	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -36,3 +39,302 @@ func TestCapabilityAdvertisement(t *testing.T) {
 		t.Fatalf("expected payload to match")
 	}
 }
+
+func TestCapabilityAdvertisementServerError(t *testing.T) {
+	tests := map[string]string{
+		"without newline": "0015ERR access denied",
+		"with newline":    "0016ERR access denied\n",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			var ca CapabilityAdvertisement
+			err := ca.Parse(pktline.NewScanner(strings.NewReader(input)))
+			var se *ServerError
+			if !errors.As(err, &se) {
+				t.Fatalf("expected *ServerError, got %v", err)
+			}
+			if se.Message != "access denied" {
+				t.Fatalf("expected %q, got %q", "access denied", se.Message)
+			}
+			var errLine pktline.ErrErrorLine
+			if !errors.As(err, &errLine) {
+				t.Fatalf("expected pktline.ErrErrorLine, got %v", err)
+			} else if errLine.Explanation != "access denied" {
+				t.Fatalf("expected %q, got %q", "access denied", errLine.Explanation)
+			}
+		})
+	}
+}
+
+func TestCapabilityAdvertisementVersion(t *testing.T) {
+	caps := Capabilities{{Key: CapabilityAgent, Value: "git/2.39.5"}}
+	tests := map[string]struct {
+		version int
+		input   string
+		wantErr string
+	}{
+		"default": {
+			input: "000eversion 2\n0015agent=git/2.39.5\n0000",
+		},
+		"version 1": {
+			version: 1,
+			input:   "000eversion 1\n0015agent=git/2.39.5\n0000",
+		},
+		"mismatch": {
+			input:   "000eversion 1\n0015agent=git/2.39.5\n0000",
+			wantErr: "unsupported protocol version: expected version 2, got version 1",
+		},
+		"invalid": {
+			input:   "000eversion x\n0015agent=git/2.39.5\n0000",
+			wantErr: "invalid protocol-version: \"version x\\n\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			parsed := CapabilityAdvertisement{Version: tc.version}
+			err := parsed.Parse(pktline.NewScanner(strings.NewReader(tc.input)))
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			ca := CapabilityAdvertisement{Version: tc.version, Capabilities: caps}
+			if !reflect.DeepEqual(parsed, ca) {
+				t.Fatalf("expected %+v, got %+v", ca, parsed)
+			}
+			if got := string(ca.Bytes()); got != tc.input {
+				t.Fatalf("expected %q, got %q", tc.input, got)
+			}
+			version, err := DetectProtocolVersion(pktline.NewScanner(bytes.NewReader(ca.Bytes())))
+			if err != nil {
+				t.Fatal(err)
+			} else if version != ca.protocolVersion() {
+				t.Fatalf("expected version %d, got %d", ca.protocolVersion(), version)
+			}
+		})
+	}
+}
+
+func TestCapabilityAdvertisementSupportsCommand(t *testing.T) {
+	scanner := pktline.NewScanner(strings.NewReader(payloadCapabilityAdvertisement))
+	var ca CapabilityAdvertisement
+	if err := ca.Parse(scanner); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		CapabilityFetch:          true,
+		CapabilityListReferences: true,
+		CapabilityObjectInfo:     false,
+		"bundle-uri":             false,
+	}
+	for command, want := range tests {
+		t.Run(command, func(t *testing.T) {
+			if got := ca.SupportsCommand(command); got != want {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestDetectProtocolVersion(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    int
+		wantErr string
+	}{
+		"version 2": {
+			input: payloadCapabilityAdvertisement,
+			want:  2,
+		},
+		"version 1": {
+			input: "000eversion 1\n",
+			want:  1,
+		},
+		"version 0": {
+			input: "003c0000000000000000000000000000000000000001 HEAD\x00multi_ack\n",
+			want:  0,
+		},
+		"smart-http version 2": {
+			input: "001e# service=git-upload-pack\n0000" + payloadCapabilityAdvertisement,
+			want:  2,
+		},
+		"smart-http version 0": {
+			input: "001e# service=git-upload-pack\n0000003c0000000000000000000000000000000000000001 HEAD\x00multi_ack\n",
+			want:  0,
+		},
+		"error-line": {
+			input:   "0015ERR access denied",
+			wantErr: "ERR access denied",
+		},
+		"smart-http error-line": {
+			input:   "001e# service=git-upload-pack\n00000015ERR access denied",
+			wantErr: "ERR access denied",
+		},
+		"unrecognized": {
+			input:   "000eversion 3\n",
+			wantErr: "invalid protocol-version: \"version 3\\n\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			scanner := pktline.NewScanner(strings.NewReader(tc.input))
+			got, err := DetectProtocolVersion(scanner)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %d, got %d", tc.want, got)
+			}
+			if got == 2 {
+				var caps Capabilities
+				if err := caps.Parse(scanner); !errors.Is(err, pktline.ErrFlushPkt) {
+					t.Fatalf("expected capabilities to be parsed, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestGitProtocolHeader(t *testing.T) {
+	tests := map[string]struct {
+		objectFormat string
+		want         string
+	}{
+		"default": {
+			want: "version=2",
+		},
+		"sha256": {
+			objectFormat: "sha256",
+			want:         "version=2:object-format=sha256",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := GitProtocolHeader(tc.objectFormat); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNewCapabilityAdvertisement(t *testing.T) {
+	tests := map[string]AdvertisementOptions{
+		"github.advertisement": {
+			Agent:          "git/github-8e2ff7c5586f",
+			SupportsLsRefs: true,
+			LsRefsFeatures: []string{"unborn"},
+			SupportsFetch:  true,
+			FetchFeatures:  []string{"shallow", "wait-for-done", "filter"},
+			ServerOption:   true,
+			ObjectFormats:  []string{"sha1"},
+		},
+		"git-2.39-sha256.advertisement": {
+			Agent:              "git/2.39.5",
+			SupportsLsRefs:     true,
+			LsRefsFeatures:     []string{"unborn"},
+			SupportsFetch:      true,
+			FetchFeatures:      []string{"shallow", "wait-for-done"},
+			ServerOption:       true,
+			ObjectFormats:      []string{"sha256"},
+			SupportsObjectInfo: true,
+		},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			payload, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := NewCapabilityAdvertisement(opts).Bytes(); !bytes.Equal(got, payload) {
+				t.Fatalf("expected %q, got %q", string(payload), string(got))
+			}
+		})
+	}
+
+	sorted := NewCapabilityAdvertisement(AdvertisementOptions{
+		Agent:          "git/2.39.5",
+		SupportsLsRefs: true,
+		SupportsFetch:  true,
+		ServerOption:   true,
+		ObjectFormats:  []string{"sha256"},
+		SessionID:      "1",
+		Sorted:         true,
+	})
+	if got, want := sorted.Capabilities.String(), "agent=git/2.39.5 fetch ls-refs server-option session-id=1 object-format=sha256"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestCapabilityAdvertisementFixtures(t *testing.T) {
+	tests := map[string]struct {
+		objectFormat string
+		preamble     bool
+		wantErr      string
+	}{
+		"github.advertisement": {
+			objectFormat: "sha1",
+		},
+		"github-smart-http.advertisement": {
+			objectFormat: "sha1",
+			preamble:     true,
+		},
+		"git-2.39-sha1.advertisement": {
+			objectFormat: "sha1",
+		},
+		"git-2.39-sha256.advertisement": {
+			objectFormat: "sha256",
+		},
+		"git-daemon-2.39-not-exported.advertisement": {
+			// git daemon sends an error-line without a trailing LF, then closes the connection
+			wantErr: "ERR access denied or repository not exported: /repo.git",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			payload, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			scanner := pktline.NewScanner(bytes.NewReader(payload))
+			version, err := DetectProtocolVersion(scanner)
+			if tc.wantErr != "" {
+				var se *ServerError
+				if !errors.As(err, &se) {
+					t.Fatalf("expected *ServerError, got %v", err)
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err.Error())
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if version != 2 {
+				t.Fatalf("expected version 2, got %d", version)
+			}
+			var ca CapabilityAdvertisement
+			if err := ca.Capabilities.Parse(scanner); !errors.Is(err, pktline.ErrFlushPkt) {
+				t.Fatalf("expected flush-pkt, got %v", err)
+			}
+			if objectFormat, _ := ca.Capabilities.Get(CapabilityObjectFormat); objectFormat != tc.objectFormat {
+				t.Fatalf("expected object-format %q, got %q", tc.objectFormat, objectFormat)
+			}
+			if tc.preamble {
+				payload = payload[len("001e# service=git-upload-pack\n0000"):]
+			}
+			if !bytes.Equal(ca.Bytes(), payload) {
+				t.Fatalf("expected %q, got %q", string(payload), string(ca.Bytes()))
+			}
+		})
+	}
+}
@@ -0,0 +1,688 @@
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+// ErrCommandNotSupported is returned when the server did not advertise the requested command
+var ErrCommandNotSupported = errors.New("command not supported by server")
+
+// Metrics receives observations of the operations performed by a Client
+// This permits instrumentation (ex: Prometheus) without depending on a specific library
+type Metrics interface {
+	// ObserveFetch is called after each fetch with the packfile (sideband-1) bytes written
+	ObserveFetch(bytesWritten int64, duration time.Duration)
+	// ObserveLsRefs is called after each ls-refs with the number of references received
+	ObserveLsRefs(references int, duration time.Duration)
+}
+
+// countingWriter counts the bytes written to the underlying (optional) writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements the io.Writer interface
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.w == nil {
+		cw.n += int64(len(p))
+		return len(p), nil
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// HTTPVersion selects the HTTP protocol version used by a Client
+type HTTPVersion int
+
+const (
+	// HTTPVersionAuto uses Go's automatic negotiation (HTTP/2 via ALPN when available)
+	HTTPVersionAuto HTTPVersion = iota
+	// HTTPVersion1 forces HTTP/1.1, a workaround for servers or proxies which misbehave over
+	// HTTP/2 (ex: stream resets during large packfiles) at the cost of a connection per request
+	HTTPVersion1
+	// HTTPVersion2 prefers HTTP/2 even when the transport has a custom TLS or dial configuration
+	// (which normally disables it), falling back to HTTP/1.1 if the server does not negotiate it
+	HTTPVersion2
+)
+
+// DefaultPostBuffer is the default Client.PostBuffer, the default of git's http.postBuffer (1 MiB)
+const DefaultPostBuffer = 1 << 20
+
+// Client implements protocol-v2 using the smart HTTP transport
+// A Client is safe for concurrent use, but its fields must not be modified once it is in use
+type Client struct {
+	// URL of the remote repository (ex: https://github.com/bored-engineer/git-protocol-v2)
+	URL string
+	// UploadPackService is the service used for fetches, defaults to ServiceUploadPack
+	// A server with custom endpoints may name it differently (ex: a proxy path), see ServiceURL
+	UploadPackService string
+	// HTTPClient used to perform requests, defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// UserAgent is sent as the User-Agent header of each request
+	UserAgent string
+	// Progress receives the sideband-2 progress messages (if non-nil)
+	Progress io.Writer
+	// ProgressFilter (if non-nil) decides which lines of progress are forwarded to Progress
+	// (ex: only the "done." summaries), by default every line is forwarded
+	ProgressFilter ProgressFilterFunc
+	// ProgressWriter (if non-nil) supplies the writer for the raw payloads of the given sideband
+	// channel (currently only SideBandProgress) for each fetch response, taking precedence over
+	// Progress and ProgressFilter. This is an extension point for caller-side transforms (ex: a
+	// decompressor for a custom server which compresses its progress), which may wrap
+	// NewProgressFilter themselves. If the writer implements io.Closer it is closed once the
+	// response is parsed, a nil writer discards the progress.
+	ProgressWriter func(sideband SideBand) io.Writer
+	// UnknownSideBand (if non-nil) receives the pkt-lines of sideband channels other than 1-3 (including
+	// the leading sideband byte) instead of failing the fetch, use io.Discard to silently drop them
+	UnknownSideBand io.Writer
+	// Metrics (if non-nil) observes each operation
+	Metrics Metrics
+	// Logger (if non-nil) receives debug events for each command and response section
+	Logger *slog.Logger
+	// Trace (if non-nil) receives every pkt-line sent and received in git's GIT_TRACE_PACKET format
+	// The trace is not redacted, it may contain sensitive data such as ref names
+	Trace io.Writer
+	// DrainLimit is the maximum number of unread bytes discarded from a response body before it is
+	// closed, permitting the connection to be reused. If zero (or the context was cancelled) the
+	// body is closed immediately, which tears down the connection if the response was not fully read.
+	DrainLimit int64
+	// ObjectFormat is the preferred object-format (ex: "sha256"), sent as the object-format
+	// capability if the server advertised one. The server may use a different object-format,
+	// see NegotiatedObjectFormat for the object-format actually in use.
+	ObjectFormat string
+	// HTTPVersion pins the HTTP protocol version, defaults to HTTPVersionAuto
+	// This only applies if the HTTPClient uses an *http.Transport (or the default transport)
+	HTTPVersion HTTPVersion
+	// PackfileBytesPerSecond (if positive) caps the throughput of the packfile written by Fetch,
+	// see NewRateLimitedWriter. This avoids saturating a shared link during large background fetches.
+	PackfileBytesPerSecond int64
+	// PackfileBufferSize (if positive) buffers the packfile written by Fetch in a bufio.Writer of
+	// this size, reducing the number of small writes (ex: syscalls to an *os.File)
+	PackfileBufferSize int
+	// MaxRequestSize (if positive) is the maximum size of a command-request body (ex: a proxy limit)
+	// A larger fetch command-request containing "done" is split into multiple rounds of negotiation
+	// (see Negotiate) with the haves divided between them. This relies on the server supporting
+	// multi-round stateless negotiation, which git does. The wants are sent in every round so they
+	// must fit in a single request, as must the haves the server acknowledges as common.
+	MaxRequestSize int
+	// PostBuffer is the size above which a command-request is streamed using chunked transfer-encoding
+	// rather than buffered, defaults to DefaultPostBuffer (matching git's http.postBuffer)
+	PostBuffer int
+	// MaxReferences (if positive) is the maximum number of references LsRefs (or LsRefsStream)
+	// accepts before returning ErrTooManyReferences, see ListReferencesResponse.ParseLimit
+	MaxReferences int
+	// DedupCapabilities keeps only the last occurrence of each capability advertised more than once
+	// (see Capabilities.Dedup), by default duplicates are preserved and Get returns the first
+	DedupCapabilities bool
+
+	// mu guards the state cached by the (possibly concurrent) commands below
+	mu            sync.Mutex
+	advertisement *CapabilityAdvertisement
+	client        *http.Client
+	objectFormat  string
+}
+
+// uploadPackService returns the UploadPackService, defaulting to ServiceUploadPack
+func (c *Client) uploadPackService() string {
+	if c.UploadPackService == "" {
+		return ServiceUploadPack
+	}
+	return c.UploadPackService
+}
+
+// InfoRefsURL returns the URL of the advertisement of the given service (ex: ServiceUploadPack)
+func (c *Client) InfoRefsURL(service string) string {
+	return c.URL + "/info/refs?service=" + url.QueryEscape(service)
+}
+
+// ServiceURL returns the URL the command-requests of the given service (ex: ServiceUploadPack) are POSTed to
+func (c *Client) ServiceURL(service string) string {
+	return c.URL + "/" + service
+}
+
+// UploadPackURL returns the ServiceURL of the UploadPackService
+func (c *Client) UploadPackURL() string {
+	return c.ServiceURL(c.uploadPackService())
+}
+
+// NegotiatedObjectFormat returns the object-format used by the server (ex: "sha1" or "sha256")
+// It is known after Capabilities and is updated if an ls-refs response uses a different
+// object-format than advertised (ex: the server downgraded the requested ObjectFormat).
+func (c *Client) NegotiatedObjectFormat() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.objectFormat
+}
+
+// setObjectFormat updates the negotiated object-format
+func (c *Client) setObjectFormat(objectFormat string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.objectFormat = objectFormat
+}
+
+// observeObjectFormat updates the negotiated object-format from the length of an object ID
+// Returns false (leaving it unchanged) if the value is not an object ID (ex: "unborn")
+func (c *Client) observeObjectFormat(objID string) bool {
+	objectFormat, ok := objectFormatOf(objID)
+	if ok {
+		c.setObjectFormat(objectFormat)
+	}
+	return ok
+}
+
+// httpClient returns the configured HTTP client or http.DefaultClient
+// If an HTTPVersion is pinned, a copy of the client with a reconfigured transport is used
+func (c *Client) httpClient() *http.Client {
+	base := c.HTTPClient
+	if base == nil {
+		base = http.DefaultClient
+	}
+	if c.HTTPVersion == HTTPVersionAuto {
+		return base
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		return c.client
+	}
+	rt := base.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	transport, ok := rt.(*http.Transport)
+	if !ok {
+		return base
+	}
+	transport = transport.Clone()
+	switch c.HTTPVersion {
+	case HTTPVersion1:
+		// A non-nil but empty TLSNextProto disables the HTTP/2 upgrade
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		// Nor can "h2" be offered via ALPN, otherwise the server may select it anyways
+		if transport.TLSClientConfig != nil {
+			transport.TLSClientConfig.NextProtos = slices.DeleteFunc(slices.Clone(transport.TLSClientConfig.NextProtos), func(proto string) bool {
+				return proto == "h2"
+			})
+		}
+	case HTTPVersion2:
+		transport.ForceAttemptHTTP2 = true
+	}
+	client := *base
+	client.Transport = transport
+	c.client = &client
+	return c.client
+}
+
+// do performs the HTTP request for the service, returning an error for any non-200 response
+func (c *Client) do(ctx context.Context, method string, url string, service string, body io.Reader) (*http.Response, error) {
+	if c.Trace != nil && body != nil {
+		if br, ok := body.(*bytes.Reader); ok {
+			// A buffered body is traced up front, wrapping it would lose its GetBody (and Content-Length)
+			if _, err := br.WriteTo(newPacketTracer(c.Trace, '>')); err != nil {
+				return nil, err
+			}
+			if _, err := br.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		} else {
+			traced := io.TeeReader(body, newPacketTracer(c.Trace, '>'))
+			// Preserve the io.Closer (if any) so the transport can close a streamed body
+			if closer, ok := body.(io.Closer); ok {
+				body = readCloser{Reader: traced, Closer: closer}
+			} else {
+				body = traced
+			}
+		}
+	}
+	reqHTTP, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		if closer, ok := body.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+	}
+	reqHTTP.Header.Set("Git-Protocol", GitProtocolHeader(c.ObjectFormat))
+	if c.UserAgent != "" {
+		reqHTTP.Header.Set("User-Agent", c.UserAgent)
+	}
+	if body != nil {
+		// The smart-HTTP request type is named after the service (ex: application/x-git-upload-pack-request)
+		reqHTTP.Header.Set("Content-Type", "application/x-"+service+"-request")
+	}
+	respHTTP, err := c.httpClient().Do(reqHTTP)
+	if err != nil {
+		return nil, fmt.Errorf("(*http.Client).Do failed: %w", err)
+	}
+	if respHTTP.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(respHTTP.Body)
+		respHTTP.Body.Close()
+		return nil, fmt.Errorf("unexpected status code (%d): %s", respHTTP.StatusCode, string(body))
+	}
+	if c.Trace != nil {
+		respHTTP.Body = readCloser{
+			Reader: io.TeeReader(respHTTP.Body, newPacketTracer(c.Trace, '<')),
+			Closer: respHTTP.Body,
+		}
+	}
+	return respHTTP, nil
+}
+
+// closeBody discards (up to DrainLimit bytes of) the remaining response body before closing it
+func (c *Client) closeBody(ctx context.Context, body io.ReadCloser) {
+	if c.DrainLimit > 0 && ctx.Err() == nil {
+		if n, _ := io.CopyN(io.Discard, body, c.DrainLimit); n > 0 {
+			loggerOrDiscard(c.Logger).Debug("discarded unread bytes of response body", "bytes", n)
+		}
+	}
+	body.Close()
+}
+
+// Capabilities returns the capability-advertisement of the server
+// The advertisement is cached for use by subsequent commands
+func (c *Client) Capabilities(ctx context.Context) (*CapabilityAdvertisement, error) {
+	c.mu.Lock()
+	cached := c.advertisement
+	c.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+	respHTTP, err := c.do(ctx, http.MethodGet, c.InfoRefsURL(c.uploadPackService()), c.uploadPackService(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeBody(ctx, respHTTP.Body)
+	// The smart-HTTP preamble is optional, git http-backend omits it when responding with protocol-v2,
+	// but if present it must name the requested service. Only the head of the body is read to detect
+	// it (rather than buffering the body), so any trailing bytes are still drained by closeBody.
+	head := make([]byte, len("0000# service="))
+	n, _ := io.ReadFull(respHTTP.Body, head)
+	scanner := pktline.NewScanner(io.MultiReader(bytes.NewReader(head[:n]), respHTTP.Body))
+	if bytes.HasSuffix(head[:n], []byte("# service=")) {
+		if err := ParseSmartHTTPPreamble(scanner, c.uploadPackService()); err != nil {
+			return nil, err
+		}
+	}
+	if version, err := DetectProtocolVersion(scanner); err != nil {
+		return nil, err
+	} else if version != 2 {
+		return nil, fmt.Errorf("%w: server responded with version %d", ErrUnsupportedProtocolVersion, version)
+	}
+	var ca CapabilityAdvertisement
+	if err := ca.Capabilities.Parse(scanner); err != nil && !errors.Is(err, pktline.ErrFlushPkt) {
+		return nil, truncated("capability-list", err)
+	}
+	// Some intermediaries append bytes after the flush-pkt (ex: a second flush-pkt or a keepalive),
+	// which are ignored rather than failing the advertisement (and drained by closeBody)
+	if c.DedupCapabilities {
+		ca.Capabilities = ca.Capabilities.Dedup()
+	}
+	// Servers which do not advertise an object-format use SHA-1
+	objectFormat := "sha1"
+	if advertised, ok := ca.Capabilities.Get(CapabilityObjectFormat); ok {
+		objectFormat = advertised
+	}
+	loggerOrDiscard(c.Logger).Debug("received capability-advertisement", "capabilities", len(ca.Capabilities), "object-format", objectFormat)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A concurrent call may have cached the advertisement first, which is kept so every caller shares it
+	if c.advertisement == nil {
+		c.advertisement = &ca
+		c.objectFormat = objectFormat
+	}
+	return c.advertisement, nil
+}
+
+// isAgent returns true if the value is a valid agent string (printable ASCII except space)
+func isAgent(value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for idx := 0; idx < len(value); idx++ {
+		if value[idx] <= 32 || value[idx] >= 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// command sends the command-request, failing fast if the server did not advertise the command
+// The caller is responsible for closing the response body
+func (c *Client) command(ctx context.Context, req *CommandRequest) (*http.Response, error) {
+	ca, err := c.Capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ca.SupportsCommand(req.Command) {
+		return nil, fmt.Errorf("%w: %s", ErrCommandNotSupported, req.Command)
+	}
+	// The agent capability MUST NOT be sent unless the server advertised its own
+	if isAgent(c.UserAgent) && ca.Capabilities.Has(CapabilityAgent) && !req.Capabilities.Has(CapabilityAgent) {
+		withAgent := *req
+		withAgent.Capabilities = append(slices.Clip(req.Capabilities), Capability{Key: CapabilityAgent, Value: c.UserAgent})
+		req = &withAgent
+	}
+	// The object-format sent MUST be the one the server advertised, so if the preferred ObjectFormat
+	// differs the server's is used (a downgrade which is visible via NegotiatedObjectFormat)
+	if c.ObjectFormat != "" && ca.Capabilities.Has(CapabilityObjectFormat) && !req.Capabilities.Has(CapabilityObjectFormat) {
+		withObjectFormat := *req
+		withObjectFormat.Capabilities = append(slices.Clip(req.Capabilities), Capability{Key: CapabilityObjectFormat, Value: c.NegotiatedObjectFormat()})
+		req = &withObjectFormat
+	}
+	loggerOrDiscard(c.Logger).Debug("sending command-request", "command", req.Command, "capabilities", len(req.Capabilities), "arguments", len(req.Arguments))
+	// Like git (see http.postBuffer) only a large command-request is streamed, a small one is buffered
+	// so it is sent with a Content-Length and can be replayed by net/http (ex: on a stale connection)
+	var size countingWriter
+	if _, err := req.WriteTo(&size); err != nil {
+		return nil, err
+	}
+	if size.n <= int64(c.postBuffer()) {
+		return c.do(ctx, http.MethodPost, c.UploadPackURL(), c.uploadPackService(), bytes.NewReader(req.Bytes()))
+	}
+	return c.do(ctx, http.MethodPost, c.UploadPackURL(), c.uploadPackService(), streamCommandRequest(ctx, req))
+}
+
+// postBuffer returns the PostBuffer, defaulting to DefaultPostBuffer
+func (c *Client) postBuffer() int {
+	if c.PostBuffer == 0 {
+		return DefaultPostBuffer
+	}
+	return c.PostBuffer
+}
+
+// streamCommandRequest returns a pipe which streams the encoded command-request as it is read
+// rather than materializing it, which is sent using chunked transfer-encoding. The writing goroutine
+// exits once the request is written or the pipe is closed, either by the HTTP transport (which
+// closes the body when the request completes or fails) or the context being cancelled.
+func streamCommandRequest(ctx context.Context, req *CommandRequest) io.ReadCloser {
+	pr, pw := io.Pipe()
+	stop := context.AfterFunc(ctx, func() {
+		pw.CloseWithError(ctx.Err())
+	})
+	go func() {
+		defer stop()
+		_, err := req.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// readCloser combines an io.Reader and io.Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// responseBody closes the HTTP response body using Client.closeBody
+type responseBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	client *Client
+}
+
+// Close implements the io.Closer interface
+func (rb responseBody) Close() error {
+	rb.client.closeBody(rb.ctx, rb.ReadCloser)
+	return nil
+}
+
+// Command sends the command-request, returning the response body which the caller must close
+func (c *Client) Command(ctx context.Context, req *CommandRequest) (io.ReadCloser, error) {
+	respHTTP, err := c.command(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return responseBody{ReadCloser: respHTTP.Body, ctx: ctx, client: c}, nil
+}
+
+// LsRefs performs an ls-refs command-request
+func (c *Client) LsRefs(ctx context.Context, req *CommandRequest) (*ListReferencesResponse, error) {
+	var resp ListReferencesResponse
+	if c.Metrics != nil {
+		defer func(start time.Time) {
+			c.Metrics.ObserveLsRefs(len(resp.References), time.Since(start))
+		}(time.Now())
+	}
+	respHTTP, err := c.command(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeBody(ctx, respHTTP.Body)
+	if err := resp.ParseLimit(pktline.NewScanner(respHTTP.Body), c.MaxReferences); err != nil {
+		return nil, err
+	}
+	if objectFormat, ok := resp.InferObjectFormat(); ok {
+		c.setObjectFormat(objectFormat)
+	}
+	return &resp, nil
+}
+
+// LsRefsStream performs an ls-refs command-request, invoking fn for each reference as it arrives
+// The references are never collected, so memory usage is bounded regardless of the response size
+// If fn returns ErrStopIteration the response body is closed without being drained (which may
+// close the underlying connection rather than returning it to the pool) and nil is returned
+func (c *Client) LsRefsStream(ctx context.Context, req *CommandRequest, fn func(Reference) error) error {
+	var references int
+	if c.Metrics != nil {
+		defer func(start time.Time) {
+			c.Metrics.ObserveLsRefs(references, time.Since(start))
+		}(time.Now())
+	}
+	respHTTP, err := c.command(ctx, req)
+	if err != nil {
+		return err
+	}
+	var stopped bool
+	defer func() {
+		if stopped {
+			respHTTP.Body.Close()
+		} else {
+			c.closeBody(ctx, respHTTP.Body)
+		}
+	}()
+	var observed bool
+	return ForEachReference(pktline.NewScanner(respHTTP.Body), func(ref Reference) error {
+		if !observed {
+			observed = c.observeObjectFormat(ref.ObjectID)
+		}
+		if c.MaxReferences > 0 && references >= c.MaxReferences {
+			return fmt.Errorf("%w: more than %d", ErrTooManyReferences, c.MaxReferences)
+		}
+		references++
+		err := fn(ref)
+		if errors.Is(err, ErrStopIteration) {
+			stopped = true
+		}
+		return err
+	})
+}
+
+// ResolveRef returns the reference with the given name (including the symref-target and peeled
+// attributes if applicable), the ls-refs response is abandoned as soon as the reference is found
+func (c *Client) ResolveRef(ctx context.Context, name string) (*Reference, error) {
+	req, err := BuildLsRefsRequest(LsRefsOptions{
+		Symrefs:  true,
+		Peel:     true,
+		Prefixes: []string{name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var found *Reference
+	if err := c.LsRefsStream(ctx, req, func(ref Reference) error {
+		if ref.Name != name {
+			return nil
+		}
+		found = &ref
+		return ErrStopIteration
+	}); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+	return found, nil
+}
+
+// Fetch performs a fetch command-request, writing the packfile (if any) to the given writer
+func (c *Client) Fetch(ctx context.Context, req *CommandRequest, packfile io.Writer) (*FetchResponse, error) {
+	if c.PackfileBytesPerSecond > 0 {
+		packfile = NewRateLimitedWriter(ctx, packfile, c.PackfileBytesPerSecond)
+	}
+	if c.Metrics != nil {
+		cw := &countingWriter{w: packfile}
+		packfile = cw
+		defer func(start time.Time) {
+			c.Metrics.ObserveFetch(cw.n, time.Since(start))
+		}(time.Now())
+	}
+	if c.MaxRequestSize > 0 && len(req.Bytes()) > c.MaxRequestSize {
+		return c.fetchChunked(ctx, req, packfile)
+	}
+	return c.fetch(ctx, req, packfile)
+}
+
+// fetch performs a single fetch command-request round-trip
+func (c *Client) fetch(ctx context.Context, req *CommandRequest, packfile io.Writer) (*FetchResponse, error) {
+	respHTTP, err := c.command(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeBody(ctx, respHTTP.Body)
+	resp := FetchResponse{Request: req}
+	// Only a writer created for this response is closed, never the caller's Progress (ex: os.Stderr)
+	progress := c.Progress
+	var progressCloser io.Closer
+	if c.ProgressWriter != nil {
+		progress = c.ProgressWriter(SideBandProgress)
+		progressCloser, _ = progress.(io.Closer)
+	} else if progress != nil && c.ProgressFilter != nil {
+		filter := NewProgressFilter(progress, c.ProgressFilter)
+		progress, progressCloser = filter, filter
+	}
+	packfile, flush := bufferPackfile(packfile, c.PackfileBufferSize)
+	err = resp.parse(pktline.NewScanner(respHTTP.Body), c.NegotiatedObjectFormat(), packfile, progress, c.UnknownSideBand, loggerOrDiscard(c.Logger))
+	// The buffered packfile is flushed even if parsing failed, as it would have been written unbuffered
+	if flushErr := flush(); err == nil {
+		err = flushErr
+	}
+	if progressCloser != nil {
+		if closeErr := progressCloser.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// fetchChunked splits the haves of an oversized fetch command-request across rounds of Negotiate,
+// sized so that each round (ignoring the re-sent common haves) fits within MaxRequestSize
+func (c *Client) fetchChunked(ctx context.Context, req *CommandRequest, packfile io.Writer) (*FetchResponse, error) {
+	haves := req.Haves()
+	if len(haves) == 0 || !req.Arguments.Has(ArgumentDone) {
+		return nil, fmt.Errorf("fetch request of %d bytes exceeds MaxRequestSize (%d)", len(req.Bytes()), c.MaxRequestSize)
+	}
+	base := req.Clone()
+	base.Arguments = slices.DeleteFunc(base.Arguments, func(arg CommandArgument) bool {
+		return arg.Key == ArgumentHave || arg.Key == ArgumentDone
+	})
+	room := c.MaxRequestSize - len(base.Bytes()) - len(CommandArgument{Key: ArgumentDone}.Bytes())
+	batchSize := room / len(CommandArgument{Key: ArgumentHave, Value: haves[0]}.Bytes())
+	if batchSize < 1 {
+		return nil, fmt.Errorf("fetch request of %d bytes (excluding haves) exceeds MaxRequestSize (%d)", len(base.Bytes()), c.MaxRequestSize)
+	}
+	return Negotiate(ctx, func(ctx context.Context, round *CommandRequest) (*FetchResponse, error) {
+		if size := len(round.Bytes()); size > c.MaxRequestSize {
+			return nil, fmt.Errorf("fetch round of %d bytes exceeds MaxRequestSize (%d)", size, c.MaxRequestSize)
+		}
+		return c.fetch(ctx, round, packfile)
+	}, base, haves, NegotiateOptions{BatchSize: batchSize})
+}
+
+// FetchToFile performs a fetch command-request, streaming the packfile to a temporary file in dir
+// The caller is responsible for removing the file at packPath, it is removed automatically on error
+func (c *Client) FetchToFile(ctx context.Context, req *CommandRequest, dir string) (packPath string, resp *FetchResponse, err error) {
+	f, err := os.CreateTemp(dir, "fetch-*.pack")
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	resp, err = c.Fetch(ctx, req, f)
+	if err != nil {
+		f.Close()
+		return "", nil, err
+	}
+	if err := f.Close(); err != nil {
+		return "", nil, err
+	}
+	return f.Name(), resp, nil
+}
+
+// Head returns the HEAD reference (including the symref-target attribute if a symbolic ref)
+func (c *Client) Head(ctx context.Context) (*Reference, error) {
+	return c.ResolveRef(ctx, "HEAD")
+}
+
+// DefaultBranch returns the ref that HEAD points to (ex: refs/heads/main)
+func (c *Client) DefaultBranch(ctx context.Context) (string, error) {
+	head, err := c.Head(ctx)
+	if err != nil {
+		return "", err
+	}
+	target, ok := head.SymrefTarget()
+	if !ok {
+		return "", fmt.Errorf("HEAD is detached at %s", head.ObjectID)
+	}
+	return target, nil
+}
+
+// ObjectInfo performs an object-info command-request
+func (c *Client) ObjectInfo(ctx context.Context, req *CommandRequest) (*ObjectInfoResponse, error) {
+	respHTTP, err := c.command(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeBody(ctx, respHTTP.Body)
+	var resp ObjectInfoResponse
+	if err := resp.Parse(pktline.NewScanner(respHTTP.Body)); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// BundleURI performs a bundle-uri command-request
+func (c *Client) BundleURI(ctx context.Context, req *CommandRequest) (*BundleURIResponse, error) {
+	respHTTP, err := c.command(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeBody(ctx, respHTTP.Body)
+	var resp BundleURIResponse
+	if err := resp.Parse(pktline.NewScanner(respHTTP.Body)); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
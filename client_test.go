@@ -0,0 +1,934 @@
+package protocolv2
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+// newTestServer returns a smart HTTP server with the given capabilities and git-upload-pack handler
+func newTestServer(t *testing.T, caps Capabilities, handler func(req *CommandRequest, w io.Writer)) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /info/refs", func(w http.ResponseWriter, r *http.Request) {
+		var b []byte
+		b = pktline.AppendString(b, "# service=git-upload-pack\n")
+		b = pktline.AppendFlushPkt(b)
+		b = CapabilityAdvertisement{Capabilities: caps}.Append(b)
+		w.Write(b)
+	})
+	mux.HandleFunc("POST /git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		var req CommandRequest
+		if err := req.Parse(pktline.NewScanner(r.Body)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handler(&req, w)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClientSupportsCommand(t *testing.T) {
+	srv := newTestServer(t, Capabilities{
+		{Key: CapabilityListReferences},
+	}, func(req *CommandRequest, w io.Writer) {
+		w.Write(ListReferencesResponse{References: []Reference{
+			{ObjectID: "0000000000000000000000000000000000000001", Name: "HEAD"},
+		}}.Bytes())
+	})
+	client := Client{URL: srv.URL}
+	resp, err := client.LsRefs(context.Background(), &CommandRequest{Command: CapabilityListReferences})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.References) != 1 {
+		t.Fatalf("expected 1 reference, got %d", len(resp.References))
+	}
+	if _, err := client.Fetch(context.Background(), &CommandRequest{Command: CapabilityFetch}, io.Discard); !errors.Is(err, ErrCommandNotSupported) {
+		t.Fatalf("expected ErrCommandNotSupported, got %v", err)
+	} else if err.Error() != "command not supported by server: fetch" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClientConcurrent(t *testing.T) {
+	srv := newTestServer(t, Capabilities{
+		{Key: CapabilityListReferences},
+		{Key: CapabilityObjectFormat, Value: "sha256"},
+	}, func(req *CommandRequest, w io.Writer) {
+		w.Write(ListReferencesResponse{References: []Reference{
+			{ObjectID: strings.Repeat("1", 64), Name: "HEAD"},
+		}}.Bytes())
+	})
+	// The cached advertisement, object-format and HTTP client are shared by every goroutine (see go test -race)
+	client := Client{URL: srv.URL, ObjectFormat: "sha256", HTTPVersion: HTTPVersion1}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.LsRefs(context.Background(), &CommandRequest{Command: CapabilityListReferences}); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if got := client.NegotiatedObjectFormat(); got != "sha256" {
+		t.Fatalf("expected object-format %q, got %q", "sha256", got)
+	}
+}
+
+func TestClientServiceURL(t *testing.T) {
+	tests := map[string]struct {
+		client         *Client
+		wantInfoRefs   string
+		wantUploadPack string
+	}{
+		"default": {
+			client:         &Client{URL: "https://example.com/repo.git"},
+			wantInfoRefs:   "https://example.com/repo.git/info/refs?service=git-upload-pack",
+			wantUploadPack: "https://example.com/repo.git/git-upload-pack",
+		},
+		"custom": {
+			client:         &Client{URL: "https://example.com/repo.git", UploadPackService: "fetch"},
+			wantInfoRefs:   "https://example.com/repo.git/info/refs?service=fetch",
+			wantUploadPack: "https://example.com/repo.git/fetch",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.client.InfoRefsURL(tc.client.uploadPackService()); got != tc.wantInfoRefs {
+				t.Fatalf("expected %q, got %q", tc.wantInfoRefs, got)
+			}
+			if got := tc.client.UploadPackURL(); got != tc.wantUploadPack {
+				t.Fatalf("expected %q, got %q", tc.wantUploadPack, got)
+			}
+		})
+	}
+
+	// The requests are sent to the custom service, with the content type named after it
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /info/refs", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("service") != "fetch" {
+			http.Error(w, "unexpected service", http.StatusBadRequest)
+			return
+		}
+		w.Write(CapabilityAdvertisement{Capabilities: Capabilities{{Key: CapabilityListReferences}}}.Bytes())
+	})
+	mux.HandleFunc("POST /fetch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-fetch-request" {
+			http.Error(w, "unexpected content type", http.StatusBadRequest)
+			return
+		}
+		w.Write(ListReferencesResponse{}.Bytes())
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	client := Client{URL: srv.URL, UploadPackService: "fetch"}
+	if _, err := client.LsRefs(context.Background(), &CommandRequest{Command: CapabilityListReferences}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// inflateWriter buffers the compressed progress, inflating it to w once closed
+type inflateWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (iw *inflateWriter) Write(p []byte) (int, error) {
+	return iw.buf.Write(p)
+}
+
+func (iw *inflateWriter) Close() error {
+	_, err := io.Copy(iw.w, flate.NewReader(&iw.buf))
+	return err
+}
+
+func TestClientProgressWriter(t *testing.T) {
+	progress := "Enumerating objects: 1, done.\n"
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	io.WriteString(fw, progress)
+	fw.Close()
+	tests := map[string]struct {
+		payload  []byte
+		compress bool
+	}{
+		"progress": {
+			payload: []byte(progress),
+		},
+		"compressed": {
+			payload:  compressed.Bytes(),
+			compress: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t, Capabilities{{Key: CapabilityFetch}}, func(req *CommandRequest, w io.Writer) {
+				var b []byte
+				b = pktline.AppendString(b, "packfile\n")
+				b = pktline.AppendBytes(b, append([]byte{byte(SideBandProgress)}, tc.payload...))
+				b = pktline.AppendBytes(b, append([]byte{byte(SideBandPack)}, "PACK"...))
+				b = pktline.AppendFlushPkt(b)
+				w.Write(b)
+			})
+			var buf bytes.Buffer
+			client := Client{URL: srv.URL, Progress: &buf}
+			var sidebands []SideBand
+			if tc.compress {
+				client.ProgressWriter = func(sideband SideBand) io.Writer {
+					sidebands = append(sidebands, sideband)
+					return &inflateWriter{w: &buf}
+				}
+			}
+			if _, err := client.Fetch(context.Background(), &CommandRequest{Command: CapabilityFetch}, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != progress {
+				t.Fatalf("expected %q, got %q", progress, buf.String())
+			}
+			if tc.compress && !reflect.DeepEqual(sidebands, []SideBand{SideBandProgress}) {
+				t.Fatalf("unexpected sidebands: %v", sidebands)
+			}
+		})
+	}
+}
+
+func TestClientProgressFilter(t *testing.T) {
+	srv := newTestServer(t, Capabilities{{Key: CapabilityFetch}}, func(req *CommandRequest, w io.Writer) {
+		var b []byte
+		b = pktline.AppendString(b, "packfile\n")
+		b = pktline.AppendBytes(b, append([]byte{byte(SideBandProgress)}, "Counting objects: 100% (1/1)\rCounting objects: 100% (1/1), done.\nTotal 1"...))
+		b = pktline.AppendBytes(b, append([]byte{byte(SideBandPack)}, "PACK"...))
+		b = pktline.AppendFlushPkt(b)
+		w.Write(b)
+	})
+	var buf bytes.Buffer
+	client := Client{URL: srv.URL, Progress: &buf, ProgressFilter: func(line []byte) bool {
+		return !bytes.HasSuffix(line, []byte("\r"))
+	}}
+	if _, err := client.Fetch(context.Background(), &CommandRequest{Command: CapabilityFetch}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	// The final line is never terminated by the server, but is flushed once the fetch completes
+	if want := "Counting objects: 100% (1/1), done.\nTotal 1"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestClientFetchToFile(t *testing.T) {
+	tests := map[string]struct {
+		payload string
+		wantErr bool
+	}{
+		"packfile": {
+			payload: "000dpackfile\n0009\x01PACK0000",
+		},
+		"truncated": {
+			payload: "000dpackfile\n0009\x01PACK",
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t, Capabilities{
+				{Key: CapabilityFetch},
+			}, func(req *CommandRequest, w io.Writer) {
+				io.WriteString(w, tc.payload)
+			})
+			dir := t.TempDir()
+			client := Client{URL: srv.URL}
+			packPath, _, err := client.FetchToFile(context.Background(), &CommandRequest{Command: CapabilityFetch}, dir)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Fatalf("expected temporary file to be removed")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if b, err := os.ReadFile(packPath); err != nil {
+				t.Fatal(err)
+			} else if string(b) != "PACK" {
+				t.Fatalf("unexpected packfile: %q", string(b))
+			}
+		})
+	}
+}
+
+// testMetrics records the observations made by a Client
+type testMetrics struct {
+	fetchBytes []int64
+	references []int
+}
+
+func (tm *testMetrics) ObserveFetch(bytesWritten int64, duration time.Duration) {
+	tm.fetchBytes = append(tm.fetchBytes, bytesWritten)
+}
+
+func (tm *testMetrics) ObserveLsRefs(references int, duration time.Duration) {
+	tm.references = append(tm.references, references)
+}
+
+func TestClientMetrics(t *testing.T) {
+	srv := newTestServer(t, Capabilities{
+		{Key: CapabilityListReferences},
+		{Key: CapabilityFetch},
+	}, func(req *CommandRequest, w io.Writer) {
+		switch req.Command {
+		case CapabilityListReferences:
+			w.Write(ListReferencesResponse{References: []Reference{
+				{ObjectID: "0000000000000000000000000000000000000001", Name: "HEAD"},
+				{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+			}}.Bytes())
+		case CapabilityFetch:
+			io.WriteString(w, "000dpackfile\n0011\x02progress...\n0009\x01PACK0009\x01DATA0000")
+		}
+	})
+	var metrics testMetrics
+	client := Client{URL: srv.URL, Metrics: &metrics}
+	if _, err := client.LsRefs(context.Background(), &CommandRequest{Command: CapabilityListReferences}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Fetch(context.Background(), &CommandRequest{Command: CapabilityFetch}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metrics.references, []int{2}) {
+		t.Fatalf("unexpected ls-refs observations: %v", metrics.references)
+	}
+	if !reflect.DeepEqual(metrics.fetchBytes, []int64{8}) {
+		t.Fatalf("unexpected fetch observations: %v", metrics.fetchBytes)
+	}
+}
+
+func TestClientFetchRequest(t *testing.T) {
+	srv := newTestServer(t, Capabilities{{Key: CapabilityFetch}}, func(req *CommandRequest, w io.Writer) {
+		io.WriteString(w, "000dpackfile\n0009\x01PACK0000")
+	})
+	client := Client{URL: srv.URL}
+	req := &CommandRequest{Command: CapabilityFetch, Arguments: CommandArguments{{Key: ArgumentWant, Value: "a"}, {Key: ArgumentDone}}}
+	resp, err := client.Fetch(context.Background(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Request != req {
+		t.Fatalf("expected the originating request, got %v", resp.Request)
+	}
+	if want := "request: command=fetch wants=1 want-refs=0 haves=0 done=true\n"; resp.Describe() != want {
+		t.Fatalf("expected %q, got %q", want, resp.Describe())
+	}
+
+	// Parsed standalone there is no request
+	var fr FetchResponse
+	if err := fr.Parse(pktline.NewScanner(strings.NewReader("000dpackfile\n0009\x01PACK0000")), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fr.Request != nil {
+		t.Fatalf("expected no request, got %v", fr.Request)
+	}
+}
+
+func TestClientDefaultBranch(t *testing.T) {
+	tests := map[string]struct {
+		refs    []Reference
+		want    string
+		wantErr string
+	}{
+		"symref": {
+			refs: []Reference{
+				{ObjectID: "0000000000000000000000000000000000000001", Name: "HEAD", Attributes: []string{"symref-target:refs/heads/main"}},
+			},
+			want: "refs/heads/main",
+		},
+		"detached": {
+			refs: []Reference{
+				{ObjectID: "0000000000000000000000000000000000000001", Name: "HEAD"},
+			},
+			wantErr: "HEAD is detached at 0000000000000000000000000000000000000001",
+		},
+		"missing": {
+			wantErr: "HEAD not found",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t, Capabilities{
+				{Key: CapabilityListReferences},
+			}, func(req *CommandRequest, w io.Writer) {
+				if !req.Arguments.Has(ArgumentSymRefs) {
+					t.Errorf("expected symrefs argument")
+				}
+				w.Write(ListReferencesResponse{References: tc.refs}.Bytes())
+			})
+			client := Client{URL: srv.URL}
+			got, err := client.DefaultBranch(context.Background())
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestClientAgent(t *testing.T) {
+	tests := map[string]struct {
+		caps      Capabilities
+		userAgent string
+		want      string
+		wantOK    bool
+	}{
+		"advertised": {
+			caps:      Capabilities{{Key: CapabilityAgent, Value: "git/2.45.0"}, {Key: CapabilityListReferences}},
+			userAgent: "git/1.0",
+			want:      "git/1.0",
+			wantOK:    true,
+		},
+		"not advertised": {
+			caps:      Capabilities{{Key: CapabilityListReferences}},
+			userAgent: "git/1.0",
+		},
+		"invalid agent": {
+			caps:      Capabilities{{Key: CapabilityAgent, Value: "git/2.45.0"}, {Key: CapabilityListReferences}},
+			userAgent: "Mozilla/5.0 (X11)",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got string
+			var gotOK bool
+			srv := newTestServer(t, tc.caps, func(req *CommandRequest, w io.Writer) {
+				got, gotOK = req.Capabilities.Get(CapabilityAgent)
+				w.Write(ListReferencesResponse{}.Bytes())
+			})
+			client := Client{URL: srv.URL, UserAgent: tc.userAgent}
+			req := &CommandRequest{Command: CapabilityListReferences}
+			if _, err := client.LsRefs(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want || gotOK != tc.wantOK {
+				t.Fatalf("expected agent (%q, %v), got (%q, %v)", tc.want, tc.wantOK, got, gotOK)
+			}
+			if req.Capabilities.Has(CapabilityAgent) {
+				t.Fatalf("expected request not to be modified")
+			}
+		})
+	}
+}
+
+func TestClientHTTPVersion(t *testing.T) {
+	tests := map[string]struct {
+		version HTTPVersion
+		want    int
+	}{
+		"http/1.1": {
+			version: HTTPVersion1,
+			want:    1,
+		},
+		"http/2": {
+			version: HTTPVersion2,
+			want:    2,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var proto int
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proto = r.ProtoMajor
+				var b []byte
+				b = pktline.AppendString(b, "# service=git-upload-pack\n")
+				b = pktline.AppendFlushPkt(b)
+				b = CapabilityAdvertisement{}.Append(b)
+				w.Write(b)
+			}))
+			srv.EnableHTTP2 = true
+			srv.StartTLS()
+			t.Cleanup(srv.Close)
+
+			client := Client{URL: srv.URL, HTTPClient: srv.Client(), HTTPVersion: tc.version}
+			if _, err := client.Capabilities(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if proto != tc.want {
+				t.Fatalf("expected HTTP/%d, got HTTP/%d", tc.want, proto)
+			}
+		})
+	}
+}
+
+// cancelWriter cancels the context on the first write
+type cancelWriter struct {
+	cancel context.CancelFunc
+}
+
+// Write implements the io.Writer interface
+func (cw cancelWriter) Write(p []byte) (int, error) {
+	cw.cancel()
+	return len(p), nil
+}
+
+func TestClientFetchCancel(t *testing.T) {
+	closed := make(chan struct{})
+	srv := newTestServer(t, Capabilities{{Key: CapabilityFetch}}, func(req *CommandRequest, w io.Writer) {
+		defer close(closed)
+		io.WriteString(w, "000dpackfile\n0009\x01PACK")
+		// Stream until the client goes away
+		for {
+			if _, err := io.WriteString(w, "0009\x01DATA"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	})
+	client := Client{URL: srv.URL, DrainLimit: 1 << 20}
+	if _, err := client.Capabilities(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := client.Fetch(ctx, &CommandRequest{Command: CapabilityFetch}, cancelWriter{cancel}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("response body was not closed")
+	}
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > goroutines; {
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked goroutines: expected at most %d, got %d", goroutines, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientObjectFormat(t *testing.T) {
+	sha1ID := strings.Repeat("1", 40)
+	sha256ID := strings.Repeat("2", 64)
+	tests := map[string]struct {
+		caps     Capabilities
+		objectID string
+		want     string
+		wantSent string
+	}{
+		"matching": {
+			caps:     Capabilities{{Key: CapabilityObjectFormat, Value: "sha256"}, {Key: CapabilityListReferences}},
+			objectID: sha256ID,
+			want:     "sha256",
+			wantSent: "sha256",
+		},
+		"downgrade": {
+			caps:     Capabilities{{Key: CapabilityObjectFormat, Value: "sha1"}, {Key: CapabilityListReferences}},
+			objectID: sha1ID,
+			want:     "sha1",
+			wantSent: "sha1",
+		},
+		"not advertised": {
+			caps:     Capabilities{{Key: CapabilityListReferences}},
+			objectID: sha1ID,
+			want:     "sha1",
+		},
+		"detected from references": {
+			caps:     Capabilities{{Key: CapabilityListReferences}},
+			objectID: sha256ID,
+			want:     "sha256",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var sent string
+			srv := newTestServer(t, tc.caps, func(req *CommandRequest, w io.Writer) {
+				sent, _ = req.Capabilities.Get(CapabilityObjectFormat)
+				w.Write(ListReferencesResponse{References: []Reference{
+					{ObjectID: tc.objectID, Name: "refs/heads/main"},
+				}}.Bytes())
+			})
+			client := Client{URL: srv.URL, ObjectFormat: "sha256"}
+			if _, err := client.LsRefs(context.Background(), &CommandRequest{Command: CapabilityListReferences}); err != nil {
+				t.Fatal(err)
+			}
+			if sent != tc.wantSent {
+				t.Fatalf("expected object-format %q to be sent, got %q", tc.wantSent, sent)
+			}
+			if got := client.NegotiatedObjectFormat(); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestClientCapabilitiesWithoutPreamble(t *testing.T) {
+	payload, err := os.ReadFile(filepath.Join("testdata", "git-2.39-sha1.advertisement"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// git http-backend omits the smart-HTTP preamble when responding with protocol-v2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	t.Cleanup(srv.Close)
+	client := Client{URL: srv.URL}
+	ca, err := client.Capabilities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.SupportsCommand(CapabilityObjectInfo) {
+		t.Fatalf("expected object-info to be supported")
+	}
+}
+
+func TestClientCapabilitiesPreamble(t *testing.T) {
+	payload, err := os.ReadFile(filepath.Join("testdata", "git-2.39-sha1.advertisement"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		preamble string
+		wantErr  string
+	}{
+		"without preamble": {},
+		"preamble": {
+			preamble: "001e# service=git-upload-pack\n0000",
+		},
+		"unexpected service": {
+			preamble: "001f# service=git-receive-pack\n0000",
+			wantErr:  "unexpected service in smart-http preamble: \"git-receive-pack\"",
+		},
+		"missing flush-pkt": {
+			preamble: "001e# service=git-upload-pack\n",
+			wantErr:  "expected flush-pkt after smart-http preamble: \"version 2\\n\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(append([]byte(tc.preamble), payload...))
+			}))
+			t.Cleanup(srv.Close)
+			client := Client{URL: srv.URL}
+			ca, err := client.Capabilities(context.Background())
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err.Error())
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !ca.SupportsCommand(CapabilityFetch) {
+				t.Fatalf("expected fetch to be supported")
+			}
+		})
+	}
+}
+
+func TestClientCapabilitiesTrailingData(t *testing.T) {
+	payload, err := os.ReadFile(filepath.Join("testdata", "git-2.39-sha1.advertisement"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A second flush-pkt and a keepalive appended by an intermediary
+		w.Write(append(payload, "00000005\x02"...))
+	}))
+	t.Cleanup(srv.Close)
+	var logs bytes.Buffer
+	client := Client{
+		URL:        srv.URL,
+		Logger:     slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		DrainLimit: 1024,
+	}
+	ca, err := client.Capabilities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.SupportsCommand(CapabilityListReferences) {
+		t.Fatalf("expected ls-refs to be supported")
+	}
+	if !strings.Contains(logs.String(), "discarded unread bytes of response body\" bytes=9") {
+		t.Fatalf("expected the trailing bytes to be discarded, got logs: %s", logs.String())
+	}
+}
+
+func TestClientLsRefsStream(t *testing.T) {
+	srv := newTestServer(t, Capabilities{{Key: CapabilityListReferences}}, func(req *CommandRequest, w io.Writer) {
+		w.Write(ListReferencesResponse{References: []Reference{
+			{ObjectID: "0000000000000000000000000000000000000001", Name: "HEAD"},
+			{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+		}}.Bytes())
+	})
+	var metrics testMetrics
+	client := Client{URL: srv.URL, Metrics: &metrics}
+	var names []string
+	if err := client.LsRefsStream(context.Background(), &CommandRequest{Command: CapabilityListReferences}, func(ref Reference) error {
+		names = append(names, ref.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"HEAD", "refs/heads/main"}) {
+		t.Fatalf("unexpected references: %v", names)
+	}
+	if !reflect.DeepEqual(metrics.references, []int{2}) {
+		t.Fatalf("unexpected ls-refs observations: %v", metrics.references)
+	}
+}
+
+func TestClientMaxReferences(t *testing.T) {
+	srv := newTestServer(t, Capabilities{{Key: CapabilityListReferences}}, func(req *CommandRequest, w io.Writer) {
+		w.Write(ListReferencesResponse{References: []Reference{
+			{ObjectID: "0000000000000000000000000000000000000001", Name: "HEAD"},
+			{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+			{ObjectID: "0000000000000000000000000000000000000002", Name: "refs/heads/next"},
+		}}.Bytes())
+	})
+	var metrics testMetrics
+	client := Client{URL: srv.URL, Metrics: &metrics, MaxReferences: 2}
+	req := &CommandRequest{Command: CapabilityListReferences}
+	if _, err := client.LsRefs(context.Background(), req); !errors.Is(err, ErrTooManyReferences) {
+		t.Fatalf("expected ErrTooManyReferences, got %v", err)
+	}
+	var names []string
+	if err := client.LsRefsStream(context.Background(), req, func(ref Reference) error {
+		names = append(names, ref.Name)
+		return nil
+	}); !errors.Is(err, ErrTooManyReferences) {
+		t.Fatalf("expected ErrTooManyReferences, got %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"HEAD", "refs/heads/main"}) {
+		t.Fatalf("unexpected references: %v", names)
+	}
+	if !reflect.DeepEqual(metrics.references, []int{2, 2}) {
+		t.Fatalf("unexpected ls-refs observations: %v", metrics.references)
+	}
+}
+
+func TestClientResolveRef(t *testing.T) {
+	refs := []Reference{
+		{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+		{ObjectID: "0000000000000000000000000000000000000002", Name: "refs/heads/main-old"},
+	}
+	tests := map[string]struct {
+		name    string
+		want    *Reference
+		wantErr string
+	}{
+		"first": {
+			name: "refs/heads/main",
+			want: &refs[0],
+		},
+		"prefix match": {
+			name: "refs/heads/main-old",
+			want: &refs[1],
+		},
+		"missing": {
+			name:    "refs/heads/next",
+			wantErr: "refs/heads/next not found",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t, Capabilities{{Key: CapabilityListReferences}}, func(req *CommandRequest, w io.Writer) {
+				if !reflect.DeepEqual(req.Arguments.GetAll(ArgumentRefPrefix), []string{tc.name}) {
+					t.Errorf("unexpected ref-prefix arguments: %v", req.Arguments)
+				}
+				w.Write(ListReferencesResponse{References: refs}.Bytes())
+			})
+			client := Client{URL: srv.URL}
+			got, err := client.ResolveRef(context.Background(), tc.name)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestClientMaxRequestSize(t *testing.T) {
+	want := CommandArgument{Key: ArgumentWant, Value: "0000000000000000000000000000000000000001"}
+	var haves []string
+	for idx := range 6 {
+		haves = append(haves, fmt.Sprintf("%040x", idx+2))
+	}
+	base := CommandRequest{Command: CapabilityFetch, Arguments: CommandArguments{want}}
+	limit := len(base.Bytes()) + len(CommandArgument{Key: ArgumentDone}.Bytes()) + 2*len(CommandArgument{Key: ArgumentHave, Value: haves[0]}.Bytes())
+
+	var rounds [][]string
+	srv := newTestServer(t, Capabilities{{Key: CapabilityFetch}}, func(req *CommandRequest, w io.Writer) {
+		if size := len(req.Bytes()); size > limit {
+			t.Errorf("request of %d bytes exceeds the limit of %d", size, limit)
+		}
+		rounds = append(rounds, req.Haves())
+		if !req.Arguments.Has(ArgumentDone) {
+			w.Write(FetchResponse{Acknowledgements: Acknowledgements{NAK: true}}.Bytes())
+			return
+		}
+		b := FetchResponse{}.Bytes()
+		b = pktline.AppendBytes(b, append([]byte{byte(pktline.SideBandPackData)}, "PACK"...))
+		b = pktline.AppendFlushPkt(b)
+		w.Write(b)
+	})
+	client := Client{URL: srv.URL, MaxRequestSize: limit}
+
+	req := base.Clone()
+	for _, objID := range haves {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentHave, Value: objID})
+	}
+	req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentDone})
+	var packfile bytes.Buffer
+	if _, err := client.Fetch(context.Background(), req, &packfile); err != nil {
+		t.Fatal(err)
+	}
+	if packfile.String() != "PACK" {
+		t.Fatalf("unexpected packfile: %q", packfile.String())
+	}
+	wantRounds := [][]string{haves[0:2], haves[2:4], haves[4:6], nil}
+	if !reflect.DeepEqual(rounds, wantRounds) {
+		t.Fatalf("expected rounds %v, got %v", wantRounds, rounds)
+	}
+
+	// Without "done" the caller is negotiating itself, so the request cannot be split
+	req.Arguments = req.Arguments[:len(req.Arguments)-1]
+	if _, err := client.Fetch(context.Background(), req, &packfile); err == nil {
+		t.Fatalf("expected error, got nil")
+	} else if want := fmt.Sprintf("fetch request of %d bytes exceeds MaxRequestSize (%d)", len(req.Bytes()), limit); err.Error() != want {
+		t.Fatalf("expected error %q, got %q", want, err)
+	}
+}
+
+func TestClientStreamsRequest(t *testing.T) {
+	req := &CommandRequest{Command: CapabilityListReferences}
+	tests := map[string]struct {
+		postBuffer        int
+		wantContentLength int64
+	}{
+		"buffered": {
+			wantContentLength: int64(len(req.Bytes())),
+		},
+		"streamed": {
+			postBuffer: 1,
+			// The request body is streamed, so its length is unknown up front
+			wantContentLength: -1,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /info/refs", func(w http.ResponseWriter, r *http.Request) {
+				w.Write(CapabilityAdvertisement{Capabilities: Capabilities{{Key: CapabilityListReferences}}}.Bytes())
+			})
+			mux.HandleFunc("POST /git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+				if r.ContentLength != tc.wantContentLength {
+					t.Errorf("expected Content-Length %d, got %d", tc.wantContentLength, r.ContentLength)
+				}
+				var req CommandRequest
+				if err := req.Parse(pktline.NewScanner(r.Body)); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				w.Write(ListReferencesResponse{}.Bytes())
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+			var trace bytes.Buffer
+			client := Client{URL: srv.URL, PostBuffer: tc.postBuffer, Trace: &trace}
+			if _, err := client.LsRefs(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(trace.String(), "> command=ls-refs") {
+				t.Fatalf("expected the request to be traced, got %q", trace.String())
+			}
+		})
+	}
+}
+
+func TestStreamCommandRequestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	body := streamCommandRequest(ctx, &CommandRequest{Command: CapabilityFetch})
+	cancel()
+	if _, err := io.ReadAll(body); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestClientDedupCapabilities(t *testing.T) {
+	srv := newTestServer(t, Capabilities{
+		{Key: CapabilityObjectFormat, Value: "sha1"},
+		{Key: CapabilityListReferences},
+		{Key: CapabilityObjectFormat, Value: "sha256"},
+	}, func(req *CommandRequest, w io.Writer) {})
+	tests := map[string]struct {
+		dedup bool
+		want  string
+	}{
+		"first": {
+			want: "sha1",
+		},
+		"dedup": {
+			dedup: true,
+			want:  "sha256",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := Client{URL: srv.URL, DedupCapabilities: tc.dedup}
+			ca, err := client.Capabilities(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := ca.Capabilities.Get(CapabilityObjectFormat); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+			if got := client.NegotiatedObjectFormat(); got != tc.want {
+				t.Fatalf("expected negotiated %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -21,9 +19,10 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	service := pflag.String("service", "git-upload-pack", "service parameter in the query string")
+	service := pflag.String("service", git.ServiceUploadPack, "service parameter in the query string")
 	smart := pflag.Bool("smart", true, "expect smart HTTP protocol response")
 	userAgent := pflag.String("user-agent", "git/1.0", "Set the User-Agent header in the HTTP request.")
+	drainLimit := pflag.Int64("drain-limit", 64*1024, "Maximum number of trailing bytes after the capability-advertisement to discard.")
 	pflag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <url>\n", filepath.Base(os.Args[0]))
 		pflag.PrintDefaults()
@@ -33,13 +32,13 @@ func main() {
 		pflag.Usage()
 		os.Exit(1)
 	}
-	url := pflag.Arg(0) + "/info/refs?service=" + *service
+	client := git.Client{URL: pflag.Arg(0)}
 
-	reqHTTP, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	reqHTTP, err := http.NewRequestWithContext(ctx, http.MethodGet, client.InfoRefsURL(*service), nil)
 	if err != nil {
 		log.Fatalf("http.NewRequest failed: %v", err)
 	}
-	reqHTTP.Header.Set("Git-Protocol", "version=2")
+	reqHTTP.Header.Set("Git-Protocol", git.GitProtocolHeader(""))
 	reqHTTP.Header.Set("User-Agent", *userAgent)
 
 	respHTTP, err := http.DefaultClient.Do(reqHTTP)
@@ -59,13 +58,8 @@ func main() {
 
 	scanner := pktline.NewScanner(respHTTP.Body)
 	if *smart {
-		if smartHTTP, err := scanner.Scan(); err != nil {
-			log.Fatalf("scanner.Scan failed: %v", err)
-		} else if !bytes.Equal(smartHTTP, []byte("# service="+*service+"\n")) {
-			log.Fatalf("unexpected smart-http response: %q", string(smartHTTP))
-		}
-		if line, err := scanner.Scan(); !errors.Is(err, pktline.ErrFlushPkt) {
-			log.Fatalf("expected flush-pkt (%v), got: %q", err, string(line))
+		if err := git.ParseSmartHTTPPreamble(scanner, *service); err != nil {
+			log.Fatalf("failed to parse smart-http preamble: %v", err)
 		}
 	}
 
@@ -76,5 +70,10 @@ func main() {
 	for _, cap := range resp.Capabilities {
 		fmt.Println(cap.String())
 	}
-
+	// Some intermediaries append bytes after the flush-pkt (ex: a second flush-pkt or a keepalive)
+	if n, err := io.CopyN(io.Discard, respHTTP.Body, *drainLimit); err != nil && err != io.EOF {
+		log.Fatalf("failed to read trailing bytes: %v", err)
+	} else if n > 0 {
+		fmt.Fprintf(os.Stderr, "warning: ignored %d trailing bytes after capability-advertisement\n", n)
+	}
 }
@@ -2,12 +2,9 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -22,14 +19,14 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	want := pflag.StringSlice("want", nil, "Indicates to the server an object which the client wants to retrieve. Wants can be anything and are not limited to advertised objects.")
-	have := pflag.StringSlice("have", nil, "Indicates to the server an object which the client has locally. This allows the server to make a packfile which only contains the objects that the client needs. Multiple 'have' lines can be supplied.")
+	want := pflag.StringSlice("want", nil, "Indicates to the server an object which the client wants to retrieve. Wants are only permitted to be unadvertised objects if the server allows it (ex: uploadpack.allowReachableSHA1InWant).")
+	have := pflag.StringSlice("have", nil, "Indicates to the server an object which the client has locally. This allows the server to make a packfile which only contains the objects that the client needs. Multiple 'have' lines can be supplied, they are sent in rounds of negotiation until the server is ready.")
 	thinPack := pflag.Bool("thin-pack", false, "Request that a thin pack be sent, which is a pack with deltas which reference base objects not contained within the pack (but are known to exist at the receiving end). This can reduce the network traffic significantly, but it requires the receiving end to know how to \"thicken\" these packs by adding the missing bases to the pack.")
 	noProgress := pflag.Bool("no-progress", false, "Request that progress information that would normally be sent on side-band channel 2, during the packfile transfer, should not be sent. However, the side-band channel 3 is still used for error responses.")
 	includeTag := pflag.Bool("include-tag", false, "Request that annotated tags should be sent if the objects they point to are being sent.")
 	ofsDelta := pflag.Bool("ofs-delta", false, "Indicate that the client understands PACKv2 with delta referring to its base by position in pack rather than by an oid. That is, they can read OBJ_OFS_DELTA (aka type 6) in a packfile.")
 	shallows := pflag.StringSlice("shallow", nil, "A client must notify the server of all commits for which it only has shallow copies (meaning that it doesn't have the parents of a commit) by supplying a 'shallow <oid>' line for each such object so that the server is aware of the limitations of the client's history.")
-	deepen := pflag.String("deepen", "", "Requests that the fetch/clone should be shallow having a commit depth of <depth> relative to the remote side.")
+	deepen := pflag.Int("deepen", 0, "Requests that the fetch/clone should be shallow having a commit depth of <depth> relative to the remote side.")
 	deepenRelative := pflag.Bool("deepen-relative", false, "Requests that the semantics of the 'deepen' command be changed to indicate that the depth requested is relative to the client's current shallow boundary, instead of relative to the requested commits.")
 	deepenSince := pflag.String("deepen-since", "", "Requests that the shallow clone/fetch should be cut at a specific time, instead of depth. Internally it's equivalent to doing 'git rev-list --max-age=<timestamp>'. Cannot be used with 'deepen'.")
 	deepenNot := pflag.String("deepen-not", "", "Requests that the shallow clone/fetch should be cut at a specific revision specified by '<rev>', instead of a depth. Internally it's equivalent of doing 'git rev-list --not <rev>'. Cannot be used with 'deepen', but can be used with 'deepen-since'.")
@@ -37,8 +34,14 @@ func main() {
 	wantRefs := pflag.StringSlice("want-ref", nil, "Indicates to the server that the client wants to retrieve a particular ref, where <ref> is the full name of a ref on the server.")
 	packfileURIs := pflag.StringSlice("packfile-uris", nil, "Indicates to the server that the client is willing to receive URIs of any of the given protocols in place of objects in the sent packfile. Before performing the connectivity check, the client should download from all given URIs. Currently, the protocols supported are 'http' and 'https'.")
 	stdin := pflag.Bool("stdin", false, "Read the 'want' lines from stdin instead of '--want'.")
+	autoFeatures := pflag.Bool("auto-features", false, "Enable the arguments which are safe for the server (ofs-delta, and thin-pack with '--fix-thin') like git does by default.")
+	fixThin := pflag.Bool("fix-thin", false, "Indicate the packfile written to stdout will be thickened (ex: piped to 'git index-pack --stdin --fix-thin'), allowing '--auto-features' to enable thin-pack.")
+	disableFeatures := pflag.StringSlice("disable-feature", nil, "Never enable the given argument (ex: 'thin-pack') when using '--auto-features'.")
+	clone := pflag.Bool("clone", false, "Clone every advertised ref (as returned by 'ls-refs') instead of using '--want', '--have' and negotiation related flags.")
 	capabilities := pflag.StringSlice("capability", nil, "Advertise a client capability in the command-request.")
-	userAgent := pflag.String("user-agent", "git/1.0", "Set the User-Agent header in the HTTP request.")
+	dump := pflag.Bool("dump", false, "Print every pkt-line of the response (classified, with the packfile data summarized) instead of writing the packfile to stdout.")
+	service := pflag.String("service", git.ServiceUploadPack, "Service used in the info/refs query string and the path command-requests are sent to (ex: for servers with custom endpoints).")
+	userAgent := pflag.String("user-agent", "git/1.0", "Set the User-Agent header in the HTTP request (and the agent capability if advertised).")
 	pflag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <url>\n", filepath.Base(os.Args[0]))
 		pflag.PrintDefaults()
@@ -48,158 +51,135 @@ func main() {
 		pflag.Usage()
 		os.Exit(1)
 	}
-	url := pflag.Arg(0) + "/git-upload-pack"
-
 	// The --stdin flag allows us to add 'wants' directly piped from the output of 'ls-refs'
+	var tips []string
 	if *stdin {
 		scanner := bufio.NewScanner(os.Stdin)
-		uniq := make(map[string]struct{})
+		var refs []git.Reference
 		for scanner.Scan() {
-			oid, _, _ := strings.Cut(scanner.Text(), " ")
-			uniq[oid] = struct{}{}
+			var ref git.Reference
+			if err := ref.Parse([]byte(scanner.Text() + "\n")); err != nil {
+				log.Fatalf("failed to parse stdin: %v", err)
+			}
+			refs = append(refs, ref)
 		}
 		if err := scanner.Err(); err != nil {
 			log.Fatalf("bufio.Scanner.Scan stdin failed: %v", err)
 		}
-		for oid := range uniq {
-			*want = append(*want, oid)
-		}
-	}
-	if len(*want) == 0 && len(*wantRefs) == 0 {
-		fmt.Fprintln(os.Stderr, "At least one '--want' or '--want-ref' is required")
-		os.Exit(1)
+		tips = git.WantsFromReferences(refs)
+		*want = append(*want, tips...)
 	}
 
-	req := git.CommandRequest{
-		Command: "fetch",
-		Arguments: git.CommandArguments{
-			{
-				// We aren't doing true negotiation here, so tell the server to wait for us to finish sending our have/want lines before responding.
-				Key: git.ArgumentWaitForDone,
-			},
-		},
+	client := git.Client{
+		URL:               pflag.Arg(0),
+		UploadPackService: *service,
+		UserAgent:         *userAgent,
+		Progress:          os.Stderr,
+	}
+	advertisement, err := client.Capabilities(ctx)
+	if err != nil {
+		log.Fatalf("failed to retrieve capabilities: %v", err)
 	}
 
+	var extraCapabilities git.Capabilities
 	for _, cap := range *capabilities {
 		key, value, _ := strings.Cut(cap, "=")
-		req.Capabilities = append(req.Capabilities, git.Capability{
+		extraCapabilities = append(extraCapabilities, git.Capability{
 			Key:   key,
 			Value: value,
 		})
 	}
 
-	if *thinPack {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key: git.ArgumentThinPack,
-		})
-	}
-	if *noProgress {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key: git.ArgumentNoProgress,
-		})
-	}
-	if *includeTag {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key: git.ArgumentIncludeTag,
-		})
-	}
-	if *ofsDelta {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key: git.ArgumentOFSDelta,
-		})
-	}
-	for _, shallow := range *shallows {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key:   git.ArgumentShallow,
-			Value: shallow,
-		})
-	}
-	if *deepen != "" {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key:   git.ArgumentDeepen,
-			Value: *deepen,
-		})
-	}
-	if *deepenRelative {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key: git.ArgumentDeepenRelative,
-		})
-	}
-	if *deepenSince != "" {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key:   git.ArgumentDeepenSince,
-			Value: *deepenSince,
-		})
-	}
-	if *deepenNot != "" {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key:   git.ArgumentDeepenNot,
-			Value: *deepenNot,
-		})
-	}
-	if *filter != "" {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key:   git.ArgumentFilter,
-			Value: *filter,
-		})
-	}
-	for _, ref := range *wantRefs {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key:   git.ArgumentWantRef,
-			Value: ref,
-		})
-	}
-	if len(*packfileURIs) > 0 {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key:   git.ArgumentPackfileURIs,
-			Value: strings.Join(*packfileURIs, ","),
-		})
-	}
-
-	// "negotiation" phase
-	for _, oid := range *have {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key:   git.ArgumentHave,
-			Value: oid,
-		})
-	}
-	for _, oid := range *want {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key:   git.ArgumentWant,
-			Value: oid,
+	var req *git.CommandRequest
+	if *clone {
+		lsRefsReq, err := git.BuildLsRefsRequest(git.LsRefsOptions{Advertisement: advertisement})
+		if err != nil {
+			log.Fatalf("failed to build ls-refs request: %v", err)
+		}
+		refs, err := client.LsRefs(ctx, lsRefsReq)
+		if err != nil {
+			log.Fatalf("ls-refs failed: %v", err)
+		}
+		req, err = git.BuildCloneRequest(git.WantsFromReferences(refs.References), git.CloneOptions{
+			Capabilities: extraCapabilities,
+			Filter:       *filter,
+			Depth:        *deepen,
+			ThinPack:     *thinPack,
+			IncludeTag:   *includeTag,
+			OFSDelta:     *ofsDelta,
 		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else {
+		opts := git.FetchOptions{
+			Advertisement:   advertisement,
+			Capabilities:    extraCapabilities,
+			ThinPack:        *thinPack,
+			NoProgress:      *noProgress,
+			IncludeTag:      *includeTag,
+			OFSDelta:        *ofsDelta,
+			Shallows:        *shallows,
+			Deepen:          *deepen,
+			DeepenRelative:  *deepenRelative,
+			DeepenSince:     *deepenSince,
+			DeepenNot:       *deepenNot,
+			Filter:          *filter,
+			WantRefs:        *wantRefs,
+			PackfileURIs:    *packfileURIs,
+			Wants:           *want,
+			AutoFeatures:    *autoFeatures,
+			FixThin:         *fixThin,
+			DisableFeatures: *disableFeatures,
+			Tips:            tips,
+			OnUnadvertisedWants: func(wants []string) {
+				for _, objID := range wants {
+					fmt.Fprintf(os.Stderr, "warning: want %s was not advertised, the server may reject it\n", objID)
+				}
+			},
+		}
+		// The haves are sent by git.Negotiate in rounds without "done" (until the server is ready or
+		// they are exhausted), except when dumping the response to a single request
+		if *dump {
+			opts.Haves = *have
+			opts.Done = true
+		}
+		req, err = git.BuildFetchRequest(opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	}
-	req.Arguments = append(req.Arguments, git.CommandArgument{
-		Key: git.ArgumentDone,
-	})
 
-	reqHTTP, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(req.Bytes()))
-	if err != nil {
-		log.Fatalf("http.NewRequest failed: %v", err)
+	if *dump {
+		body, err := client.Command(ctx, req)
+		if err != nil {
+			log.Fatalf("fetch failed: %v", err)
+		}
+		defer body.Close()
+		frames, err := git.DecodeFrames(pktline.NewScanner(body))
+		for _, frame := range frames {
+			fmt.Println(frame)
+		}
+		if err != nil {
+			log.Fatalf("failed to decode response: %v", err)
+		}
+		return
 	}
-	reqHTTP.Header.Set("Git-Protocol", "version=2")
-	reqHTTP.Header.Set("User-Agent", *userAgent)
 
-	respHTTP, err := http.DefaultClient.Do(reqHTTP)
-	if err != nil {
-		log.Fatalf("http.DefaultClient.Do failed: %v", err)
+	fetch := func(ctx context.Context, req *git.CommandRequest) (*git.FetchResponse, error) {
+		return client.Fetch(ctx, req, os.Stdout)
 	}
-	defer func() {
-		if err := respHTTP.Body.Close(); err != nil {
-			log.Fatalf("(*http.Response).Body.Close failed: %v", err)
-		}
-	}()
-
-	if respHTTP.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(respHTTP.Body)
-		log.Fatalf("unexpected status code (%d): %s", respHTTP.StatusCode, string(body))
+	var resp *git.FetchResponse
+	if req.Arguments.Has(git.ArgumentDone) {
+		resp, err = fetch(ctx, req)
+	} else {
+		// Only the final round of negotiation contains the packfile
+		resp, err = git.Negotiate(ctx, fetch, req, *have, git.NegotiateOptions{})
 	}
-
-	scanner := pktline.NewScanner(respHTTP.Body)
-
-	var resp git.FetchResponse
-	if err := resp.Parse(scanner, os.Stdout, os.Stderr); err != nil {
-		log.Fatalf("failed to parse fetch response: %v", err)
+	if err != nil {
+		log.Fatalf("fetch failed: %v", err)
 	}
 
 	if resp.Acknowledgements.Ready {
@@ -220,6 +200,16 @@ func main() {
 	for _, wantedRef := range resp.WantedRefs {
 		fmt.Fprintf(os.Stderr, "wanted-ref %s %s\n", wantedRef.ObjectID, wantedRef.Name)
 	}
+	if len(*wantRefs) > 0 {
+		if err := resp.VerifyWantedRefs(*wantRefs); err != nil {
+			log.Fatalf("incomplete fetch: %v", err)
+		}
+	}
+	if len(*packfileURIs) > 0 {
+		if err := resp.VerifyPackfileURIs(*packfileURIs); err != nil {
+			log.Fatalf("untrusted packfile-uri: %v", err)
+		}
+	}
 	for _, packfileURI := range resp.PackfileURIs {
 		fmt.Fprintf(os.Stderr, "packfile-uri %s\n", packfileURI)
 	}
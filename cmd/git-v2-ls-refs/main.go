@@ -1,18 +1,15 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"context"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 
-	pktline "github.com/bored-engineer/git-pkt-line"
 	git "github.com/bored-engineer/git-protocol-v2"
 	"github.com/spf13/pflag"
 )
@@ -25,8 +22,10 @@ func main() {
 	peel := pflag.Bool("peel", false, "Show peeled tags.")
 	unborn := pflag.Bool("unborn", false, "request unborn refs")
 	refPrefixes := pflag.StringSlice("ref-prefix", nil, "When specified, only references having a prefix matching one of the provided prefixes are displayed. Multiple instances may be given, in which case references matching any prefix will be shown. Note that this is purely for optimization; a server MAY show refs not matching the prefix if it chooses, and clients should filter the result themselves.")
+	refPrefixFile := pflag.String("ref-prefix-file", "", "Read additional newline-separated '--ref-prefix' values from the given file.")
 	capabilities := pflag.StringSlice("capability", nil, "Advertise a client capability in the command-request.")
-	userAgent := pflag.String("user-agent", "git/1.0", "Set the User-Agent header in the HTTP request.")
+	service := pflag.String("service", git.ServiceUploadPack, "Service used in the info/refs query string and the path command-requests are sent to (ex: for servers with custom endpoints).")
+	userAgent := pflag.String("user-agent", "git/1.0", "Set the User-Agent header in the HTTP request (and the agent capability if advertised).")
 	pflag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <url>\n", filepath.Base(os.Args[0]))
 		pflag.PrintDefaults()
@@ -36,71 +35,74 @@ func main() {
 		pflag.Usage()
 		os.Exit(1)
 	}
-	url := pflag.Arg(0) + "/git-upload-pack"
 
-	req := git.CommandRequest{
-		Command: "ls-refs",
+	// The --ref-prefix-file flag allows large sets of prefixes (ex: mirror configs) to be provided
+	if *refPrefixFile != "" {
+		f, err := os.Open(*refPrefixFile)
+		if err != nil {
+			log.Fatalf("os.Open failed: %v", err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if prefix := strings.TrimSpace(scanner.Text()); prefix != "" {
+				*refPrefixes = append(*refPrefixes, prefix)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("bufio.Scanner.Scan %s failed: %v", *refPrefixFile, err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("(*os.File).Close failed: %v", err)
+		}
 	}
-	for _, cap := range *capabilities {
-		key, value, _ := strings.Cut(cap, "=")
-		req.Capabilities = append(req.Capabilities, git.Capability{
-			Key:   key,
-			Value: value,
-		})
+	uniq := make(map[string]struct{}, len(*refPrefixes))
+	prefixes := (*refPrefixes)[:0]
+	for _, prefix := range *refPrefixes {
+		if _, ok := uniq[prefix]; !ok {
+			uniq[prefix] = struct{}{}
+			prefixes = append(prefixes, prefix)
+		}
 	}
+	*refPrefixes = prefixes
 
-	if *symrefs {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key: git.ArgumentSymRefs,
-		})
+	client := git.Client{
+		URL:               pflag.Arg(0),
+		UploadPackService: *service,
+		UserAgent:         *userAgent,
 	}
-	if *peel {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key: git.ArgumentPeel,
-		})
+	advertisement, err := client.Capabilities(ctx)
+	if err != nil {
+		log.Fatalf("failed to retrieve capabilities: %v", err)
 	}
-	if *unborn {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key: git.ArgumentUnborn,
-		})
+
+	opts := git.LsRefsOptions{
+		Advertisement: advertisement,
+		Symrefs:       *symrefs,
+		Peel:          *peel,
+		Unborn:        *unborn,
+		Prefixes:      *refPrefixes,
 	}
-	for _, prefix := range *refPrefixes {
-		req.Arguments = append(req.Arguments, git.CommandArgument{
-			Key:   git.ArgumentRefPrefix,
-			Value: prefix,
+	for _, cap := range *capabilities {
+		key, value, _ := strings.Cut(cap, "=")
+		opts.Capabilities = append(opts.Capabilities, git.Capability{
+			Key:   key,
+			Value: value,
 		})
 	}
-
-	reqHTTP, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(req.Bytes()))
+	req, err := git.BuildLsRefsRequest(opts)
 	if err != nil {
-		log.Fatalf("http.NewRequestWithContext failed: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	reqHTTP.Header.Set("Git-Protocol", "version=2")
-	reqHTTP.Header.Set("User-Agent", *userAgent)
 
-	respHTTP, err := http.DefaultClient.Do(reqHTTP)
-	if err != nil {
-		log.Fatalf("http.DefaultClient.Do failed: %v", err)
-	}
-	defer func() {
-		if err := respHTTP.Body.Close(); err != nil {
-			log.Fatalf("(*http.Response).Body.Close failed: %v", err)
+	// Stream the references so memory usage is bounded for repositories with many refs
+	if err := client.LsRefsStream(ctx, req, func(ref git.Reference) error {
+		if ref.MatchesPrefixes(*refPrefixes) {
+			fmt.Println(ref.String())
 		}
-	}()
-
-	if respHTTP.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(respHTTP.Body)
-		log.Fatalf("unexpected status code (%d): %s", respHTTP.StatusCode, string(body))
-	}
-
-	scanner := pktline.NewScanner(respHTTP.Body)
-
-	var resp git.ListReferencesResponse
-	if err := resp.Parse(scanner); err != nil {
-		log.Fatalf("failed to parse ls-refs response: %v", err)
-	}
-	for _, ref := range resp.References {
-		fmt.Println(ref.String())
+		return nil
+	}); err != nil {
+		log.Fatalf("ls-refs failed: %v", err)
 	}
 
 }
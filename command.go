@@ -2,8 +2,14 @@ package protocolv2
 
 import (
 	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"slices"
+	"strings"
 
 	pktline "github.com/bored-engineer/git-pkt-line"
 )
@@ -32,6 +38,92 @@ func (cr CommandRequest) Bytes() []byte {
 	return cr.Append(nil)
 }
 
+// WriteTo implements the io.WriterTo interface, writing the command-request one pkt-line at a
+// time so that the encoding of a large request (ex: many haves) is never materialized in full
+func (cr CommandRequest) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	var buf []byte
+	write := func(b []byte) error {
+		n, err := w.Write(b)
+		written += int64(n)
+		return err
+	}
+	if err := write(pktline.AppendString(buf[:0], "command="+cr.Command+"\n")); err != nil {
+		return written, err
+	}
+	for _, cap := range cr.Capabilities {
+		buf = cap.Append(buf[:0])
+		if err := write(buf); err != nil {
+			return written, err
+		}
+	}
+	if err := write(pktline.AppendDelimPkt(buf[:0])); err != nil {
+		return written, err
+	}
+	for _, arg := range cr.Arguments {
+		buf = arg.Append(buf[:0])
+		if err := write(buf); err != nil {
+			return written, err
+		}
+	}
+	if err := write(pktline.AppendFlushPkt(buf[:0])); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+// Clone returns a deep copy of the command-request, which can be modified without affecting the original
+func (cr CommandRequest) Clone() *CommandRequest {
+	return &CommandRequest{
+		Command:      cr.Command,
+		Capabilities: slices.Clone(cr.Capabilities),
+		Arguments:    slices.Clone(cr.Arguments),
+	}
+}
+
+// volatileCapabilities identify the client rather than the request, so they are excluded from CacheKey
+var volatileCapabilities = []string{CapabilityAgent, CapabilitySessionID}
+
+// CacheKey returns the hex-encoded SHA-256 of the canonical form of the command-request, in which the
+// capabilities (excluding agent and session-id) and arguments are sorted and deduplicated, so that
+// semantically identical requests (ex: two clones of the same tips) have the same key
+func (cr CommandRequest) CacheKey() string {
+	canonical := CommandRequest{
+		Command:   cr.Command,
+		Arguments: slices.Clone(cr.Arguments),
+	}
+	for _, c := range cr.Capabilities {
+		if !slices.Contains(volatileCapabilities, c.Key) {
+			canonical.Capabilities = append(canonical.Capabilities, c)
+		}
+	}
+	slices.SortFunc(canonical.Capabilities, func(a, b Capability) int {
+		return cmp.Or(strings.Compare(a.Key, b.Key), strings.Compare(a.Value, b.Value))
+	})
+	canonical.Capabilities = slices.Compact(canonical.Capabilities)
+	slices.SortFunc(canonical.Arguments, func(a, b CommandArgument) int {
+		return cmp.Or(strings.Compare(a.Key, b.Key), strings.Compare(a.Value, b.Value))
+	})
+	canonical.Arguments = slices.Compact(canonical.Arguments)
+	sum := sha256.Sum256(canonical.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// Wants returns the object IDs of each "want" argument
+func (cr CommandRequest) Wants() []string {
+	return cr.Arguments.GetAll(ArgumentWant)
+}
+
+// Haves returns the object IDs of each "have" argument
+func (cr CommandRequest) Haves() []string {
+	return cr.Arguments.GetAll(ArgumentHave)
+}
+
+// WantRefs returns the ref names of each "want-ref" argument
+func (cr CommandRequest) WantRefs() []string {
+	return cr.Arguments.GetAll(ArgumentWantRef)
+}
+
 // Parse populates the fields from a given pkt-line scanner
 func (cr *CommandRequest) Parse(scanner *pktline.Scanner) error {
 	line, err := scanner.Scan()
@@ -47,11 +139,23 @@ func (cr *CommandRequest) Parse(scanner *pktline.Scanner) error {
 		return fmt.Errorf("invalid command-request: %q", string(line))
 	}
 	cr.Command = string(command)
-	if err := cr.Capabilities.Parse(scanner); err != nil && !errors.Is(err, pktline.ErrDelimPkt) {
+	// The capability-list ends with a delim-pkt, but git also accepts a flush-pkt when there are no command-args
+	switch err := cr.Capabilities.Parse(scanner); {
+	case errors.Is(err, pktline.ErrFlushPkt):
+		return nil
+	case errors.Is(err, pktline.ErrDelimPkt):
+	case errors.Is(err, pktline.ErrResponseEndPkt):
+		return fmt.Errorf("invalid command-request: unexpected %w in capability-list", err)
+	default:
 		return err
 	}
-	if err := cr.Arguments.Parse(scanner); err != nil && !errors.Is(err, pktline.ErrFlushPkt) {
+	// The command-args must end with a flush-pkt
+	switch err := cr.Arguments.Parse(scanner); {
+	case errors.Is(err, pktline.ErrFlushPkt):
+		return nil
+	case errors.Is(err, pktline.ErrDelimPkt), errors.Is(err, pktline.ErrResponseEndPkt):
+		return fmt.Errorf("invalid command-request: unexpected %w in command-args", err)
+	default:
 		return err
 	}
-	return nil
 }
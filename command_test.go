@@ -0,0 +1,250 @@
+package protocolv2
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func FuzzCommandRequestParse(f *testing.F) {
+	f.Add(CommandRequest{
+		Command:      CapabilityListReferences,
+		Capabilities: Capabilities{{Key: CapabilityAgent, Value: "git/2.45.0"}},
+		Arguments:    CommandArguments{{Key: ArgumentPeel}, {Key: ArgumentRefPrefix, Value: "refs/heads/"}},
+	}.Bytes())
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		var cr CommandRequest
+		_ = cr.Parse(pktline.NewScanner(bytes.NewReader(payload)))
+	})
+}
+
+func TestCommandRequestParse(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    CommandRequest
+		wantErr string
+	}{
+		"capabilities and arguments": {
+			input: "0014command=ls-refs\n0015agent=git/2.45.0\n00010009peel\n0000",
+			want: CommandRequest{
+				Command:      CapabilityListReferences,
+				Capabilities: Capabilities{{Key: CapabilityAgent, Value: "git/2.45.0"}},
+				Arguments:    CommandArguments{{Key: ArgumentPeel}},
+			},
+		},
+		"no arguments": {
+			input: "0014command=ls-refs\n0015agent=git/2.45.0\n0000",
+			want: CommandRequest{
+				Command:      CapabilityListReferences,
+				Capabilities: Capabilities{{Key: CapabilityAgent, Value: "git/2.45.0"}},
+			},
+		},
+		"empty arguments": {
+			input: "0014command=ls-refs\n00010000",
+			want: CommandRequest{
+				Command: CapabilityListReferences,
+			},
+		},
+		"delim in arguments": {
+			input:   "0014command=ls-refs\n00010009peel\n0001",
+			wantErr: "invalid command-request: unexpected delim-pkt in command-args",
+		},
+		"response-end in capabilities": {
+			input:   "0014command=ls-refs\n0002",
+			wantErr: "invalid command-request: unexpected response-end-pkt in capability-list",
+		},
+		"truncated arguments": {
+			input:   "0014command=ls-refs\n00010009peel\n",
+			wantErr: "EOF",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var cr CommandRequest
+			err := cr.Parse(pktline.NewScanner(bytes.NewReader([]byte(tc.input))))
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cr, tc.want) {
+				t.Fatalf("expected %+v, got %+v", tc.want, cr)
+			}
+		})
+	}
+}
+
+func TestCommandRequestWriteTo(t *testing.T) {
+	req := CommandRequest{
+		Command:      CapabilityFetch,
+		Capabilities: Capabilities{{Key: CapabilityAgent, Value: "git/1.0"}},
+		Arguments: CommandArguments{
+			{Key: ArgumentWant, Value: "0000000000000000000000000000000000000001"},
+			{Key: ArgumentHave, Value: "0000000000000000000000000000000000000002"},
+			{Key: ArgumentDone},
+		},
+	}
+	var buf bytes.Buffer
+	n, err := req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), req.Bytes()) {
+		t.Fatalf("expected %q, got %q", req.Bytes(), buf.Bytes())
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("expected %d bytes written, got %d", buf.Len(), n)
+	}
+}
+
+func TestCommandRequestWants(t *testing.T) {
+	var b []byte
+	b = pktline.AppendString(b, "command=fetch\n")
+	b = pktline.AppendDelimPkt(b)
+	b = pktline.AppendString(b, "want a\n")
+	b = pktline.AppendString(b, "have c\n")
+	b = pktline.AppendString(b, "want b\n")
+	b = pktline.AppendString(b, "want-ref refs/heads/main\n")
+	b = pktline.AppendString(b, "have d\n")
+	b = pktline.AppendFlushPkt(b)
+	var cr CommandRequest
+	if err := cr.Parse(pktline.NewScanner(bytes.NewReader(b))); err != nil {
+		t.Fatal(err)
+	}
+	if got := cr.Wants(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("unexpected wants: %v", got)
+	}
+	if got := cr.Haves(); !reflect.DeepEqual(got, []string{"c", "d"}) {
+		t.Fatalf("unexpected haves: %v", got)
+	}
+	if got := cr.WantRefs(); !reflect.DeepEqual(got, []string{"refs/heads/main"}) {
+		t.Fatalf("unexpected want-refs: %v", got)
+	}
+	if got := cr.Arguments.GetAll(ArgumentShallow); got != nil {
+		t.Fatalf("unexpected shallows: %v", got)
+	}
+}
+
+func TestCommandRequestClone(t *testing.T) {
+	original := &CommandRequest{
+		Command:      CapabilityFetch,
+		Capabilities: make(Capabilities, 1, 2),
+		Arguments:    make(CommandArguments, 1, 2),
+	}
+	original.Capabilities[0] = Capability{Key: CapabilityAgent, Value: "git/1.0"}
+	original.Arguments[0] = CommandArgument{Key: ArgumentWant, Value: "a"}
+
+	clone := original.Clone()
+	if !reflect.DeepEqual(clone, original) {
+		t.Fatalf("expected %v, got %v", original, clone)
+	}
+	// Appending within the spare capacity or modifying in-place must not be visible in the original
+	clone.Capabilities[0].Value = "git/2.0"
+	clone.Capabilities = append(clone.Capabilities, Capability{Key: CapabilityObjectFormat, Value: "sha1"})
+	clone.Arguments[0].Value = "b"
+	clone.Arguments = append(clone.Arguments, CommandArgument{Key: ArgumentDone})
+	if original.Capabilities[0].Value != "git/1.0" || original.Capabilities[:2][1] != (Capability{}) {
+		t.Fatalf("unexpected modification of the original capabilities: %v", original.Capabilities[:2])
+	}
+	if original.Arguments[0].Value != "a" || original.Arguments[:2][1] != (CommandArgument{}) {
+		t.Fatalf("unexpected modification of the original arguments: %v", original.Arguments[:2])
+	}
+}
+
+func TestCommandRequestCacheKey(t *testing.T) {
+	base := CommandRequest{
+		Command: CapabilityFetch,
+		Capabilities: Capabilities{
+			{Key: CapabilityAgent, Value: "git/2.39.5"},
+			{Key: CapabilityObjectFormat, Value: "sha1"},
+		},
+		Arguments: CommandArguments{
+			{Key: ArgumentOFSDelta},
+			{Key: ArgumentWant, Value: "0000000000000000000000000000000000000001"},
+			{Key: ArgumentWant, Value: "0000000000000000000000000000000000000002"},
+			{Key: ArgumentDone},
+		},
+	}
+	tests := map[string]struct {
+		req       CommandRequest
+		wantEqual bool
+	}{
+		"identical": {
+			req:       *base.Clone(),
+			wantEqual: true,
+		},
+		"different agent and session-id": {
+			req: CommandRequest{
+				Command: CapabilityFetch,
+				Capabilities: Capabilities{
+					{Key: CapabilityAgent, Value: "git/2.45.0"},
+					{Key: CapabilitySessionID, Value: "1"},
+					{Key: CapabilityObjectFormat, Value: "sha1"},
+				},
+				Arguments: base.Arguments,
+			},
+			wantEqual: true,
+		},
+		"reordered and duplicated arguments": {
+			req: CommandRequest{
+				Command:      CapabilityFetch,
+				Capabilities: base.Capabilities,
+				Arguments: CommandArguments{
+					{Key: ArgumentWant, Value: "0000000000000000000000000000000000000002"},
+					{Key: ArgumentDone},
+					{Key: ArgumentWant, Value: "0000000000000000000000000000000000000001"},
+					{Key: ArgumentOFSDelta},
+					{Key: ArgumentWant, Value: "0000000000000000000000000000000000000002"},
+				},
+			},
+			wantEqual: true,
+		},
+		"different object-format": {
+			req: CommandRequest{
+				Command:      CapabilityFetch,
+				Capabilities: Capabilities{{Key: CapabilityObjectFormat, Value: "sha256"}},
+				Arguments:    base.Arguments,
+			},
+		},
+		"different want": {
+			req: CommandRequest{
+				Command:      CapabilityFetch,
+				Capabilities: base.Capabilities,
+				Arguments: CommandArguments{
+					{Key: ArgumentOFSDelta},
+					{Key: ArgumentWant, Value: "0000000000000000000000000000000000000001"},
+					{Key: ArgumentDone},
+				},
+			},
+		},
+		"different command": {
+			req: CommandRequest{
+				Command:      CapabilityObjectInfo,
+				Capabilities: base.Capabilities,
+				Arguments:    base.Arguments,
+			},
+		},
+	}
+	want := base.CacheKey()
+	if len(want) != 64 {
+		t.Fatalf("expected a hex-encoded SHA-256, got %q", want)
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.req.CacheKey(); (got == want) != tc.wantEqual {
+				t.Fatalf("expected equal %v, got %q and %q", tc.wantEqual, got, want)
+			}
+		})
+	}
+	// CacheKey must not reorder the arguments of the request itself
+	if base.Arguments[0].Key != ArgumentOFSDelta {
+		t.Fatalf("expected arguments to be unmodified, got %v", base.Arguments)
+	}
+}
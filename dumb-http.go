@@ -0,0 +1,37 @@
+package protocolv2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ParseDumbInfoRefs parses the info/refs file served by dumb-HTTP servers (as generated by
+// git update-server-info), which is a plain list of "<oid>\t<refname>" lines without pkt-line
+// framing. Peeled tags ("<oid>\t<refname>^{}" lines) are added to the preceding reference as a
+// "peeled:<oid>" attribute, matching the ls-refs "peel" argument.
+func ParseDumbInfoRefs(r io.Reader) (*ListReferencesResponse, error) {
+	var lrs ListReferencesResponse
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		objID, name, ok := strings.Cut(line, "\t")
+		if !ok || objID == "" || name == "" {
+			return nil, fmt.Errorf("invalid info/refs line: %q", line)
+		}
+		if tagged, ok := strings.CutSuffix(name, "^{}"); ok {
+			if len(lrs.References) == 0 || lrs.References[len(lrs.References)-1].Name != tagged {
+				return nil, fmt.Errorf("unexpected peeled ref: %q", line)
+			}
+			ref := &lrs.References[len(lrs.References)-1]
+			ref.Attributes = append(ref.Attributes, "peeled:"+objID)
+			continue
+		}
+		lrs.References = append(lrs.References, Reference{ObjectID: objID, Name: name})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &lrs, nil
+}
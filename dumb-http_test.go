@@ -0,0 +1,83 @@
+package protocolv2
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDumbInfoRefs(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    []Reference
+		wantErr string
+	}{
+		"empty": {},
+		"refs": {
+			input: "0000000000000000000000000000000000000001\trefs/heads/main\n0000000000000000000000000000000000000002\trefs/heads/next\n",
+			want: []Reference{
+				{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+				{ObjectID: "0000000000000000000000000000000000000002", Name: "refs/heads/next"},
+			},
+		},
+		"missing trailing LF": {
+			input: "0000000000000000000000000000000000000001\trefs/heads/main",
+			want: []Reference{
+				{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+			},
+		},
+		"peeled": {
+			input: "0000000000000000000000000000000000000002\trefs/tags/v1\n0000000000000000000000000000000000000001\trefs/tags/v1^{}\n",
+			want: []Reference{
+				{ObjectID: "0000000000000000000000000000000000000002", Name: "refs/tags/v1", Attributes: []string{"peeled:0000000000000000000000000000000000000001"}},
+			},
+		},
+		"orphan peeled": {
+			input:   "0000000000000000000000000000000000000002\trefs/tags/v1\n0000000000000000000000000000000000000001\trefs/tags/v2^{}\n",
+			wantErr: "unexpected peeled ref: \"0000000000000000000000000000000000000001\\trefs/tags/v2^{}\"",
+		},
+		"space separator": {
+			input:   "0000000000000000000000000000000000000001 refs/heads/main\n",
+			wantErr: "invalid info/refs line: \"0000000000000000000000000000000000000001 refs/heads/main\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			lrs, err := ParseDumbInfoRefs(strings.NewReader(tc.input))
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(lrs.References, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, lrs.References)
+			}
+		})
+	}
+}
+
+func TestParseDumbInfoRefsFixture(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "git-2.39-sha1.info-refs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lrs, err := ParseDumbInfoRefs(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Reference{
+		{ObjectID: "ec0fe20996b4c463845498b315d14055fd5d1c99", Name: "refs/heads/main"},
+		{ObjectID: "78a56c529fcb31c926030826a610d430a1995fba", Name: "refs/tags/v1", Attributes: []string{"peeled:ec0fe20996b4c463845498b315d14055fd5d1c99"}},
+	}
+	if !reflect.DeepEqual(lrs.References, want) {
+		t.Fatalf("expected %v, got %v", want, lrs.References)
+	}
+}
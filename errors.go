@@ -0,0 +1,78 @@
+package protocolv2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+// ErrTruncatedResponse is returned when a response ends abruptly instead of with a flush-pkt
+type ErrTruncatedResponse struct {
+	// Section is the name of the section being parsed when the stream ended
+	Section string
+	// Err is the underlying io.EOF or io.ErrUnexpectedEOF
+	Err error
+}
+
+// Error implements the error interface
+func (err ErrTruncatedResponse) Error() string {
+	return "truncated during " + err.Section + " section: " + err.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (err ErrTruncatedResponse) Unwrap() error {
+	return err.Err
+}
+
+// truncated wraps io.EOF and io.ErrUnexpectedEOF as an ErrTruncatedResponse
+// A pktline.ErrInvalidLen is also wrapped with the section, as the bare "invalid length prefix"
+// gives no hint of where the stream was corrupted. Note a length header cut short by the end of
+// the stream (ex: "00") is reported by the scanner as io.ErrUnexpectedEOF, so it is truncated.
+func truncated(section string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncatedResponse{Section: section, Err: err}
+	}
+	if errors.As(err, new(pktline.ErrInvalidLen)) {
+		return fmt.Errorf("invalid pkt-line length header during %s section: %w", section, err)
+	}
+	return err
+}
+
+// error-line = PKT-LINE("ERR" SP explanation-text)
+type ServerError struct {
+	Message string
+}
+
+// Append the error pkt-line to the given slice
+func (se ServerError) Append(b []byte) []byte {
+	return pktline.AppendString(b, "ERR "+se.Message)
+}
+
+// Bytes returns the error pkt-line as a slice
+func (se ServerError) Bytes() []byte {
+	return se.Append(nil)
+}
+
+// Error implements the error interface
+func (se ServerError) Error() string {
+	return "ERR " + se.Message
+}
+
+// Unwrap returns the equivalent pktline.ErrErrorLine, so callers of this package and of
+// pktline.Scanner can match an error-line the same way (ex: errors.As(err, &pktline.ErrErrorLine{}))
+func (se ServerError) Unwrap() error {
+	return pktline.ErrErrorLine{Explanation: se.Message}
+}
+
+// asServerError converts the pktline.ErrErrorLine of an error-line (ex: "ERR access denied" sent
+// instead of the protocol-version when the service is not permitted) into a *ServerError
+func asServerError(err error) error {
+	var errLine pktline.ErrErrorLine
+	if errors.As(err, &errLine) {
+		return &ServerError{Message: strings.TrimSuffix(errLine.Explanation, "\n")}
+	}
+	return err
+}
@@ -2,10 +2,15 @@ package protocolv2
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 
 	pktline "github.com/bored-engineer/git-pkt-line"
 )
@@ -103,6 +108,271 @@ const (
 	ArgumentWaitForDone = "wait-for-done"
 )
 
+// Indicates the server supports the "want-ref" argument in a fetch command-request
+const FeatureRefInWant = "ref-in-want"
+
+const (
+	// Indicates the server allows a want of an object at the tip of a hidden (unadvertised)
+	// ref (uploadpack.allowTipSHA1InWant). This is a protocol v0/v1 capability, a protocol-v2
+	// server applies the same configuration but does not advertise it.
+	CapabilityAllowTipSHA1InWant = "allow-tip-sha1-in-want"
+	// Indicates the server allows a want of any object reachable from a ref
+	// (uploadpack.allowReachableSHA1InWant). This is a protocol v0/v1 capability, a
+	// protocol-v2 server applies the same configuration but does not advertise it.
+	CapabilityAllowReachableSHA1InWant = "allow-reachable-sha1-in-want"
+)
+
+// UnadvertisedWants returns the wants which are not one of the advertised tips (ex: from ls-refs)
+// if the features of the fetch command (see CapabilityAdvertisement.Features) do not include an
+// allowance for them, so the server may reject them with "not our ref". As protocol-v2 servers
+// never advertise the allowances, a non-empty result is a warning rather than a guarantee of
+// failure (ex: GitHub allows any reachable object).
+func UnadvertisedWants(features []string, tips []string, wants []string) []string {
+	if slices.Contains(features, CapabilityAllowTipSHA1InWant) || slices.Contains(features, CapabilityAllowReachableSHA1InWant) {
+		return nil
+	}
+	var unadvertised []string
+	for _, objID := range wants {
+		if !slices.Contains(tips, objID) {
+			unadvertised = append(unadvertised, objID)
+		}
+	}
+	return unadvertised
+}
+
+// FetchArguments are the argument keys recognized by the fetch command
+var FetchArguments = []string{
+	ArgumentWant,
+	ArgumentHave,
+	ArgumentDone,
+	ArgumentThinPack,
+	ArgumentNoProgress,
+	ArgumentIncludeTag,
+	ArgumentOFSDelta,
+	ArgumentShallow,
+	ArgumentDeepen,
+	ArgumentDeepenRelative,
+	ArgumentDeepenSince,
+	ArgumentDeepenNot,
+	ArgumentFilter,
+	ArgumentWantRef,
+	ArgumentSidebandAll,
+	ArgumentPackfileURIs,
+	ArgumentWaitForDone,
+}
+
+// FetchOptions are the typed arguments for a fetch command-request
+type FetchOptions struct {
+	// Advertisement (if non-nil) is used to validate the server supports the requested features
+	Advertisement *CapabilityAdvertisement
+	// Capabilities to include in the command-request
+	Capabilities Capabilities
+	// ObjectFormat (if non-empty) is sent as the object-format capability (ex: "sha256"), which is
+	// required to fetch from a SHA-256 repository. It must be the object-format the server advertised.
+	ObjectFormat string
+	// Wants are the object IDs to retrieve
+	Wants []string
+	// Haves are the object IDs present locally
+	Haves []string
+	// WantRefs are the full names of the refs to retrieve
+	WantRefs []string
+	// Shallows are the commits which the client only has shallow copies of
+	Shallows []string
+	// Deepen is the requested commit depth (if non-zero)
+	Deepen int
+	// DeepenRelative makes Deepen relative to the current shallow boundary
+	DeepenRelative bool
+	// DeepenSince cuts the shallow fetch at the given timestamp
+	DeepenSince string
+	// DeepenNot cuts the shallow fetch at the given revision
+	DeepenNot string
+	// Filter is the filter-spec for a partial fetch
+	Filter string
+	// PackfileURIs are the protocols accepted in place of objects in the packfile
+	PackfileURIs []string
+	// ThinPack requests a thin pack
+	ThinPack bool
+	// NoProgress requests that progress is not sent
+	NoProgress bool
+	// IncludeTag requests annotated tags pointing to sent objects
+	IncludeTag bool
+	// OFSDelta indicates OBJ_OFS_DELTA is understood
+	OFSDelta bool
+	// WaitForDone requests the server never send "ready"
+	// It is omitted when there are no Haves (a clone) as there is nothing to negotiate, "done" alone suffices
+	WaitForDone bool
+	// Done terminates negotiation
+	Done bool
+	// AutoFeatures enables the arguments returned by AutoFeatures for the Advertisement
+	AutoFeatures bool
+	// FixThin indicates the caller thickens a thin pack (ex: with IndexPack or git index-pack
+	// --fix-thin), only then does AutoFeatures enable thin-pack
+	FixThin bool
+	// DisableFeatures are the arguments (ex: ArgumentThinPack) never enabled by AutoFeatures
+	DisableFeatures []string
+	// Tips (if non-nil) are the advertised object IDs (ex: from ls-refs) the Wants are checked against
+	// A want of any other object is rejected unless the Advertisement allows it, see UnadvertisedWants
+	Tips []string
+	// OnUnadvertisedWants (if non-nil) is called with the unadvertised Wants instead of rejecting them
+	// (ex: to print a warning), as protocol-v2 servers never advertise the allowance
+	OnUnadvertisedWants func(wants []string)
+}
+
+// AutoFeatures returns the fetch arguments which are safe to enable for the server, as git does by
+// default. Protocol-v2 servers do not advertise "ofs-delta" or "thin-pack" as every implementation
+// of the fetch command supports them, but a thin pack is unusable unless the client thickens it
+// (ex: with git index-pack --fix-thin), so thin-pack is only returned if fixThin is true.
+func AutoFeatures(ca *CapabilityAdvertisement, fixThin bool) []string {
+	if ca == nil || !ca.SupportsCommand(CapabilityFetch) {
+		return nil
+	}
+	if !fixThin {
+		return []string{ArgumentOFSDelta}
+	}
+	return []string{ArgumentOFSDelta, ArgumentThinPack}
+}
+
+// BuildFetchRequest constructs a fetch command-request from the given options
+func BuildFetchRequest(opts FetchOptions) (*CommandRequest, error) {
+	if len(opts.Wants) == 0 && len(opts.WantRefs) == 0 {
+		return nil, errors.New("at least one want or want-ref is required")
+	}
+	if len(opts.WantRefs) > 0 && opts.Advertisement != nil && !opts.Advertisement.SupportsFeature(CapabilityFetch, FeatureRefInWant) {
+		return nil, errors.New("want-ref requires the server to advertise " + FeatureRefInWant)
+	}
+	if opts.Tips != nil {
+		var features []string
+		if opts.Advertisement != nil {
+			features = opts.Advertisement.Features(CapabilityFetch)
+		}
+		if unadvertised := UnadvertisedWants(features, opts.Tips, opts.Wants); len(unadvertised) > 0 {
+			if opts.OnUnadvertisedWants == nil {
+				return nil, fmt.Errorf("want %s was not advertised, it requires the server to allow %s or %s", unadvertised[0], CapabilityAllowTipSHA1InWant, CapabilityAllowReachableSHA1InWant)
+			}
+			opts.OnUnadvertisedWants(unadvertised)
+		}
+	}
+	if opts.AutoFeatures {
+		for _, feature := range AutoFeatures(opts.Advertisement, opts.FixThin) {
+			if slices.Contains(opts.DisableFeatures, feature) {
+				continue
+			}
+			switch feature {
+			case ArgumentOFSDelta:
+				opts.OFSDelta = true
+			case ArgumentThinPack:
+				opts.ThinPack = true
+			}
+		}
+	}
+	req := &CommandRequest{
+		Command:      CapabilityFetch,
+		Capabilities: opts.Capabilities,
+	}
+	// The object-format is a capability (before the delim-pkt) rather than an argument, even if it is
+	// the only capability of the command-request
+	if opts.ObjectFormat != "" && !req.Capabilities.Has(CapabilityObjectFormat) {
+		if opts.Advertisement != nil && !slices.Contains(opts.Advertisement.Capabilities, Capability{Key: CapabilityObjectFormat, Value: opts.ObjectFormat}) {
+			return nil, fmt.Errorf("%s=%s requires the server to advertise it", CapabilityObjectFormat, opts.ObjectFormat)
+		}
+		req.Capabilities = append(slices.Clip(req.Capabilities), Capability{Key: CapabilityObjectFormat, Value: opts.ObjectFormat})
+	}
+	// Without haves the server has nothing to acknowledge so it will never send "ready" anyway
+	if opts.WaitForDone && len(opts.Haves) > 0 {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentWaitForDone})
+	}
+	if opts.ThinPack {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentThinPack})
+	}
+	if opts.NoProgress {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentNoProgress})
+	}
+	if opts.IncludeTag {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentIncludeTag})
+	}
+	if opts.OFSDelta {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentOFSDelta})
+	}
+	for _, objID := range opts.Shallows {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentShallow, Value: objID})
+	}
+	if opts.Deepen > 0 {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentDeepen, Value: strconv.Itoa(opts.Deepen)})
+	}
+	if opts.DeepenRelative {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentDeepenRelative})
+	}
+	if opts.DeepenSince != "" {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentDeepenSince, Value: opts.DeepenSince})
+	}
+	if opts.DeepenNot != "" {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentDeepenNot, Value: opts.DeepenNot})
+	}
+	if opts.Filter != "" {
+		filter, err := ExpandFilterSpec(opts.Filter)
+		if err != nil {
+			return nil, err
+		}
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentFilter, Value: filter})
+	}
+	for _, ref := range opts.WantRefs {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentWantRef, Value: ref})
+	}
+	if len(opts.PackfileURIs) > 0 {
+		for _, protocol := range opts.PackfileURIs {
+			if !slices.Contains(PackfileURIProtocols, protocol) {
+				return nil, fmt.Errorf("unsupported packfile-uris protocol: %q", protocol)
+			}
+		}
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentPackfileURIs, Value: strings.Join(opts.PackfileURIs, ",")})
+	}
+	for _, objID := range opts.Haves {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentHave, Value: objID})
+	}
+	for _, objID := range opts.Wants {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentWant, Value: objID})
+	}
+	if opts.Done {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentDone})
+	}
+	return req, nil
+}
+
+// CloneOptions are the typed arguments for a clone command-request
+type CloneOptions struct {
+	// Capabilities to include in the command-request
+	Capabilities Capabilities
+	// Filter is the filter-spec for a partial clone
+	Filter string
+	// Depth is the requested commit depth for a shallow clone (if non-zero)
+	Depth int
+	// ThinPack requests a thin pack
+	ThinPack bool
+	// IncludeTag requests annotated tags pointing to sent objects
+	// Only the tag objects are sent, see ListReferencesResponse.IncludedTags for their refs
+	IncludeTag bool
+	// OFSDelta indicates OBJ_OFS_DELTA is understood
+	OFSDelta bool
+}
+
+// BuildCloneRequest constructs a fetch command-request which retrieves everything reachable from
+// the given tips (ex: WantsFromReferences of an ls-refs response), there are no haves to negotiate
+func BuildCloneRequest(tips []string, opts CloneOptions) (*CommandRequest, error) {
+	if len(tips) == 0 {
+		return nil, errors.New("at least one tip is required")
+	}
+	return BuildFetchRequest(FetchOptions{
+		Capabilities: opts.Capabilities,
+		Wants:        tips,
+		Deepen:       opts.Depth,
+		Filter:       opts.Filter,
+		ThinPack:     opts.ThinPack,
+		IncludeTag:   opts.IncludeTag,
+		OFSDelta:     opts.OFSDelta,
+		Done:         true,
+	})
+}
+
 // acknowledgments = PKT-LINE("acknowledgments" LF) (nak | *ack) (ready)
 // ready = PKT-LINE("ready" LF)
 // nak = PKT-LINE("NAK" LF)
@@ -121,9 +391,6 @@ func (a Acknowledgements) IsZero() bool {
 // Append the response pkt-line to the given slice
 func (a Acknowledgements) Append(b []byte) []byte {
 	b = pktline.AppendString(b, "acknowledgments\n")
-	if a.Ready {
-		b = pktline.AppendString(b, "ready\n")
-	}
 	if a.NAK {
 		b = pktline.AppendString(b, "NAK\n")
 	}
@@ -133,6 +400,9 @@ func (a Acknowledgements) Append(b []byte) []byte {
 		b = append(b, objID...)
 		b = append(b, '\n')
 	}
+	if a.Ready {
+		b = pktline.AppendString(b, "ready\n")
+	}
 	return b
 }
 
@@ -142,12 +412,17 @@ func (a Acknowledgements) Bytes() []byte {
 }
 
 // Parse populates the fields from a given pkt-line scanner
+// The grammar is (nak | *ack) (ready), so any line following "ready" is rejected
 func (a *Acknowledgements) Parse(scanner *pktline.Scanner) error {
 	for {
 		line, err := scanner.Scan()
 		if err != nil {
 			return err
 		}
+		// The "ready" line terminates the section, nothing else may follow it
+		if a.Ready {
+			return fmt.Errorf("unexpected pkt-line after ready: %q", string(line))
+		}
 		if objID, ok := bytes.CutPrefix(line, []byte("ACK ")); ok {
 			objID, ok := bytes.CutSuffix(objID, []byte("\n"))
 			if !ok {
@@ -182,12 +457,9 @@ func (s Shallow) Bytes() []byte {
 }
 
 // Parse populates the fields from a given pkt-line slice
+// The trailing LF is optional, git omits it
 func (s *Shallow) Parse(line []byte) error {
-	remaining, ok := bytes.CutSuffix(line, []byte("\n"))
-	if !ok {
-		return fmt.Errorf("invalid shallow: %q", string(line))
-	}
-	objID, ok := bytes.CutPrefix(remaining, []byte("shallow "))
+	objID, ok := bytes.CutPrefix(bytes.TrimSuffix(line, []byte("\n")), []byte("shallow "))
 	if !ok {
 		return fmt.Errorf("invalid shallow: %q", string(line))
 	}
@@ -215,12 +487,9 @@ func (u Unshallow) Bytes() []byte {
 }
 
 // Parse populates the fields from a given pkt-line slice
+// The trailing LF is optional, git omits it
 func (s *Unshallow) Parse(line []byte) error {
-	remaining, ok := bytes.CutSuffix(line, []byte("\n"))
-	if !ok {
-		return fmt.Errorf("invalid unshallow: %q", string(line))
-	}
-	objID, ok := bytes.CutPrefix(remaining, []byte("unshallow "))
+	objID, ok := bytes.CutPrefix(bytes.TrimSuffix(line, []byte("\n")), []byte("unshallow "))
 	if !ok {
 		return fmt.Errorf("invalid unshallow: %q", string(line))
 	}
@@ -228,8 +497,33 @@ func (s *Unshallow) Parse(line []byte) error {
 	return nil
 }
 
+// ParseShallowLine decodes a single shallow or unshallow pkt-line
+func ParseShallowLine(line []byte) (isShallow bool, oid string, err error) {
+	switch {
+	case bytes.HasPrefix(line, []byte("shallow ")):
+		var s Shallow
+		if err := s.Parse(line); err != nil {
+			return false, "", err
+		}
+		return true, s.ObjectID, nil
+	case bytes.HasPrefix(line, []byte("unshallow ")):
+		var u Unshallow
+		if err := u.Parse(line); err != nil {
+			return false, "", err
+		}
+		return false, u.ObjectID, nil
+	default:
+		return false, "", fmt.Errorf("invalid shallow-info: %q", string(line))
+	}
+}
+
 // shallow-info = PKT-LINE("shallow-info" LF)
 // *PKT-LINE((shallow | unshallow) LF)
+//
+// The order of the lines is not significant: a commit is never both shallow and unshallow, so
+// applying them in any order results in the same boundary. git sends every shallow line before
+// the unshallow lines, which is the order Append uses, so an interleaved response is not
+// preserved byte-for-byte.
 type ShallowInfo struct {
 	Shallow   []Shallow
 	Unshallow []Unshallow
@@ -240,6 +534,34 @@ func (si ShallowInfo) IsZero() bool {
 	return si.Shallow == nil && si.Unshallow == nil
 }
 
+// Apply returns the shallow boundary after applying the shallow-info to the previous boundary
+//
+// The shallow/unshallow lines are absolute object IDs, so in both cases unshallowed commits
+// are removed from the boundary and the new shallow commits are added. The difference is in
+// what the server computed them from: for an absolute "deepen" the depth is relative to the
+// wants, so the server may unshallow commits the client never sent (which are ignored), while
+// with "deepen-relative" the depth is relative to the boundary the client sent, so every
+// unshallowed commit must be part of the previous boundary or an error is returned.
+func (si ShallowInfo) Apply(boundary []string, relative bool) ([]string, error) {
+	next := slices.Clone(boundary)
+	for _, u := range si.Unshallow {
+		idx := slices.Index(next, u.ObjectID)
+		if idx == -1 {
+			if relative {
+				return nil, fmt.Errorf("unshallow %s is not part of the shallow boundary", u.ObjectID)
+			}
+			continue
+		}
+		next = slices.Delete(next, idx, idx+1)
+	}
+	for _, s := range si.Shallow {
+		if !slices.Contains(next, s.ObjectID) {
+			next = append(next, s.ObjectID)
+		}
+	}
+	return next, nil
+}
+
 // Appends the response pkt-lines to the given slice
 func (si ShallowInfo) Append(b []byte) []byte {
 	b = pktline.AppendString(b, "shallow-info\n")
@@ -264,21 +586,14 @@ func (si *ShallowInfo) Parse(scanner *pktline.Scanner) error {
 		if err != nil {
 			return err
 		}
-		switch {
-		case bytes.HasPrefix(line, []byte("shallow ")):
-			var s Shallow
-			if err := s.Parse(line); err != nil {
-				return err
-			}
-			si.Shallow = append(si.Shallow, s)
-		case bytes.HasPrefix(line, []byte("unshallow ")):
-			var u Unshallow
-			if err := u.Parse(line); err != nil {
-				return err
-			}
-			si.Unshallow = append(si.Unshallow, u)
-		default:
-			return fmt.Errorf("invalid shallow-info: %q", string(line))
+		isShallow, objID, err := ParseShallowLine(line)
+		if err != nil {
+			return err
+		}
+		if isShallow {
+			si.Shallow = append(si.Shallow, Shallow{ObjectID: objID})
+		} else {
+			si.Unshallow = append(si.Unshallow, Unshallow{ObjectID: objID})
 		}
 	}
 }
@@ -289,7 +604,16 @@ type WantedRef struct {
 	Name     string
 }
 
+// Validate returns an error if the wanted-ref would corrupt the pkt-line framing
+func (wr WantedRef) Validate() error {
+	if strings.ContainsAny(wr.Name, "\n\x00") {
+		return fmt.Errorf("invalid wanted-ref name: %q", wr.Name)
+	}
+	return nil
+}
+
 // Appends the response pkt-lines to the given slice
+// The wanted-ref is not validated, use Validate before serving untrusted references
 func (wr WantedRef) Append(b []byte) []byte {
 	b = pktline.AppendLength(b, len(wr.ObjectID)+len(" ")+len(wr.Name)+len("\n"))
 	b = append(b, wr.ObjectID...)
@@ -304,7 +628,7 @@ func (wr WantedRef) Bytes() []byte {
 	return wr.Append(nil)
 }
 
-// Parse populates the fields from a given pkt-line slice
+// Parse populates the fields from a given pkt-line slice, rejecting invalid wanted-refs (see Validate)
 func (wr *WantedRef) Parse(line []byte) error {
 	remaining, ok := bytes.CutSuffix(line, []byte("\n"))
 	if !ok {
@@ -316,7 +640,7 @@ func (wr *WantedRef) Parse(line []byte) error {
 	}
 	wr.ObjectID = string(objID)
 	wr.Name = string(name)
-	return nil
+	return wr.Validate()
 }
 
 // wanted-refs = PKT-LINE("wanted-refs" LF) *PKT-LINE(wanted-ref)
@@ -356,6 +680,9 @@ func (wrs *WantedRefs) Parse(scanner *pktline.Scanner) error {
 	}
 }
 
+// PackfileURIProtocols are the protocols which may be requested with the packfile-uris argument
+var PackfileURIProtocols = []string{"http", "https"}
+
 // packfile-uri = PKT-LINE(40*(HEXDIGIT) SP *%x20-ff LF)
 type PackfileURI struct {
 	Checksum string
@@ -429,19 +756,56 @@ func (pus *PackfileURIs) Parse(scanner *pktline.Scanner) error {
 	}
 }
 
+// PackfileIndexOrder returns the packfiles in the order they should be indexed (ex: git index-pack)
+// The packfile-uris packs come first since objects in the inline packfile may depend on them, and
+// every pack must be downloaded and indexed before the connectivity check is performed.
+func PackfileIndexOrder(inline io.Reader, uris ...io.Reader) []io.Reader {
+	order := make([]io.Reader, 0, len(uris)+1)
+	order = append(order, uris...)
+	if inline != nil {
+		order = append(order, inline)
+	}
+	return order
+}
+
 // https://git-scm.com/docs/protocol-v2#_fetch
 type FetchResponse struct {
 	Acknowledgements Acknowledgements
 	ShallowInfo      ShallowInfo
 	WantedRefs       WantedRefs
 	PackfileURIs     PackfileURIs
+	// PackHash is the trailing checksum of the packfile, which git uses to name it (pack-<hash>.pack)
+	// It is only populated by Parse if the trailer matched the checksum of the packfile, which is
+	// SHA-1 or SHA-256 depending on the object-format (see ParseObjectFormat)
+	PackHash []byte
+	// PackSize is the number of packfile bytes received in the packfile section
+	PackSize int64
+	// Request is the command-request which produced the response (set by Client.Fetch, nil when
+	// parsed standalone), purely for diagnostics. It is the request itself rather than a copy or its
+	// encoded pkt-lines, so it retains nothing the caller did not already hold.
+	Request *CommandRequest
+}
+
+// IsEmptyPack returns true if the packfile received contained no objects (ex: already up to date)
+// Unlike an empty response (see ErrNothingToFetch) an empty packfile is a successful fetch.
+// An empty packfile is just the 12 byte header followed by the trailer, whose size depends on the
+// negotiated object-format (ex: "sha1" or "sha256", defaulting to "sha1" if empty).
+func (fr FetchResponse) IsEmptyPack(objectFormat string) bool {
+	return fr.PackSize == int64(packHeaderSize+objectFormatSize(objectFormat))
+}
+
+// PackHashHex returns the PackHash as a hex string (or empty if not present)
+func (fr FetchResponse) PackHashHex() string {
+	return hex.EncodeToString(fr.PackHash)
 }
 
 // Appends the response pkt-lines to the given slice
 func (fr FetchResponse) Append(b []byte) []byte {
 	if !fr.Acknowledgements.IsZero() {
 		b = fr.Acknowledgements.Append(b)
-		if fr.Acknowledgements.NAK {
+		// Without "ready" (ex: a NAK or ACKs to continue negotiating) the response ends after the
+		// acknowledgments section, there is no packfile section
+		if !fr.Acknowledgements.Ready {
 			b = pktline.AppendFlushPkt(b)
 			return b
 		}
@@ -465,64 +829,233 @@ func (fr FetchResponse) Bytes() []byte {
 	return fr.Append(nil)
 }
 
+// ReferencedOIDs returns the (unique) object IDs the server committed to in the response metadata,
+// namely the wanted-refs, acknowledged haves and the shallow/unshallow commits. These can be verified
+// against the packfile during the connectivity check, but objects only present in the packfile are
+// not included.
+func (fr FetchResponse) ReferencedOIDs() []string {
+	var objIDs []string
+	add := func(objID string) {
+		if !slices.Contains(objIDs, objID) {
+			objIDs = append(objIDs, objID)
+		}
+	}
+	for _, wr := range fr.WantedRefs {
+		add(wr.ObjectID)
+	}
+	for _, objID := range fr.Acknowledgements.ACKs {
+		add(objID)
+	}
+	for _, s := range fr.ShallowInfo.Shallow {
+		add(s.ObjectID)
+	}
+	for _, u := range fr.ShallowInfo.Unshallow {
+		add(u.ObjectID)
+	}
+	return objIDs
+}
+
+// VerifyWantedRefs returns an error naming any of the requested want-refs which are missing from the
+// wanted-refs section, as a server may silently omit refs (ex: the client lacks permission to read them)
+func (fr FetchResponse) VerifyWantedRefs(requested []string) error {
+	var missing []string
+	for _, name := range requested {
+		if !slices.ContainsFunc(fr.WantedRefs, func(wr WantedRef) bool {
+			return wr.Name == name
+		}) && !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing wanted-refs: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// VerifyPackfileURIs returns an error for the first packfile-uri whose scheme is not one of the
+// requested protocols (ex: "https"), as the URIs are downloaded before the connectivity check
+func (fr FetchResponse) VerifyPackfileURIs(protocols []string) error {
+	for _, pu := range fr.PackfileURIs {
+		u, err := url.Parse(pu.URI)
+		if err != nil {
+			return fmt.Errorf("invalid packfile-uri: %w", err)
+		}
+		if !slices.Contains(protocols, u.Scheme) {
+			return fmt.Errorf("packfile-uri %q does not use a requested protocol (%s)", pu.URI, strings.Join(protocols, ","))
+		}
+	}
+	return nil
+}
+
+// Describe renders the sections present in the response (excluding the packfile) for debugging
+func (fr FetchResponse) Describe() string {
+	var sb strings.Builder
+	if fr.Request != nil {
+		fmt.Fprintf(&sb, "request: command=%s wants=%d want-refs=%d haves=%d done=%t\n", fr.Request.Command, len(fr.Request.Wants()), len(fr.Request.WantRefs()), len(fr.Request.Haves()), fr.Request.Arguments.Has(ArgumentDone))
+	}
+	if !fr.Acknowledgements.IsZero() {
+		fmt.Fprintf(&sb, "acknowledgments: ready=%t nak=%t acks=%v\n", fr.Acknowledgements.Ready, fr.Acknowledgements.NAK, fr.Acknowledgements.ACKs)
+	}
+	if !fr.ShallowInfo.IsZero() {
+		fmt.Fprintf(&sb, "shallow-info: shallow=%d unshallow=%d\n", len(fr.ShallowInfo.Shallow), len(fr.ShallowInfo.Unshallow))
+	}
+	if !fr.WantedRefs.IsZero() {
+		sb.WriteString("wanted-refs:")
+		for _, wr := range fr.WantedRefs {
+			sb.WriteString(" " + wr.Name + "=" + wr.ObjectID)
+		}
+		sb.WriteByte('\n')
+	}
+	if !fr.PackfileURIs.IsZero() {
+		sb.WriteString("packfile-uris:")
+		for _, pu := range fr.PackfileURIs {
+			sb.WriteString(" " + pu.URI)
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// ErrNothingToFetch is the underlying error of the ErrTruncatedResponse returned when a fetch response
+// is entirely empty, which is how git responds to a fetch command-request without any wants (ex: when
+// cloning an empty repository). On a stateful connection the server instead sends nothing and waits
+// for the next command, so the request should not be sent at all (see Session.Clone).
+// A want of an object the server does not have (ex: any object of an empty repository) is rejected
+// with an error-line (ex: "ERR upload-pack: not our ref <obj-id>") rather than an empty response.
+var ErrNothingToFetch = fmt.Errorf("nothing to fetch: %w", io.EOF)
+
+// fetchSections are the sections of a fetch response in the order they must be sent
+var fetchSections = []string{
+	"fetch-response",
+	"acknowledgments",
+	"shallow-info",
+	"wanted-refs",
+	"packfile-uris",
+	"packfile",
+}
+
 // Parse populates the fields from a given pkt-line scanner
+// The packfile section is terminal, parsing stops at the flush-pkt which follows it
+// Sideband channels other than 1-3 are rejected (see Session.UnknownSideBand to accept them)
+// The packfile is assumed to be SHA-1, see ParseObjectFormat for a SHA-256 fetch
 func (fr *FetchResponse) Parse(scanner *pktline.Scanner, packfile io.Writer, progress io.Writer) error {
-	// TODO: This incorrectly permits a server to send sections out of order (or even more than once)
-	for {
+	return fr.parse(scanner, "sha1", packfile, progress, nil, discardLogger)
+}
+
+// ParseObjectFormat is Parse for a fetch of the given object-format (ex: "sha256"), which determines
+// the checksum of the packfile trailer (see PackHash). The trailer of a SHA-256 packfile must be its
+// SHA-256 checksum, otherwise (ex: a SHA-1 trailer) the packfile is rejected.
+func (fr *FetchResponse) ParseObjectFormat(scanner *pktline.Scanner, objectFormat string, packfile io.Writer, progress io.Writer) error {
+	return fr.parse(scanner, objectFormat, packfile, progress, nil, discardLogger)
+}
+
+// parse implements Parse, emitting a debug event to the logger for each section
+// Unknown sideband channels are written to unknownSideBand, or rejected if it is nil
+func (fr *FetchResponse) parse(scanner *pktline.Scanner, objectFormat string, packfile io.Writer, progress io.Writer, unknownSideBand io.Writer, logger *slog.Logger) error {
+	section := "fetch-response"
+	for empty := true; ; empty = false {
 		line, err := scanner.Scan()
 		if err != nil {
 			if errors.Is(err, pktline.ErrDelimPkt) {
 				continue
 			}
-			return err
+			if empty && errors.Is(err, io.EOF) {
+				return ErrTruncatedResponse{Section: section, Err: ErrNothingToFetch}
+			}
+			return truncated(section, err)
+		}
+		// Each section is optional but must be sent (at most once) in the order of fetchSections
+		if next, ok := bytes.CutSuffix(line, []byte("\n")); ok && slices.Contains(fetchSections, string(next)) {
+			if slices.Index(fetchSections, string(next)) <= slices.Index(fetchSections, section) {
+				return fmt.Errorf("unexpected %s section after %s section", string(next), section)
+			}
+			logger.Debug("parsing fetch-response section", "section", string(next))
 		}
 		switch {
 		case bytes.Equal(line, []byte("acknowledgments\n")):
-			log.Println("acknowledgments")
+			section = "acknowledgments"
 			err = fr.Acknowledgements.Parse(scanner)
+			// Without "ready" the acknowledgments section is terminated by a flush-pkt
+			if errors.Is(err, pktline.ErrFlushPkt) {
+				return nil
+			}
 		case bytes.Equal(line, []byte("shallow-info\n")):
-			log.Println("shallow-info")
+			section = "shallow-info"
 			err = fr.ShallowInfo.Parse(scanner)
 		case bytes.Equal(line, []byte("wanted-refs\n")):
-			log.Println("wanted-refs")
+			section = "wanted-refs"
 			err = fr.WantedRefs.Parse(scanner)
 		case bytes.Equal(line, []byte("packfile-uris\n")):
-			log.Println("packfile-uris")
+			section = "packfile-uris"
 			err = fr.PackfileURIs.Parse(scanner)
 		case bytes.Equal(line, []byte("packfile\n")):
+			section = "packfile"
+			// The first (up to 4) bytes of the packfile used to detect a non-packfile response
+			// Only sideband-1 is inspected, servers may send progress on sideband-2 before the packfile
+			var signature []byte
+			hasher := newPackHasher(objectFormat)
 			for {
 				line, err = scanner.Scan()
 				if err != nil {
 					if errors.Is(err, pktline.ErrFlushPkt) {
+						fr.PackHash = hasher.Sum()
+						if fr.PackHash == nil && objectFormat == "sha256" {
+							return errors.New("packfile trailer is not its sha256 checksum")
+						}
 						return nil
 					}
-					return err
+					break
+				}
+				// An empty pkt-line has no sideband byte at all, so it is always invalid
+				if len(line) == 0 {
+					return errors.New("unexpected empty pkt-line in packfile section")
 				}
-				sideband, data := pktline.SideBand(line)
+				sideband, data := SideBand(line[0]), line[1:]
 				switch sideband {
-				case pktline.SideBandPackData:
+				case SideBandPack:
+					if len(signature) < len("PACK") {
+						signature = append(signature, data[:min(len(data), len("PACK")-len(signature))]...)
+						if !bytes.HasPrefix([]byte("PACK"), signature) {
+							return fmt.Errorf("server did not send a packfile: %q", string(data))
+						}
+					}
+					hasher.Write(data)
+					fr.PackSize += int64(len(data))
 					if packfile != nil {
 						if _, err := packfile.Write(data); err != nil {
 							return err
 						}
 					}
-				case pktline.SideBandProgress:
+				case SideBandProgress:
+					if len(data) == 0 {
+						logger.Debug("received sideband", "sideband", sideband.label(data))
+					}
 					if progress != nil {
 						if _, err := progress.Write(data); err != nil {
 							return err
 						}
 					}
-				case pktline.SideBandFatal:
+				case SideBandError:
 					return fmt.Errorf("fatal: %s", string(data))
 				default:
-					return fmt.Errorf("invalid sideband: %q", string(line))
+					if unknownSideBand == nil {
+						return fmt.Errorf("unexpected sideband channel %d (%s)", sideband, sideband)
+					}
+					logger.Debug("received sideband", "sideband", sideband.label(data), "channel", byte(sideband))
+					if _, err := unknownSideBand.Write(line); err != nil {
+						return err
+					}
 				}
 			}
 		default:
-			err = fmt.Errorf("unsupported pkt-line: %q", string(line))
+			return fmt.Errorf("unsupported pkt-line: %q", string(line))
 		}
-		if err != nil {
-			return err
+		// Each section is terminated by a delim-pkt (only the packfile may end the response)
+		if errors.Is(err, pktline.ErrDelimPkt) {
+			continue
+		} else if errors.Is(err, pktline.ErrFlushPkt) {
+			return fmt.Errorf("unexpected flush-pkt after %s section", section)
 		}
+		return truncated(section, err)
 	}
 }
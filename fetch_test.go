@@ -0,0 +1,1190 @@
+package protocolv2
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+// newFetchPayload builds a fetch response with a shallow-info and packfile section
+func newFetchPayload() []byte {
+	var b []byte
+	b = pktline.AppendString(b, "shallow-info\n")
+	b = pktline.AppendString(b, "shallow 0000000000000000000000000000000000000001\n")
+	b = pktline.AppendDelimPkt(b)
+	b = pktline.AppendString(b, "packfile\n")
+	b = pktline.AppendString(b, "\x02Enumerating objects: 1, done.\n")
+	b = pktline.AppendString(b, "\x01PACK")
+	b = pktline.AppendFlushPkt(b)
+	return b
+}
+
+func TestFetchResponseParse(t *testing.T) {
+	var packfile, progress bytes.Buffer
+	var fr FetchResponse
+	if err := fr.Parse(pktline.NewScanner(bytes.NewReader(newFetchPayload())), &packfile, &progress); err != nil {
+		t.Fatal(err)
+	}
+	if len(fr.ShallowInfo.Shallow) != 1 {
+		t.Fatalf("expected 1 shallow, got %d", len(fr.ShallowInfo.Shallow))
+	}
+	if packfile.String() != "PACK" {
+		t.Fatalf("unexpected packfile: %q", packfile.String())
+	}
+	if progress.String() != "Enumerating objects: 1, done.\n" {
+		t.Fatalf("unexpected progress: %q", progress.String())
+	}
+}
+
+func TestFetchResponseParseAcknowledgments(t *testing.T) {
+	var b []byte
+	b = pktline.AppendString(b, "acknowledgments\n")
+	b = pktline.AppendString(b, "NAK\n")
+	b = pktline.AppendFlushPkt(b)
+	var fr FetchResponse
+	if err := fr.Parse(pktline.NewScanner(bytes.NewReader(b)), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !fr.Acknowledgements.NAK {
+		t.Fatalf("expected NAK")
+	}
+}
+
+func TestFetchResponseParseTruncated(t *testing.T) {
+	payload := newFetchPayload()
+	tests := map[string]struct {
+		length      int
+		wantSection string
+	}{
+		"empty": {
+			length:      0,
+			wantSection: "fetch-response",
+		},
+		"shallow-info header": {
+			length:      len("0011shallow-info\n"),
+			wantSection: "shallow-info",
+		},
+		"shallow line": {
+			length:      len("0011shallow-info\n") + 10,
+			wantSection: "shallow-info",
+		},
+		"packfile header": {
+			length:      bytes.Index(payload, []byte("packfile\n")) + len("packfile\n"),
+			wantSection: "packfile",
+		},
+		"packfile data": {
+			length:      len(payload) - len("0000") - 2,
+			wantSection: "packfile",
+		},
+		"packfile flush": {
+			length:      len(payload) - len("0000"),
+			wantSection: "packfile",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var fr FetchResponse
+			err := fr.Parse(pktline.NewScanner(bytes.NewReader(payload[:tc.length])), io.Discard, io.Discard)
+			var truncated ErrTruncatedResponse
+			if !errors.As(err, &truncated) {
+				t.Fatalf("expected ErrTruncatedResponse, got %v", err)
+			}
+			if truncated.Section != tc.wantSection {
+				t.Fatalf("expected section %q, got %q", tc.wantSection, truncated.Section)
+			}
+		})
+	}
+}
+
+func TestFetchResponseParseEmptyRepository(t *testing.T) {
+	// git pack-objects --stdout </dev/null
+	emptyPack, _ := hex.DecodeString("5041434b0000000200000000029d08823bd8a8eab510ad6ac75c823cfd3ed31e")
+	tests := map[string]struct {
+		payload         []byte
+		wantErr         string
+		wantNothing     bool
+		wantEmptyPack   bool
+		wantPackHashHex string
+	}{
+		"empty response": {
+			payload:     nil,
+			wantErr:     "truncated during fetch-response section: nothing to fetch: EOF",
+			wantNothing: true,
+		},
+		"delim-pkt only": {
+			payload: pktline.AppendDelimPkt(nil),
+			wantErr: "truncated during fetch-response section: EOF",
+		},
+		"not our ref": {
+			// git upload-pack --stateless-rpc for a want in an empty repository
+			payload: []byte("0049ERR upload-pack: not our ref 0000000000000000000000000000000000000001"),
+			wantErr: "ERR upload-pack: not our ref 0000000000000000000000000000000000000001",
+		},
+		"empty pack": {
+			payload:         pktline.AppendFlushPkt(pktline.AppendBytes(pktline.AppendString(nil, "packfile\n"), append([]byte{1}, emptyPack...))),
+			wantEmptyPack:   true,
+			wantPackHashHex: "029d08823bd8a8eab510ad6ac75c823cfd3ed31e",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var fr FetchResponse
+			err := fr.Parse(pktline.NewScanner(bytes.NewReader(tc.payload)), io.Discard, io.Discard)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err.Error())
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if errors.Is(err, ErrNothingToFetch) != tc.wantNothing {
+				t.Fatalf("expected ErrNothingToFetch %v, got %v", tc.wantNothing, err)
+			}
+			if fr.IsEmptyPack("sha1") != tc.wantEmptyPack {
+				t.Fatalf("expected IsEmptyPack %v, got %d bytes", tc.wantEmptyPack, fr.PackSize)
+			}
+			if fr.PackHashHex() != tc.wantPackHashHex {
+				t.Fatalf("expected pack hash %q, got %q", tc.wantPackHashHex, fr.PackHashHex())
+			}
+		})
+	}
+}
+
+func TestPackfileIndexOrder(t *testing.T) {
+	inline := bytes.NewReader([]byte("inline"))
+	uri1 := bytes.NewReader([]byte("uri1"))
+	uri2 := bytes.NewReader([]byte("uri2"))
+	tests := map[string]struct {
+		inline io.Reader
+		uris   []io.Reader
+		want   []io.Reader
+	}{
+		"inline only": {
+			inline: inline,
+			want:   []io.Reader{inline},
+		},
+		"uris only": {
+			uris: []io.Reader{uri1, uri2},
+			want: []io.Reader{uri1, uri2},
+		},
+		"uris before inline": {
+			inline: inline,
+			uris:   []io.Reader{uri1, uri2},
+			want:   []io.Reader{uri1, uri2, inline},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := PackfileIndexOrder(tc.inline, tc.uris...)
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected %d packfiles, got %d", len(tc.want), len(got))
+			}
+			for idx := range got {
+				if got[idx] != tc.want[idx] {
+					t.Fatalf("unexpected packfile at index %d", idx)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildFetchRequestObjectFormat(t *testing.T) {
+	payload, err := os.ReadFile(filepath.Join("testdata", "git-2.39-sha256.advertisement"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sha256Advertisement CapabilityAdvertisement
+	if err := sha256Advertisement.Parse(pktline.NewScanner(bytes.NewReader(payload))); err != nil {
+		t.Fatal(err)
+	}
+	want := "0000000000000000000000000000000000000000000000000000000000000001"
+	tests := map[string]struct {
+		opts    FetchOptions
+		want    string
+		wantErr string
+	}{
+		"sha256": {
+			opts: FetchOptions{Advertisement: &sha256Advertisement, ObjectFormat: "sha256", Wants: []string{want}, Done: true},
+			want: "0012command=fetch\n0019object-format=sha256\n00010049want " + want + "0008done0000",
+		},
+		"sha256 without advertisement": {
+			opts: FetchOptions{ObjectFormat: "sha256", Wants: []string{want}, Done: true},
+			want: "0012command=fetch\n0019object-format=sha256\n00010049want " + want + "0008done0000",
+		},
+		"explicit capability": {
+			opts: FetchOptions{Capabilities: Capabilities{{Key: CapabilityObjectFormat, Value: "sha256"}}, ObjectFormat: "sha256", Wants: []string{want}, Done: true},
+			want: "0012command=fetch\n0019object-format=sha256\n00010049want " + want + "0008done0000",
+		},
+		"sha1 not advertised": {
+			opts:    FetchOptions{Advertisement: &sha256Advertisement, ObjectFormat: "sha1", Wants: []string{want}, Done: true},
+			wantErr: "object-format=sha1 requires the server to advertise it",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := BuildFetchRequest(tc.opts)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(req.Bytes()); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestBuildFetchRequest(t *testing.T) {
+	withRefInWant := &CapabilityAdvertisement{Capabilities: Capabilities{{Key: CapabilityFetch, Value: "shallow ref-in-want"}}}
+	withoutRefInWant := &CapabilityAdvertisement{Capabilities: Capabilities{{Key: CapabilityFetch, Value: "shallow"}}}
+	tests := map[string]struct {
+		opts    FetchOptions
+		want    CommandArguments
+		wantErr string
+	}{
+		"empty": {
+			opts:    FetchOptions{Done: true},
+			wantErr: "at least one want or want-ref is required",
+		},
+		"want": {
+			opts: FetchOptions{Wants: []string{"a"}, Haves: []string{"b"}, Deepen: 1, Done: true},
+			want: CommandArguments{
+				{Key: ArgumentDeepen, Value: "1"},
+				{Key: ArgumentHave, Value: "b"},
+				{Key: ArgumentWant, Value: "a"},
+				{Key: ArgumentDone},
+			},
+		},
+		"wait-for-done with haves": {
+			opts: FetchOptions{Wants: []string{"a"}, Haves: []string{"b"}, WaitForDone: true, Done: true},
+			want: CommandArguments{
+				{Key: ArgumentWaitForDone},
+				{Key: ArgumentHave, Value: "b"},
+				{Key: ArgumentWant, Value: "a"},
+				{Key: ArgumentDone},
+			},
+		},
+		"wait-for-done without haves": {
+			opts: FetchOptions{Wants: []string{"a"}, WaitForDone: true, Done: true},
+			want: CommandArguments{
+				{Key: ArgumentWant, Value: "a"},
+				{Key: ArgumentDone},
+			},
+		},
+		"packfile-uris": {
+			opts: FetchOptions{Wants: []string{"a"}, PackfileURIs: []string{"https", "http"}},
+			want: CommandArguments{
+				{Key: ArgumentPackfileURIs, Value: "https,http"},
+				{Key: ArgumentWant, Value: "a"},
+			},
+		},
+		"packfile-uris unsupported protocol": {
+			opts:    FetchOptions{Wants: []string{"a"}, PackfileURIs: []string{"https", "ftp"}},
+			wantErr: `unsupported packfile-uris protocol: "ftp"`,
+		},
+		"want-ref without advertisement": {
+			opts: FetchOptions{WantRefs: []string{"refs/heads/main"}},
+			want: CommandArguments{
+				{Key: ArgumentWantRef, Value: "refs/heads/main"},
+			},
+		},
+		"want-ref with ref-in-want": {
+			opts: FetchOptions{Advertisement: withRefInWant, WantRefs: []string{"refs/heads/main"}},
+			want: CommandArguments{
+				{Key: ArgumentWantRef, Value: "refs/heads/main"},
+			},
+		},
+		"want-ref without ref-in-want": {
+			opts:    FetchOptions{Advertisement: withoutRefInWant, WantRefs: []string{"refs/heads/main"}},
+			wantErr: "want-ref requires the server to advertise ref-in-want",
+		},
+		"auto features": {
+			opts: FetchOptions{Advertisement: withoutRefInWant, AutoFeatures: true, Wants: []string{"a"}},
+			want: CommandArguments{
+				{Key: ArgumentOFSDelta},
+				{Key: ArgumentWant, Value: "a"},
+			},
+		},
+		"auto features with fix-thin": {
+			opts: FetchOptions{Advertisement: withoutRefInWant, AutoFeatures: true, FixThin: true, Wants: []string{"a"}},
+			want: CommandArguments{
+				{Key: ArgumentThinPack},
+				{Key: ArgumentOFSDelta},
+				{Key: ArgumentWant, Value: "a"},
+			},
+		},
+		"auto features disabled": {
+			opts: FetchOptions{Advertisement: withoutRefInWant, AutoFeatures: true, FixThin: true, DisableFeatures: []string{ArgumentThinPack}, Wants: []string{"a"}},
+			want: CommandArguments{
+				{Key: ArgumentOFSDelta},
+				{Key: ArgumentWant, Value: "a"},
+			},
+		},
+		"auto features without advertisement": {
+			opts: FetchOptions{AutoFeatures: true, Wants: []string{"a"}},
+			want: CommandArguments{
+				{Key: ArgumentWant, Value: "a"},
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := BuildFetchRequest(tc.opts)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(req.Arguments, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, req.Arguments)
+			}
+		})
+	}
+}
+
+func TestParseShallowLine(t *testing.T) {
+	tests := map[string]struct {
+		input         string
+		wantIsShallow bool
+		wantOID       string
+		wantErr       string
+	}{
+		"shallow": {
+			input:         "shallow 0000000000000000000000000000000000000001\n",
+			wantIsShallow: true,
+			wantOID:       "0000000000000000000000000000000000000001",
+		},
+		"unshallow": {
+			input:   "unshallow 0000000000000000000000000000000000000002\n",
+			wantOID: "0000000000000000000000000000000000000002",
+		},
+		// git omits the trailing LF
+		"missing newline": {
+			input:         "shallow 0000000000000000000000000000000000000001",
+			wantIsShallow: true,
+			wantOID:       "0000000000000000000000000000000000000001",
+		},
+		"missing object ID": {
+			input:   "unshallow\n",
+			wantErr: "invalid shallow-info: \"unshallow\\n\"",
+		},
+		"invalid": {
+			input:   "deepen 1\n",
+			wantErr: "invalid shallow-info: \"deepen 1\\n\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			isShallow, oid, err := ParseShallowLine([]byte(tc.input))
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if isShallow != tc.wantIsShallow || oid != tc.wantOID {
+				t.Fatalf("expected (%v, %q), got (%v, %q)", tc.wantIsShallow, tc.wantOID, isShallow, oid)
+			}
+		})
+	}
+}
+
+func TestShallowInfoDeepen(t *testing.T) {
+	// Recorded from git 2.39 deepening two shallow tips by 3, the lines have no trailing LF
+	recorded := "0034shallow 1d745df1292b96c1cd05e90c41ad950edf87837a" +
+		"0034shallow bd75396216f028130d12a455d107a50a68207edd" +
+		"0036unshallow dbd4dc4a5cbe9e4fe12ea5b64db0c508c596a6d9" +
+		"0036unshallow 4d19e07227b4d6ea26e884e7d81673a7096aae6b" +
+		"0001"
+	interleaved := "0037unshallow dbd4dc4a5cbe9e4fe12ea5b64db0c508c596a6d9\n" +
+		"0035shallow 1d745df1292b96c1cd05e90c41ad950edf87837a\n" +
+		"0037unshallow 4d19e07227b4d6ea26e884e7d81673a7096aae6b\n" +
+		"0035shallow bd75396216f028130d12a455d107a50a68207edd\n" +
+		"0001"
+	want := ShallowInfo{
+		Shallow: []Shallow{
+			{ObjectID: "1d745df1292b96c1cd05e90c41ad950edf87837a"},
+			{ObjectID: "bd75396216f028130d12a455d107a50a68207edd"},
+		},
+		Unshallow: []Unshallow{
+			{ObjectID: "dbd4dc4a5cbe9e4fe12ea5b64db0c508c596a6d9"},
+			{ObjectID: "4d19e07227b4d6ea26e884e7d81673a7096aae6b"},
+		},
+	}
+	boundary := []string{"dbd4dc4a5cbe9e4fe12ea5b64db0c508c596a6d9", "4d19e07227b4d6ea26e884e7d81673a7096aae6b"}
+	wantBoundary := []string{"1d745df1292b96c1cd05e90c41ad950edf87837a", "bd75396216f028130d12a455d107a50a68207edd"}
+	for name, payload := range map[string]string{"recorded": recorded, "interleaved": interleaved} {
+		t.Run(name, func(t *testing.T) {
+			var si ShallowInfo
+			if err := si.Parse(pktline.NewScanner(strings.NewReader(payload))); !errors.Is(err, pktline.ErrDelimPkt) {
+				t.Fatalf("expected ErrDelimPkt, got %v", err)
+			}
+			if !reflect.DeepEqual(si, want) {
+				t.Fatalf("expected %v, got %v", want, si)
+			}
+			got, err := si.Apply(boundary, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, wantBoundary) {
+				t.Fatalf("expected boundary %v, got %v", wantBoundary, got)
+			}
+			// Append uses git's order (every shallow before the unshallows)
+			var roundTrip ShallowInfo
+			scanner := pktline.NewScanner(bytes.NewReader(si.Bytes()))
+			if _, err := scanner.Scan(); err != nil {
+				t.Fatal(err)
+			}
+			if err := roundTrip.Parse(scanner); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected io.EOF, got %v", err)
+			}
+			if !reflect.DeepEqual(roundTrip, want) {
+				t.Fatalf("expected round-trip %v, got %v", want, roundTrip)
+			}
+		})
+	}
+}
+
+func TestFetchResponseParseSignature(t *testing.T) {
+	tests := map[string]struct {
+		progress []string
+		packfile []string
+		wantErr  string
+	}{
+		"leading progress": {
+			progress: []string{"Enumerating objects: 3, done.\n", "Counting objects:  33% (1/3)\r", "Counting objects: 100% (3/3), done.\n"},
+			packfile: []string{"PACK\x00\x00\x00\x02"},
+		},
+		"leading progress error message": {
+			progress: []string{"Enumerating objects: 3, done.\n"},
+			packfile: []string{"<html>Service Unavailable</html>"},
+			wantErr:  "server did not send a packfile: \"<html>Service Unavailable</html>\"",
+		},
+		"packfile": {
+			packfile: []string{"PACK\x00\x00\x00\x02"},
+		},
+		"split signature": {
+			packfile: []string{"PA", "CK"},
+		},
+		"error message": {
+			packfile: []string{"<html>Service Unavailable</html>"},
+			wantErr:  "server did not send a packfile: \"<html>Service Unavailable</html>\"",
+		},
+		"split error message": {
+			packfile: []string{"PA", "TCH"},
+			wantErr:  "server did not send a packfile: \"TCH\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var b []byte
+			b = pktline.AppendString(b, "packfile\n")
+			for _, data := range tc.progress {
+				b = pktline.AppendString(b, "\x02"+data)
+			}
+			for _, data := range tc.packfile {
+				b = pktline.AppendString(b, "\x01"+data)
+			}
+			b = pktline.AppendFlushPkt(b)
+			var packfile, progress bytes.Buffer
+			var fr FetchResponse
+			err := fr.Parse(pktline.NewScanner(bytes.NewReader(b)), &packfile, &progress)
+			if want := strings.Join(tc.progress, ""); progress.String() != want {
+				t.Fatalf("expected progress %q, got %q", want, progress.String())
+			}
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				if !bytes.HasPrefix([]byte("PACK"), packfile.Bytes()) {
+					t.Fatalf("expected non-packfile data not to be written, got %q", packfile.String())
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWantedRefValidate(t *testing.T) {
+	tests := map[string]struct {
+		wr      WantedRef
+		wantErr string
+	}{
+		"valid": {
+			wr: WantedRef{ObjectID: "1", Name: "refs/heads/main"},
+		},
+		"newline": {
+			wr:      WantedRef{ObjectID: "1", Name: "refs/heads/main\n"},
+			wantErr: "invalid wanted-ref name: \"refs/heads/main\\n\"",
+		},
+		"nul": {
+			wr:      WantedRef{ObjectID: "1", Name: "refs/heads/\x00main"},
+			wantErr: "invalid wanted-ref name: \"refs/heads/\\x00main\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.wr.Validate()
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			// Parse rejects what Validate rejects, so an accepted WantedRef always round-trips
+			var parsed WantedRef
+			if err := parsed.Parse(tc.wr.Bytes()[4:]); (err != nil) != (tc.wantErr != "") {
+				t.Fatalf("expected Parse error %t, got %v", tc.wantErr != "", err)
+			}
+		})
+	}
+}
+
+func FuzzFetchResponseParse(f *testing.F) {
+	f.Add(newFetchPayload())
+	f.Add([]byte("0013acknowledgments\n0008NAK\n0000"))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		var fr FetchResponse
+		_ = fr.Parse(pktline.NewScanner(bytes.NewReader(payload)), io.Discard, io.Discard)
+	})
+}
+
+func TestFetchResponseDescribe(t *testing.T) {
+	tests := map[string]struct {
+		fr   FetchResponse
+		want string
+	}{
+		"empty": {},
+		"acknowledgments": {
+			fr: FetchResponse{
+				Acknowledgements: Acknowledgements{Ready: true, ACKs: []string{"a", "b"}},
+			},
+			want: "acknowledgments: ready=true nak=false acks=[a b]\n",
+		},
+		"all": {
+			fr: FetchResponse{
+				Acknowledgements: Acknowledgements{NAK: true},
+				ShallowInfo: ShallowInfo{
+					Shallow:   []Shallow{{ObjectID: "a"}, {ObjectID: "b"}},
+					Unshallow: []Unshallow{{ObjectID: "c"}},
+				},
+				WantedRefs:   WantedRefs{{ObjectID: "d", Name: "refs/heads/main"}},
+				PackfileURIs: PackfileURIs{{Checksum: "e", URI: "https://example.com/pack"}},
+			},
+			want: "acknowledgments: ready=false nak=true acks=[]\n" +
+				"shallow-info: shallow=2 unshallow=1\n" +
+				"wanted-refs: refs/heads/main=d\n" +
+				"packfile-uris: https://example.com/pack\n",
+		},
+		"request": {
+			fr: FetchResponse{
+				Acknowledgements: Acknowledgements{NAK: true},
+				Request: &CommandRequest{
+					Command: CapabilityFetch,
+					Arguments: CommandArguments{
+						{Key: ArgumentWant, Value: "a"},
+						{Key: ArgumentHave, Value: "b"},
+						{Key: ArgumentHave, Value: "c"},
+					},
+				},
+			},
+			want: "request: command=fetch wants=1 want-refs=0 haves=2 done=false\n" +
+				"acknowledgments: ready=false nak=true acks=[]\n",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.fr.Describe(); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestShallowInfoApply(t *testing.T) {
+	tests := map[string]struct {
+		si       ShallowInfo
+		boundary []string
+		relative bool
+		want     []string
+		wantErr  string
+	}{
+		"initial": {
+			si:   ShallowInfo{Shallow: []Shallow{{ObjectID: "a"}, {ObjectID: "b"}}},
+			want: []string{"a", "b"},
+		},
+		"relative deepen": {
+			si: ShallowInfo{
+				Shallow:   []Shallow{{ObjectID: "c"}},
+				Unshallow: []Unshallow{{ObjectID: "a"}},
+			},
+			boundary: []string{"a", "b"},
+			relative: true,
+			want:     []string{"b", "c"},
+		},
+		"relative unknown unshallow": {
+			si: ShallowInfo{
+				Unshallow: []Unshallow{{ObjectID: "z"}},
+			},
+			boundary: []string{"a"},
+			relative: true,
+			wantErr:  "unshallow z is not part of the shallow boundary",
+		},
+		"absolute unknown unshallow": {
+			si: ShallowInfo{
+				Shallow:   []Shallow{{ObjectID: "c"}},
+				Unshallow: []Unshallow{{ObjectID: "z"}},
+			},
+			boundary: []string{"a"},
+			want:     []string{"a", "c"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tc.si.Apply(tc.boundary, tc.relative)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFetchResponseParseSectionOrder(t *testing.T) {
+	tests := map[string]struct {
+		sections []string
+		wantErr  string
+	}{
+		"out of order": {
+			sections: []string{"shallow-info", "acknowledgments"},
+			wantErr:  "unexpected acknowledgments section after shallow-info section",
+		},
+		"duplicate": {
+			sections: []string{"wanted-refs", "wanted-refs"},
+			wantErr:  "unexpected wanted-refs section after wanted-refs section",
+		},
+		"second packfile": {
+			sections: []string{"packfile", "packfile"},
+			wantErr:  "unexpected packfile section after packfile section",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var b []byte
+			for _, section := range tc.sections {
+				b = pktline.AppendString(b, section+"\n")
+				if section == "packfile" {
+					b = pktline.AppendString(b, "\x01PACK")
+				}
+				b = pktline.AppendDelimPkt(b)
+			}
+			b = pktline.AppendFlushPkt(b)
+			var fr FetchResponse
+			err := fr.Parse(pktline.NewScanner(bytes.NewReader(b)), io.Discard, io.Discard)
+			if err == nil {
+				t.Fatalf("expected error, got nil")
+			} else if err.Error() != tc.wantErr {
+				t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestFetchResponseParsePackHash(t *testing.T) {
+	pack := append([]byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00"), bytes.Repeat([]byte{0xAB}, 100)...)
+	sha1Sum := sha1.Sum(pack)
+	sha256Sum := sha256.Sum256(pack)
+	tests := map[string]struct {
+		objectFormat string
+		packfile     []byte
+		want         []byte
+		wantErr      string
+	}{
+		"sha1": {
+			objectFormat: "sha1",
+			packfile:     append(slices.Clone(pack), sha1Sum[:]...),
+			want:         sha1Sum[:],
+		},
+		"sha256": {
+			objectFormat: "sha256",
+			packfile:     append(slices.Clone(pack), sha256Sum[:]...),
+			want:         sha256Sum[:],
+		},
+		"sha256 trailer in sha1 fetch": {
+			objectFormat: "sha1",
+			packfile:     append(slices.Clone(pack), sha256Sum[:]...),
+		},
+		"sha1 trailer in sha256 fetch": {
+			objectFormat: "sha256",
+			packfile:     append(slices.Clone(pack), sha1Sum[:]...),
+			wantErr:      "packfile trailer is not its sha256 checksum",
+		},
+		"mismatch": {
+			objectFormat: "sha1",
+			packfile:     append(slices.Clone(pack), make([]byte, sha1.Size)...),
+		},
+		"short": {
+			objectFormat: "sha1",
+			packfile:     []byte("PACK"),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var b []byte
+			b = pktline.AppendString(b, "packfile\n")
+			for chunk := range slices.Chunk(tc.packfile, 7) {
+				b = pktline.AppendBytes(b, append([]byte{byte(pktline.SideBandPackData)}, chunk...))
+			}
+			b = pktline.AppendFlushPkt(b)
+			var fr FetchResponse
+			err := fr.ParseObjectFormat(pktline.NewScanner(bytes.NewReader(b)), tc.objectFormat, io.Discard, io.Discard)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err.Error())
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if fr.PackSize != int64(len(tc.packfile)) {
+				t.Fatalf("expected %d packfile bytes, got %d", len(tc.packfile), fr.PackSize)
+			}
+			if !bytes.Equal(fr.PackHash, tc.want) {
+				t.Fatalf("expected %x, got %x", tc.want, fr.PackHash)
+			}
+			if fr.PackHashHex() != hex.EncodeToString(tc.want) {
+				t.Fatalf("expected %x, got %s", tc.want, fr.PackHashHex())
+			}
+		})
+	}
+}
+
+func TestBuildCloneRequest(t *testing.T) {
+	tests := map[string]struct {
+		tips    []string
+		opts    CloneOptions
+		want    CommandArguments
+		wantErr string
+	}{
+		"full": {
+			tips: []string{"a", "b"},
+			opts: CloneOptions{OFSDelta: true},
+			want: CommandArguments{
+				{Key: ArgumentOFSDelta},
+				{Key: ArgumentWant, Value: "a"},
+				{Key: ArgumentWant, Value: "b"},
+				{Key: ArgumentDone},
+			},
+		},
+		"shallow partial": {
+			tips: []string{"a"},
+			opts: CloneOptions{Depth: 1, Filter: "blob:none"},
+			want: CommandArguments{
+				{Key: ArgumentDeepen, Value: "1"},
+				{Key: ArgumentFilter, Value: "blob:none"},
+				{Key: ArgumentWant, Value: "a"},
+				{Key: ArgumentDone},
+			},
+		},
+		"no tips": {
+			wantErr: "at least one tip is required",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := BuildCloneRequest(tc.tips, tc.opts)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(req.Arguments, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, req.Arguments)
+			}
+		})
+	}
+}
+
+func TestAcknowledgementsParse(t *testing.T) {
+	tests := map[string]struct {
+		lines   []string
+		want    Acknowledgements
+		wantErr string
+	}{
+		"acks then ready": {
+			lines: []string{"ACK a\n", "ACK b\n", "ready\n"},
+			want:  Acknowledgements{ACKs: []string{"a", "b"}, Ready: true},
+		},
+		"ack after ready": {
+			lines:   []string{"ACK a\n", "ready\n", "ACK b\n"},
+			wantErr: "unexpected pkt-line after ready: \"ACK b\\n\"",
+		},
+		"nak after ready": {
+			lines:   []string{"ready\n", "NAK\n"},
+			wantErr: "unexpected pkt-line after ready: \"NAK\\n\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var b []byte
+			for _, line := range tc.lines {
+				b = pktline.AppendString(b, line)
+			}
+			b = pktline.AppendDelimPkt(b)
+			var a Acknowledgements
+			err := a.Parse(pktline.NewScanner(bytes.NewReader(b)))
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if !errors.Is(err, pktline.ErrDelimPkt) {
+				t.Fatalf("expected delim-pkt, got %v", err)
+			}
+			if !reflect.DeepEqual(a, tc.want) {
+				t.Fatalf("expected %+v, got %+v", tc.want, a)
+			}
+			if !bytes.Equal(a.Bytes(), append(pktline.AppendString(nil, "acknowledgments\n"), b[:len(b)-len("0001")]...)) {
+				t.Fatalf("unexpected round-trip: %q", string(a.Bytes()))
+			}
+		})
+	}
+}
+
+func TestFetchResponseIsEmptyPack(t *testing.T) {
+	tests := map[string]struct {
+		packSize     int64
+		objectFormat string
+		want         bool
+	}{
+		"no packfile": {
+			packSize: 0,
+		},
+		"sha1": {
+			packSize: 32,
+			want:     true,
+		},
+		"explicit sha1": {
+			packSize:     32,
+			objectFormat: "sha1",
+			want:         true,
+		},
+		"sha256": {
+			packSize:     44,
+			objectFormat: "sha256",
+			want:         true,
+		},
+		"sha256 objects": {
+			packSize:     44,
+			objectFormat: "sha1",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			fr := FetchResponse{PackSize: tc.packSize}
+			if got := fr.IsEmptyPack(tc.objectFormat); got != tc.want {
+				t.Fatalf("expected %t, got %t", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFetchResponseReferencedOIDs(t *testing.T) {
+	tests := map[string]struct {
+		fr   FetchResponse
+		want []string
+	}{
+		"empty": {},
+		"all sections": {
+			fr: FetchResponse{
+				Acknowledgements: Acknowledgements{ACKs: []string{"b", "a"}},
+				ShallowInfo: ShallowInfo{
+					Shallow:   []Shallow{{ObjectID: "c"}},
+					Unshallow: []Unshallow{{ObjectID: "d"}},
+				},
+				WantedRefs: WantedRefs{{ObjectID: "a", Name: "refs/heads/main"}},
+			},
+			want: []string{"a", "b", "c", "d"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.fr.ReferencedOIDs(); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFetchResponseVerifyWantedRefs(t *testing.T) {
+	fr := FetchResponse{WantedRefs: WantedRefs{
+		{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+		{ObjectID: "0000000000000000000000000000000000000002", Name: "refs/heads/next"},
+	}}
+	tests := map[string]struct {
+		requested []string
+		wantErr   string
+	}{
+		"complete": {
+			requested: []string{"refs/heads/main", "refs/heads/next"},
+		},
+		"subset": {
+			requested: []string{"refs/heads/next"},
+		},
+		"partial": {
+			requested: []string{"refs/heads/main", "refs/heads/secret", "refs/tags/v1"},
+			wantErr:   "missing wanted-refs: refs/heads/secret, refs/tags/v1",
+		},
+		"duplicate": {
+			requested: []string{"refs/heads/secret", "refs/heads/secret"},
+			wantErr:   "missing wanted-refs: refs/heads/secret",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := fr.VerifyWantedRefs(tc.requested)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFetchResponseVerifyPackfileURIs(t *testing.T) {
+	tests := map[string]struct {
+		uris      PackfileURIs
+		protocols []string
+		wantErr   string
+	}{
+		"none": {
+			protocols: []string{"https"},
+		},
+		"matching": {
+			uris: PackfileURIs{
+				{Checksum: "0000000000000000000000000000000000000001", URI: "https://cdn.example.com/pack-1.pack"},
+				{Checksum: "0000000000000000000000000000000000000002", URI: "HTTP://cdn.example.com/pack-2.pack"},
+			},
+			protocols: []string{"http", "https"},
+		},
+		"mismatched scheme": {
+			uris: PackfileURIs{
+				{Checksum: "0000000000000000000000000000000000000001", URI: "http://cdn.example.com/pack-1.pack"},
+			},
+			protocols: []string{"https"},
+			wantErr:   `packfile-uri "http://cdn.example.com/pack-1.pack" does not use a requested protocol (https)`,
+		},
+		"unsupported scheme": {
+			uris: PackfileURIs{
+				{Checksum: "0000000000000000000000000000000000000001", URI: "file:///etc/passwd"},
+			},
+			protocols: []string{"http", "https"},
+			wantErr:   `packfile-uri "file:///etc/passwd" does not use a requested protocol (http,https)`,
+		},
+		"invalid": {
+			uris: PackfileURIs{
+				{Checksum: "0000000000000000000000000000000000000001", URI: "https://cdn.example.com/%zz"},
+			},
+			protocols: []string{"https"},
+			wantErr:   `invalid packfile-uri: parse "https://cdn.example.com/%zz": invalid URL escape "%zz"`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := FetchResponse{PackfileURIs: tc.uris}.VerifyPackfileURIs(tc.protocols)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUnadvertisedWants(t *testing.T) {
+	tests := map[string]struct {
+		features []string
+		wants    []string
+		want     []string
+	}{
+		"advertised": {
+			wants: []string{"a"},
+		},
+		"unadvertised": {
+			wants: []string{"a", "z"},
+			want:  []string{"z"},
+		},
+		"allow-tip-sha1-in-want": {
+			features: []string{CapabilityAllowTipSHA1InWant},
+			wants:    []string{"z"},
+		},
+		"allow-reachable-sha1-in-want": {
+			features: []string{"shallow", CapabilityAllowReachableSHA1InWant},
+			wants:    []string{"z"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := UnadvertisedWants(tc.features, []string{"a", "b"}, tc.wants)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestBuildFetchRequestUnadvertisedWants(t *testing.T) {
+	advertise := func(features string) *CapabilityAdvertisement {
+		return &CapabilityAdvertisement{Capabilities: Capabilities{{Key: CapabilityFetch, Value: features}}}
+	}
+	tests := map[string]struct {
+		opts    FetchOptions
+		want    []string
+		wantErr string
+	}{
+		"advertised": {
+			opts: FetchOptions{Advertisement: advertise("shallow"), Tips: []string{"a", "b"}, Wants: []string{"a"}},
+		},
+		"unadvertised": {
+			opts:    FetchOptions{Advertisement: advertise("shallow"), Tips: []string{"a", "b"}, Wants: []string{"a", "z"}},
+			wantErr: "want z was not advertised, it requires the server to allow allow-tip-sha1-in-want or allow-reachable-sha1-in-want",
+		},
+		"unadvertised warning": {
+			opts: FetchOptions{Advertisement: advertise("shallow"), Tips: []string{"a", "b"}, Wants: []string{"a", "z"}},
+			want: []string{"z"},
+		},
+		"allow-tip-sha1-in-want": {
+			opts: FetchOptions{Advertisement: advertise("shallow allow-tip-sha1-in-want"), Tips: []string{"a", "b"}, Wants: []string{"z"}},
+		},
+		"allow-reachable-sha1-in-want": {
+			opts: FetchOptions{Advertisement: advertise("allow-reachable-sha1-in-want"), Tips: []string{"a", "b"}, Wants: []string{"z"}},
+		},
+		"without tips": {
+			opts: FetchOptions{Advertisement: advertise("shallow"), Wants: []string{"z"}},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			if tc.want != nil {
+				tc.opts.OnUnadvertisedWants = func(wants []string) { got = wants }
+			}
+			req, err := BuildFetchRequest(tc.opts)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err.Error())
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected unadvertised wants %v, got %v", tc.want, got)
+			}
+			if wants := req.Arguments.GetAll(ArgumentWant); !reflect.DeepEqual(wants, tc.opts.Wants) {
+				t.Fatalf("expected wants %v, got %v", tc.opts.Wants, wants)
+			}
+		})
+	}
+}
+
+func TestFetchResponseFixtures(t *testing.T) {
+	tests := map[string]struct {
+		objectFormat string
+	}{
+		"git-2.39-sha1.fetch": {
+			objectFormat: "sha1",
+		},
+		"git-2.39-sha256.fetch": {
+			objectFormat: "sha256",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			payload, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fr FetchResponse
+			var packfile, progress bytes.Buffer
+			if err := fr.ParseObjectFormat(pktline.NewScanner(bytes.NewReader(payload)), tc.objectFormat, &packfile, &progress); err != nil {
+				t.Fatal(err)
+			}
+			if len(fr.PackHash) != objectFormatSize(tc.objectFormat) {
+				t.Fatalf("expected %s packfile trailer to be verified, got %x", tc.objectFormat, fr.PackHash)
+			}
+			if fr.PackSize != int64(packfile.Len()) {
+				t.Fatalf("expected %d packfile bytes, got %d", packfile.Len(), fr.PackSize)
+			}
+			if !strings.Contains(progress.String(), "Enumerating objects: 3, done.") {
+				t.Fatalf("unexpected progress: %q", progress.String())
+			}
+			if !bytes.HasPrefix(payload, fr.Bytes()) {
+				t.Fatalf("expected %q to prefix the payload", string(fr.Bytes()))
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package protocolv2
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The characters (in addition to whitespace, '%' and '+') which must be
+// percent-encoded within the sub-filters of a "combine:" filter-spec
+const filterSpecReserved = "~`!@#$^&*()[]{}\\;'\",<>?"
+
+// Indicates the filter-spec is a combination of several (encoded) sub-filters
+const filterSpecCombinePrefix = "combine:"
+
+// filterSpecAllowUnencoded mirrors git's allow_unencoded
+func filterSpecAllowUnencoded(ch byte) bool {
+	if ch <= ' ' || ch >= 0x7f || ch == '%' || ch == '+' {
+		return false
+	}
+	return strings.IndexByte(filterSpecReserved, ch) == -1
+}
+
+// EncodeFilterSpec percent-encodes a filter-spec for use as a sub-filter of a "combine:" filter-spec
+func EncodeFilterSpec(spec string) string {
+	var sb strings.Builder
+	for idx := 0; idx < len(spec); idx++ {
+		if ch := spec[idx]; filterSpecAllowUnencoded(ch) {
+			sb.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&sb, "%%%02x", ch)
+		}
+	}
+	return sb.String()
+}
+
+// DecodeFilterSpec percent-decodes a sub-filter of a "combine:" filter-spec
+func DecodeFilterSpec(spec string) (string, error) {
+	var sb strings.Builder
+	for idx := 0; idx < len(spec); idx++ {
+		ch := spec[idx]
+		if ch == '%' {
+			if idx+2 >= len(spec) {
+				return "", fmt.Errorf("invalid filter-spec: %q", spec)
+			}
+			hi, ok1 := unhex(spec[idx+1])
+			lo, ok2 := unhex(spec[idx+2])
+			if !ok1 || !ok2 {
+				return "", fmt.Errorf("invalid filter-spec: %q", spec)
+			}
+			sb.WriteByte(hi<<4 | lo)
+			idx += 2
+			continue
+		}
+		if !filterSpecAllowUnencoded(ch) {
+			return "", fmt.Errorf("must escape char in sub-filter-spec: '%c'", ch)
+		}
+		sb.WriteByte(ch)
+	}
+	return sb.String(), nil
+}
+
+// CombineFilterSpecs returns a "combine:" filter-spec of the given filter-specs
+// A single filter-spec is returned as-is since it does not require combination
+func CombineFilterSpecs(specs ...string) string {
+	if len(specs) == 1 {
+		return specs[0]
+	}
+	encoded := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		encoded = append(encoded, EncodeFilterSpec(spec))
+	}
+	return filterSpecCombinePrefix + strings.Join(encoded, "+")
+}
+
+// SplitFilterSpec returns the decoded sub-filters of a "combine:" filter-spec
+// Any other filter-spec is returned as the only element
+func SplitFilterSpec(spec string) ([]string, error) {
+	combined, ok := strings.CutPrefix(spec, filterSpecCombinePrefix)
+	if !ok {
+		return []string{spec}, nil
+	}
+	var specs []string
+	for _, sub := range strings.Split(combined, "+") {
+		if len(sub) == 0 {
+			return nil, fmt.Errorf("invalid filter-spec: %q", spec)
+		}
+		decoded, err := DecodeFilterSpec(sub)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, decoded)
+	}
+	return specs, nil
+}
+
+// ExpandFilterSpec validates the filter-spec and returns it in the form git sends it, where the
+// scaled integer of a "blob:limit=<n>[kmg]" filter-spec is fully expanded (ex: "1k" to "1024").
+// Like git, the sub-filters of a "combine:" filter-spec are validated but sent as-is.
+func ExpandFilterSpec(spec string) (string, error) {
+	specs, err := SplitFilterSpec(spec)
+	if err != nil {
+		return "", err
+	}
+	for _, sub := range specs {
+		if limit, ok := strings.CutPrefix(sub, "blob:limit="); ok {
+			n, err := parseFilterUnit(limit)
+			if err != nil {
+				return "", fmt.Errorf("invalid filter-spec: %q", spec)
+			}
+			if len(specs) == 1 {
+				return "blob:limit=" + strconv.FormatUint(n, 10), nil
+			}
+		} else if depth, ok := strings.CutPrefix(sub, "tree:"); ok {
+			if _, err := parseFilterUnit(depth); err != nil {
+				return "", fmt.Errorf("invalid filter-spec: %q", spec)
+			}
+		}
+	}
+	return spec, nil
+}
+
+// parseFilterUnit mirrors git's git_parse_ulong, parsing an integer with an optional
+// (case-insensitive) 'k', 'm' or 'g' suffix for 1024, 1048576 and 1073741824 respectively
+func parseFilterUnit(value string) (uint64, error) {
+	factor := uint64(1)
+	if len(value) > 0 {
+		switch value[len(value)-1] {
+		case 'k', 'K':
+			factor = 1 << 10
+		case 'm', 'M':
+			factor = 1 << 20
+		case 'g', 'G':
+			factor = 1 << 30
+		}
+		if factor != 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxUint64/factor {
+		return 0, strconv.ErrRange
+	}
+	return n * factor, nil
+}
+
+// unhex returns the value of a hexadecimal digit
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
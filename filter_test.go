@@ -0,0 +1,154 @@
+package protocolv2
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFilterSpec(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    string
+		wantErr string
+	}{
+		"plain": {
+			input: "blob:none",
+			want:  "blob:none",
+		},
+		"encoded": {
+			input: "sparse:oid=main%3adir%2bfile%7e",
+			want:  "sparse:oid=main:dir+file~",
+		},
+		"uppercase": {
+			input: "sparse:oid=main%3Adir",
+			want:  "sparse:oid=main:dir",
+		},
+		"unescaped reserved": {
+			input:   "sparse:oid=main~",
+			wantErr: "must escape char in sub-filter-spec: '~'",
+		},
+		"invalid escape": {
+			input:   "blob%zz",
+			wantErr: "invalid filter-spec: \"blob%zz\"",
+		},
+		"truncated escape": {
+			input:   "blob%2",
+			wantErr: "invalid filter-spec: \"blob%2\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := DecodeFilterSpec(tc.input)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCombineFilterSpecs(t *testing.T) {
+	specs := []string{"blob:none", "sparse:oid=main:path with spaces", "tree:2"}
+	combined := CombineFilterSpecs(specs...)
+	if combined != "combine:blob:none+sparse:oid=main:path%20with%20spaces+tree:2" {
+		t.Fatalf("unexpected filter-spec: %q", combined)
+	}
+	got, err := SplitFilterSpec(combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, specs) {
+		t.Fatalf("expected %v, got %v", specs, got)
+	}
+	if single := CombineFilterSpecs("blob:none"); single != "blob:none" {
+		t.Fatalf("unexpected filter-spec: %q", single)
+	}
+}
+
+func TestExpandFilterSpec(t *testing.T) {
+	// The expected values are the filter-specs git sends (expand_list_objects_filter_spec)
+	tests := map[string]struct {
+		input   string
+		want    string
+		wantErr string
+	}{
+		"blob:none": {
+			input: "blob:none",
+			want:  "blob:none",
+		},
+		"blob:limit": {
+			input: "blob:limit=1000",
+			want:  "blob:limit=1000",
+		},
+		"blob:limit k": {
+			input: "blob:limit=1k",
+			want:  "blob:limit=1024",
+		},
+		"blob:limit uppercase M": {
+			input: "blob:limit=1M",
+			want:  "blob:limit=1048576",
+		},
+		"blob:limit g": {
+			input: "blob:limit=2g",
+			want:  "blob:limit=2147483648",
+		},
+		"tree": {
+			input: "tree:2",
+			want:  "tree:2",
+		},
+		"combine": {
+			input: "combine:blob:none+blob:limit=1m",
+			want:  "combine:blob:none+blob:limit=1m",
+		},
+		"invalid suffix": {
+			input:   "blob:limit=1x",
+			wantErr: "invalid filter-spec: \"blob:limit=1x\"",
+		},
+		"missing limit": {
+			input:   "blob:limit=k",
+			wantErr: "invalid filter-spec: \"blob:limit=k\"",
+		},
+		"negative limit": {
+			input:   "blob:limit=-1",
+			wantErr: "invalid filter-spec: \"blob:limit=-1\"",
+		},
+		"overflow": {
+			input:   "blob:limit=18446744073709551615k",
+			wantErr: "invalid filter-spec: \"blob:limit=18446744073709551615k\"",
+		},
+		"invalid tree depth": {
+			input:   "tree:x",
+			wantErr: "invalid filter-spec: \"tree:x\"",
+		},
+		"combine invalid suffix": {
+			input:   "combine:blob:none+blob:limit=1x",
+			wantErr: "invalid filter-spec: \"combine:blob:none+blob:limit=1x\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ExpandFilterSpec(tc.input)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
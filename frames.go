@@ -0,0 +1,107 @@
+package protocolv2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+// FrameType classifies a pkt-line decoded by DecodeFrames
+type FrameType int
+
+const (
+	// FrameData is a pkt-line outside of the packfile section (ex: "ACK <obj-id>\n")
+	FrameData FrameType = iota
+	// FrameSection is a fetch response section header (ex: "packfile\n")
+	FrameSection
+	// FrameSideBand is a pkt-line of the packfile section, multiplexed by its sideband byte
+	FrameSideBand
+	// FrameFlush is a flush-pkt (0000)
+	FrameFlush
+	// FrameDelim is a delim-pkt (0001)
+	FrameDelim
+	// FrameResponseEnd is a response-end-pkt (0002)
+	FrameResponseEnd
+)
+
+// Frame is a single classified pkt-line of a response
+type Frame struct {
+	Type FrameType
+	// SideBand is the channel of a FrameSideBand (ex: SideBandPack)
+	SideBand SideBand
+	// Data is the payload of the pkt-line, without the sideband byte for a FrameSideBand
+	Data []byte
+}
+
+// String implements the fmt.Stringer interface, the packfile data is summarized by its length
+func (f Frame) String() string {
+	switch f.Type {
+	case FrameSection:
+		return "section " + escapePacket(f.Data)
+	case FrameSideBand:
+		switch label := f.SideBand.label(f.Data); label {
+		case "pack":
+			return fmt.Sprintf("sideband %d (%d bytes)", f.SideBand, len(f.Data))
+		case "keepalive":
+			return fmt.Sprintf("sideband %d (keepalive)", f.SideBand)
+		case "unknown":
+			return fmt.Sprintf("sideband %d (unknown) %s", f.SideBand, escapePacket(f.Data))
+		default:
+			return fmt.Sprintf("sideband %d %s", f.SideBand, escapePacket(f.Data))
+		}
+	case FrameFlush:
+		return "flush-pkt"
+	case FrameDelim:
+		return "delim-pkt"
+	case FrameResponseEnd:
+		return "response-end-pkt"
+	default:
+		return "data " + escapePacket(f.Data)
+	}
+}
+
+// DecodeFrames reads every pkt-line until the end of the stream, classifying each as a Frame.
+// It is a debugging utility (ex: for test assertions or dumping a response) which buffers the entire
+// response including the packfile, use FetchResponse.Parse to stream a response instead.
+// An error-line ends the decoding, returning the frames decoded so far with the pktline.ErrErrorLine.
+func DecodeFrames(scanner *pktline.Scanner) ([]Frame, error) {
+	var frames []Frame
+	var packfile bool
+	for {
+		line, err := scanner.Scan()
+		switch {
+		case err == nil:
+		case errors.Is(err, io.EOF):
+			return frames, nil
+		case errors.Is(err, pktline.ErrFlushPkt):
+			// Each response ends with a flush-pkt, so the next pkt-line starts a new response
+			packfile = false
+			frames = append(frames, Frame{Type: FrameFlush})
+			continue
+		case errors.Is(err, pktline.ErrDelimPkt):
+			frames = append(frames, Frame{Type: FrameDelim})
+			continue
+		case errors.Is(err, pktline.ErrResponseEndPkt):
+			packfile = false
+			frames = append(frames, Frame{Type: FrameResponseEnd})
+			continue
+		default:
+			return frames, err
+		}
+		data := bytes.Clone(line)
+		switch next, _ := bytes.CutSuffix(data, []byte("\n")); {
+		case packfile && len(data) > 0:
+			frames = append(frames, Frame{Type: FrameSideBand, SideBand: SideBand(data[0]), Data: data[1:]})
+		// The first of fetchSections is the start of the response rather than a section header
+		case slices.Contains(fetchSections[1:], string(next)):
+			packfile = string(next) == "packfile"
+			frames = append(frames, Frame{Type: FrameSection, Data: data})
+		default:
+			frames = append(frames, Frame{Type: FrameData, Data: data})
+		}
+	}
+}
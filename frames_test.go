@@ -0,0 +1,85 @@
+package protocolv2
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func TestDecodeFrames(t *testing.T) {
+	tests := map[string]struct {
+		payload []byte
+		want    []string
+		wantErr string
+	}{
+		"fetch response": {
+			payload: newFetchPayload(),
+			want: []string{
+				"section shallow-info",
+				"data shallow 0000000000000000000000000000000000000001",
+				"delim-pkt",
+				"section packfile",
+				"sideband 2 Enumerating objects: 1, done.",
+				"sideband 1 (4 bytes)",
+				"flush-pkt",
+			},
+		},
+		"successive responses": {
+			payload: append(pktline.AppendFlushPkt(Acknowledgements{NAK: true}.Append(nil)), newFetchPayload()[:len("0011shallow-info\n")]...),
+			want: []string{
+				"section acknowledgments",
+				"data NAK",
+				"flush-pkt",
+				"section shallow-info",
+			},
+		},
+		"ls-refs response": {
+			payload: ListReferencesResponse{References: []Reference{{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"}}}.Bytes(),
+			want: []string{
+				"data 0000000000000000000000000000000000000001 refs/heads/main",
+				"flush-pkt",
+			},
+		},
+		"keepalive and unknown sideband": {
+			payload: []byte("000dpackfile\n0005\x020008\x04ext0000"),
+			want: []string{
+				"section packfile",
+				"sideband 2 (keepalive)",
+				"sideband 4 (unknown) ext",
+				"flush-pkt",
+			},
+		},
+		"response-end-pkt": {
+			payload: []byte("0002"),
+			want:    []string{"response-end-pkt"},
+		},
+		"error-line": {
+			payload: []byte("000dpackfile\n0009ERR x"),
+			want:    []string{"section packfile"},
+			wantErr: "ERR x",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			frames, err := DecodeFrames(pktline.NewScanner(bytes.NewReader(tc.payload)))
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, frame := range frames {
+				got = append(got, frame.String())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
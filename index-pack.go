@@ -0,0 +1,37 @@
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// IndexPack pipes the packfile (ex: written by Client.Fetch to an io.Pipe) into git index-pack in
+// the repository at gitDir, storing the pack and its index under objects/pack/ as the last step of
+// a clone or fetch. It returns the pack hash which names the stored pack-<hash>.pack. The --fix-thin
+// flag is always passed so a thin pack (requested with the thin-pack argument) is completed with the
+// missing base objects from the repository, it has no effect on a pack which is not thin. Only for a
+// pack which is not thin does the hash match the FetchResponse.PackHashHex, completing a thin pack
+// rewrites its trailer. The stderr of index-pack is included in the error.
+func IndexPack(ctx context.Context, packReader io.Reader, gitDir string) (packHash string, err error) {
+	cmd := exec.CommandContext(ctx, "git", "--git-dir="+gitDir, "index-pack", "--stdin", "--fix-thin")
+	cmd.Stdin = packReader
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git index-pack failed: %w: %s", err, msg)
+		}
+		return "", fmt.Errorf("git index-pack failed: %w", err)
+	}
+	// index-pack prints "pack\t<hash>" (or "keep\t<hash>" if a .keep file was created)
+	_, packHash, _ = strings.Cut(strings.TrimSpace(stdout.String()), "\t")
+	if !isObjectID([]byte(packHash)) {
+		return "", fmt.Errorf("invalid git index-pack output: %q", stdout.String())
+	}
+	return packHash, nil
+}
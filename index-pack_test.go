@@ -0,0 +1,68 @@
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func TestIndexPack(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	payload, err := os.ReadFile(filepath.Join("testdata", "git-2.39-sha1.fetch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		payload []byte
+		wantErr string
+	}{
+		"packfile": {
+			payload: payload,
+		},
+		"corrupt": {
+			payload: []byte("000dpackfile\n0009\x01PACK0000"),
+			wantErr: "git index-pack failed: exit status 128: fatal: ",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitDir := t.TempDir()
+			if out, err := exec.Command("git", "init", "--quiet", "--bare", gitDir).CombinedOutput(); err != nil {
+				t.Fatalf("git init failed: %v: %s", err, out)
+			}
+			// Stream the packfile into index-pack as it is parsed
+			pr, pw := io.Pipe()
+			var fr FetchResponse
+			go func() {
+				pw.CloseWithError(fr.Parse(pktline.NewScanner(bytes.NewReader(tc.payload)), pw, io.Discard))
+			}()
+			packHash, err := IndexPack(context.Background(), pr, gitDir)
+			pr.Close()
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if packHash != fr.PackHashHex() {
+				t.Fatalf("expected pack hash %s, got %s", fr.PackHashHex(), packHash)
+			}
+			if _, err := os.Stat(filepath.Join(gitDir, "objects", "pack", "pack-"+packHash+".idx")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
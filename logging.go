@@ -0,0 +1,21 @@
+package protocolv2
+
+import (
+	"io"
+	"log/slog"
+	"math"
+)
+
+// discardLogger is used when no *slog.Logger is configured
+// slog.DiscardHandler requires go1.24, so instead every level is disabled
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{
+	Level: slog.Level(math.MaxInt),
+}))
+
+// loggerOrDiscard returns the logger or discardLogger if nil
+func loggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger != nil {
+		return logger
+	}
+	return discardLogger
+}
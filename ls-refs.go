@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 
 	pktline "github.com/bored-engineer/git-pkt-line"
@@ -28,6 +29,58 @@ const (
 	ArgumentUnborn = "unborn"
 )
 
+// The protocol v0/v1 reference advertisement reports symbolic refs as "symref=<name>:<target>"
+// capabilities (ex: "symref=HEAD:refs/heads/main") on the first ref. Protocol-v2 has no such
+// capability, instead ls-refs reports them as "symref-target:<target>" ref attributes if the
+// "symrefs" argument is sent.
+const CapabilitySymref = "symref"
+
+// LsRefsOptions are the typed arguments for an ls-refs command-request
+type LsRefsOptions struct {
+	// Advertisement (if non-nil) is used to validate the server supports the requested features
+	Advertisement *CapabilityAdvertisement
+	// DropUnsupported silently drops unsupported features instead of returning an error
+	DropUnsupported bool
+	// Capabilities to include in the command-request
+	Capabilities Capabilities
+	// Symrefs requests the underlying ref of symbolic refs
+	Symrefs bool
+	// Peel requests peeled tags
+	Peel bool
+	// Unborn requests HEAD even if it points to an unborn branch
+	Unborn bool
+	// Prefixes limits the references to those matching any prefix
+	Prefixes []string
+}
+
+// BuildLsRefsRequest constructs an ls-refs command-request from the given options
+func BuildLsRefsRequest(opts LsRefsOptions) (*CommandRequest, error) {
+	// Older servers will error if sent "unborn" without advertising ls-refs=unborn
+	if opts.Unborn && opts.Advertisement != nil && !opts.Advertisement.SupportsFeature(CapabilityListReferences, ArgumentUnborn) {
+		if !opts.DropUnsupported {
+			return nil, errors.New("unborn requires the server to advertise ls-refs=unborn")
+		}
+		opts.Unborn = false
+	}
+	req := &CommandRequest{
+		Command:      CapabilityListReferences,
+		Capabilities: opts.Capabilities,
+	}
+	if opts.Symrefs {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentSymRefs})
+	}
+	if opts.Peel {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentPeel})
+	}
+	if opts.Unborn {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentUnborn})
+	}
+	for _, prefix := range opts.Prefixes {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentRefPrefix, Value: prefix})
+	}
+	return req, nil
+}
+
 // ref = PKT-LINE(obj-id-or-unborn SP refname *(SP ref-attribute) LF)
 type Reference struct {
 	// obj-id-or-unborn = (obj-id | "unborn")
@@ -37,7 +90,21 @@ type Reference struct {
 	Attributes []string
 }
 
+// Validate returns an error if the reference would corrupt the pkt-line framing
+func (r Reference) Validate() error {
+	if strings.ContainsAny(r.Name, "\n\x00") {
+		return fmt.Errorf("invalid ref name: %q", r.Name)
+	}
+	for _, attr := range r.Attributes {
+		if strings.ContainsAny(attr, "\n\x00") {
+			return fmt.Errorf("invalid ref attribute: %q", attr)
+		}
+	}
+	return nil
+}
+
 // Append the reference pkt-line to the given slice
+// The reference is not validated, use Validate before serving untrusted references
 func (r Reference) Append(b []byte) []byte {
 	sz := len(r.ObjectID) + len(" ") + len(r.Name)
 	for _, attr := range r.Attributes {
@@ -74,7 +141,69 @@ func (r Reference) String() string {
 	return sb.String()
 }
 
-// Parse populates the fields from a given pkt-line slice
+// MarshalText implements the encoding.TextMarshaler interface using the String form
+func (r Reference) MarshalText() ([]byte, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface, the inverse of MarshalText
+func (r *Reference) UnmarshalText(text []byte) error {
+	var ref Reference
+	if err := ref.Parse(append(slices.Clip(text), '\n')); err != nil {
+		return err
+	}
+	*r = ref
+	return nil
+}
+
+// Attribute returns the value of the first attribute in the "<prefix>:<value>" form
+// ref-attribute = (symref | peeled), unknown attributes from newer servers are preserved
+func (r Reference) Attribute(prefix string) (string, bool) {
+	for _, attr := range r.Attributes {
+		if value, ok := strings.CutPrefix(attr, prefix+":"); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// SymrefTarget returns the target of a symbolic ref (requires the "symrefs" argument)
+// symref = "symref-target:" symref-target
+func (r Reference) SymrefTarget() (string, bool) {
+	return r.Attribute("symref-target")
+}
+
+// Symrefs returns the targets of the symbolic refs (keyed by name) reported in either form, by the
+// "symref=<name>:<target>" capabilities of a protocol v0/v1 advertisement or the "symref-target:"
+// attributes of protocol-v2 ls-refs references. If both report a ref the attribute takes precedence.
+func Symrefs(refs []Reference, caps Capabilities) map[string]string {
+	symrefs := make(map[string]string)
+	for _, c := range caps {
+		if c.Key != CapabilitySymref {
+			continue
+		}
+		if name, target, ok := strings.Cut(c.Value, ":"); ok && name != "" && target != "" {
+			symrefs[name] = target
+		}
+	}
+	for _, ref := range refs {
+		if target, ok := ref.SymrefTarget(); ok {
+			symrefs[ref.Name] = target
+		}
+	}
+	return symrefs
+}
+
+// Peeled returns the object ID of a peeled tag (requires the "peel" argument)
+// peeled = "peeled:" obj-id
+func (r Reference) Peeled() (string, bool) {
+	return r.Attribute("peeled")
+}
+
+// Parse populates the fields from a given pkt-line slice, rejecting invalid references (see Validate)
 func (r *Reference) Parse(line []byte) error {
 	remaining, ok := bytes.CutSuffix(line, []byte("\n"))
 	if !ok {
@@ -92,7 +221,8 @@ func (r *Reference) Parse(line []byte) error {
 		attr, remaining, ok = bytes.Cut(remaining, []byte(" "))
 		r.Attributes = append(r.Attributes, string(attr))
 	}
-	return nil
+	// Reject what Append would emit differently, so a parsed reference always round-trips
+	return r.Validate()
 }
 
 // https://git-scm.com/docs/protocol-v2#_ls_refs
@@ -123,20 +253,165 @@ func (lrs ListReferencesResponse) Map() map[string]string {
 	return m
 }
 
+// InferObjectFormat returns the object-format (ex: "sha1" or "sha256") implied by the length of the
+// object ID of the first reference which has one (skipping unborn references), a fallback for servers
+// which do not advertise the object-format capability. Returns false if there is no such reference.
+func (lrs ListReferencesResponse) InferObjectFormat() (string, bool) {
+	for _, ref := range lrs.References {
+		if objectFormat, ok := objectFormatOf(ref.ObjectID); ok {
+			return objectFormat, true
+		}
+	}
+	return "", false
+}
+
+// WantsFromReferences returns the unique object IDs of the references (skipping unborn references)
+// for use as the wants of a fetch command-request
+func WantsFromReferences(refs []Reference) []string {
+	var wants []string
+	uniq := make(map[string]struct{}, len(refs))
+	for _, ref := range refs {
+		if ref.ObjectID == "unborn" {
+			continue
+		}
+		if _, ok := uniq[ref.ObjectID]; ok {
+			continue
+		}
+		uniq[ref.ObjectID] = struct{}{}
+		wants = append(wants, ref.ObjectID)
+	}
+	return wants
+}
+
+// PeeledTags returns the annotated tags, the references under refs/tags/ with a "peeled:" attribute
+// (requires the "peel" argument), lightweight tags point directly at their object and are omitted
+func (lrs ListReferencesResponse) PeeledTags() []Reference {
+	var tags []Reference
+	for _, ref := range lrs.References {
+		if !strings.HasPrefix(ref.Name, "refs/tags/") {
+			continue
+		}
+		if _, ok := ref.Peeled(); ok {
+			tags = append(tags, ref)
+		}
+	}
+	return tags
+}
+
+// IncludedTags returns the annotated tags whose tag object was fetched, as reported by has (ex: a
+// lookup in the index of the fetched packfile). With the include-tag argument the server adds the
+// annotated tags pointing at fetched objects to the packfile but never their refs, so the client
+// creates these refs locally after the fetch (as git does when following tags). If the packfile
+// can't be inspected, checking the peeled object ID against the wants finds the tags of the fetched
+// tips, but misses those of older commits which the server also included.
+func (lrs ListReferencesResponse) IncludedTags(has func(objID string) bool) []Reference {
+	var tags []Reference
+	for _, ref := range lrs.PeeledTags() {
+		if has(ref.ObjectID) {
+			tags = append(tags, ref)
+		}
+	}
+	return tags
+}
+
+// Filter returns only the references matching any of the given prefixes
+// Servers MAY ignore ref-prefix, so clients should filter the result themselves
+func (lrs ListReferencesResponse) Filter(prefixes []string) ListReferencesResponse {
+	if len(prefixes) == 0 {
+		return lrs
+	}
+	var filtered ListReferencesResponse
+	for _, ref := range lrs.References {
+		if ref.MatchesPrefixes(prefixes) {
+			filtered.References = append(filtered.References, ref)
+		}
+	}
+	return filtered
+}
+
+// Stats returns the number of references matching each prefix (a reference matching overlapping
+// prefixes is counted for each), along with the total number of references under the empty prefix
+// which matches every reference
+func (lrs ListReferencesResponse) Stats(prefixes []string) map[string]int {
+	stats := make(map[string]int, len(prefixes)+1)
+	stats[""] = len(lrs.References)
+	for _, prefix := range prefixes {
+		if _, ok := stats[prefix]; ok {
+			continue
+		}
+		var count int
+		for _, ref := range lrs.References {
+			if strings.HasPrefix(ref.Name, prefix) {
+				count++
+			}
+		}
+		stats[prefix] = count
+	}
+	return stats
+}
+
+// MatchesPrefixes returns true if the name has one of the given prefixes (or there are none)
+func (r Reference) MatchesPrefixes(prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(r.Name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // Parse populates the fields from a given pkt-line scanner
 func (lrs *ListReferencesResponse) Parse(scanner *pktline.Scanner) error {
+	return lrs.ParseLimit(scanner, 0)
+}
+
+// ErrTooManyReferences is returned when an ls-refs response exceeds the maximum number of references
+var ErrTooManyReferences = errors.New("too many references")
+
+// ParseLimit is Parse but returns ErrTooManyReferences once more than maxReferences (if positive)
+// references are parsed, protecting against a server advertising an unbounded number of references.
+// The references parsed before the limit was exceeded are retained.
+func (lrs *ListReferencesResponse) ParseLimit(scanner *pktline.Scanner, maxReferences int) error {
+	var count int
+	return ForEachReference(scanner, func(ref Reference) error {
+		if maxReferences > 0 && count >= maxReferences {
+			return fmt.Errorf("%w: more than %d", ErrTooManyReferences, maxReferences)
+		}
+		count++
+		lrs.References = append(lrs.References, ref)
+		return nil
+	})
+}
+
+// ErrStopIteration may be returned by the callback of ForEachReference (or Client.LsRefsStream)
+// to stop parsing early without an error
+var ErrStopIteration = errors.New("stop iteration")
+
+// ForEachReference parses an ls-refs response from the scanner, invoking fn for each reference
+// as it is parsed. Unlike Parse the references are never collected, bounding memory usage for
+// responses with many references. Parsing stops at the first error returned by fn, if that error
+// is ErrStopIteration nil is returned and the remainder of the response is left unread.
+func ForEachReference(scanner *pktline.Scanner, fn func(Reference) error) error {
 	for {
 		line, err := scanner.Scan()
 		if err != nil {
 			if errors.Is(err, pktline.ErrFlushPkt) {
 				return nil
 			}
-			return err
+			return truncated("ls-refs", err)
 		}
 		var ref Reference
 		if err := ref.Parse(line); err != nil {
 			return err
 		}
-		lrs.References = append(lrs.References, ref)
+		if err := fn(ref); err != nil {
+			if errors.Is(err, ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
 	}
 }
@@ -0,0 +1,633 @@
+package protocolv2
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func TestBuildLsRefsRequest(t *testing.T) {
+	req, err := BuildLsRefsRequest(LsRefsOptions{
+		Symrefs:  true,
+		Peel:     true,
+		Unborn:   true,
+		Prefixes: []string{"HEAD", "refs/heads/", "refs/tags/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req.Bytes(), []byte("0014command=ls-refs\n"+
+		"0001"+
+		"000bsymrefs"+
+		"0008peel"+
+		"000aunborn"+
+		"0013ref-prefix HEAD"+
+		"001aref-prefix refs/heads/"+
+		"0019ref-prefix refs/tags/"+
+		"0000")) {
+		t.Fatalf("unexpected payload: %q", string(req.Bytes()))
+	}
+}
+
+func TestBuildLsRefsRequestUnborn(t *testing.T) {
+	withUnborn := &CapabilityAdvertisement{Capabilities: Capabilities{{Key: CapabilityListReferences, Value: "unborn"}}}
+	withoutUnborn := &CapabilityAdvertisement{Capabilities: Capabilities{{Key: CapabilityListReferences}}}
+	tests := map[string]struct {
+		opts    LsRefsOptions
+		want    CommandArguments
+		wantErr string
+	}{
+		"advertised": {
+			opts: LsRefsOptions{Advertisement: withUnborn, Unborn: true},
+			want: CommandArguments{{Key: ArgumentUnborn}},
+		},
+		"not advertised": {
+			opts:    LsRefsOptions{Advertisement: withoutUnborn, Unborn: true},
+			wantErr: "unborn requires the server to advertise ls-refs=unborn",
+		},
+		"not advertised dropped": {
+			opts: LsRefsOptions{Advertisement: withoutUnborn, Unborn: true, DropUnsupported: true},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := BuildLsRefsRequest(tc.opts)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(req.Arguments, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, req.Arguments)
+			}
+		})
+	}
+}
+
+func TestListReferencesResponseFilter(t *testing.T) {
+	lrs := ListReferencesResponse{
+		References: []Reference{
+			{ObjectID: "1", Name: "HEAD"},
+			{ObjectID: "1", Name: "refs/heads/main"},
+			{ObjectID: "2", Name: "refs/pull/1/head"},
+			{ObjectID: "3", Name: "refs/tags/v1"},
+		},
+	}
+	tests := map[string]struct {
+		prefixes []string
+		want     []Reference
+	}{
+		"none": {
+			want: lrs.References,
+		},
+		"single": {
+			prefixes: []string{"refs/heads/"},
+			want:     []Reference{{ObjectID: "1", Name: "refs/heads/main"}},
+		},
+		"multiple": {
+			prefixes: []string{"HEAD", "refs/tags/"},
+			want: []Reference{
+				{ObjectID: "1", Name: "HEAD"},
+				{ObjectID: "3", Name: "refs/tags/v1"},
+			},
+		},
+		"no match": {
+			prefixes: []string{"refs/notes/"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := lrs.Filter(tc.prefixes)
+			if !reflect.DeepEqual(got.References, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got.References)
+			}
+		})
+	}
+}
+
+func TestListReferencesResponseStats(t *testing.T) {
+	lrs := ListReferencesResponse{References: []Reference{
+		{ObjectID: "0000000000000000000000000000000000000001", Name: "HEAD"},
+		{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+		{ObjectID: "0000000000000000000000000000000000000002", Name: "refs/heads/release/1.0"},
+		{ObjectID: "0000000000000000000000000000000000000003", Name: "refs/tags/v1.0"},
+	}}
+	tests := map[string]struct {
+		prefixes []string
+		want     map[string]int
+	}{
+		"total": {
+			want: map[string]int{"": 4},
+		},
+		"overlapping": {
+			prefixes: []string{"refs/", "refs/heads/", "refs/heads/release/"},
+			want:     map[string]int{"": 4, "refs/": 3, "refs/heads/": 2, "refs/heads/release/": 1},
+		},
+		"no matches": {
+			prefixes: []string{"refs/pull/"},
+			want:     map[string]int{"": 4, "refs/pull/": 0},
+		},
+		"duplicate": {
+			prefixes: []string{"refs/tags/", "refs/tags/"},
+			want:     map[string]int{"": 4, "refs/tags/": 1},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := lrs.Stats(tc.prefixes); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestReferenceValidate(t *testing.T) {
+	tests := map[string]struct {
+		ref     Reference
+		wantErr string
+	}{
+		"valid": {
+			ref: Reference{ObjectID: "1", Name: "refs/heads/main", Attributes: []string{"peeled:2"}},
+		},
+		"newline": {
+			ref:     Reference{ObjectID: "1", Name: "refs/heads/main\n0000"},
+			wantErr: "invalid ref name: \"refs/heads/main\\n0000\"",
+		},
+		"nul": {
+			ref:     Reference{ObjectID: "1", Name: "refs/heads/\x00main"},
+			wantErr: "invalid ref name: \"refs/heads/\\x00main\"",
+		},
+		"attribute": {
+			ref:     Reference{ObjectID: "1", Name: "HEAD", Attributes: []string{"symref-target:refs/heads/main\n"}},
+			wantErr: "invalid ref attribute: \"symref-target:refs/heads/main\\n\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.ref.Validate()
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			// Parse rejects what Validate rejects, so an accepted Reference always round-trips
+			var parsed Reference
+			if err := parsed.Parse(tc.ref.Bytes()[4:]); (err != nil) != (tc.wantErr != "") {
+				t.Fatalf("expected Parse error %t, got %v", tc.wantErr != "", err)
+			}
+		})
+	}
+}
+
+func FuzzReferenceParse(f *testing.F) {
+	f.Add([]byte("0000000000000000000000000000000000000001 HEAD symref-target:refs/heads/main\n"))
+	f.Add([]byte("unborn HEAD\n"))
+	f.Fuzz(func(t *testing.T, line []byte) {
+		var r Reference
+		if err := r.Parse(line); err != nil {
+			return
+		}
+		// Every parsed reference must round-trip through Bytes
+		var parsed Reference
+		if err := parsed.Parse(r.Bytes()[4:]); err != nil {
+			t.Fatalf("failed to parse %q: %v", r.Bytes(), err)
+		}
+		if !reflect.DeepEqual(parsed, r) {
+			t.Fatalf("expected %#v, got %#v", r, parsed)
+		}
+	})
+}
+
+func TestReferenceAttribute(t *testing.T) {
+	ref := Reference{
+		ObjectID: "0000000000000000000000000000000000000001",
+		Name:     "refs/tags/v1",
+		Attributes: []string{
+			"peeled:0000000000000000000000000000000000000002",
+			"object-type:tag",
+			"update-time:1700000000",
+			"object-type:commit",
+			"flag",
+		},
+	}
+	tests := map[string]struct {
+		prefix string
+		want   string
+		wantOK bool
+	}{
+		"peeled": {
+			prefix: "peeled",
+			want:   "0000000000000000000000000000000000000002",
+			wantOK: true,
+		},
+		"first match": {
+			prefix: "object-type",
+			want:   "tag",
+			wantOK: true,
+		},
+		"future attribute": {
+			prefix: "update-time",
+			want:   "1700000000",
+			wantOK: true,
+		},
+		"missing": {
+			prefix: "symref-target",
+		},
+		"without value": {
+			prefix: "flag",
+		},
+		"partial prefix": {
+			prefix: "object",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := ref.Attribute(tc.prefix)
+			if got != tc.want || ok != tc.wantOK {
+				t.Fatalf("expected (%q, %t), got (%q, %t)", tc.want, tc.wantOK, got, ok)
+			}
+		})
+	}
+}
+
+func TestSymrefs(t *testing.T) {
+	tests := map[string]struct {
+		refs []Reference
+		caps Capabilities
+		want map[string]string
+	}{
+		"attribute": {
+			refs: []Reference{
+				{ObjectID: "0000000000000000000000000000000000000001", Name: "HEAD", Attributes: []string{"symref-target:refs/heads/main"}},
+				{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+			},
+			want: map[string]string{"HEAD": "refs/heads/main"},
+		},
+		"capability": {
+			caps: Capabilities{
+				{Key: "multi_ack"},
+				{Key: CapabilitySymref, Value: "HEAD:refs/heads/main"},
+				{Key: CapabilitySymref, Value: "refs/remotes/origin/HEAD:refs/remotes/origin/main"},
+				{Key: CapabilitySymref, Value: "invalid"},
+				{Key: CapabilityAgent, Value: "git/2.39.5"},
+			},
+			want: map[string]string{
+				"HEAD":                     "refs/heads/main",
+				"refs/remotes/origin/HEAD": "refs/remotes/origin/main",
+			},
+		},
+		"both": {
+			refs: []Reference{
+				{ObjectID: "0000000000000000000000000000000000000001", Name: "HEAD", Attributes: []string{"symref-target:refs/heads/next"}},
+			},
+			caps: Capabilities{{Key: CapabilitySymref, Value: "HEAD:refs/heads/main"}},
+			want: map[string]string{"HEAD": "refs/heads/next"},
+		},
+		"none": {
+			refs: []Reference{{ObjectID: "0000000000000000000000000000000000000001", Name: "HEAD"}},
+			want: map[string]string{},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := Symrefs(tc.refs, tc.caps); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestListReferencesResponseInferObjectFormat(t *testing.T) {
+	sha1 := "0000000000000000000000000000000000000001"
+	sha256 := "0000000000000000000000000000000000000000000000000000000000000001"
+	tests := map[string]struct {
+		refs   []Reference
+		want   string
+		wantOK bool
+	}{
+		"sha1": {
+			refs:   []Reference{{ObjectID: sha1, Name: "refs/heads/main"}},
+			want:   "sha1",
+			wantOK: true,
+		},
+		"sha256": {
+			refs:   []Reference{{ObjectID: sha256, Name: "refs/heads/main"}},
+			want:   "sha256",
+			wantOK: true,
+		},
+		"unborn first": {
+			refs: []Reference{
+				{ObjectID: "unborn", Name: "HEAD", Attributes: []string{"symref-target:refs/heads/main"}},
+				{ObjectID: sha256, Name: "refs/heads/other"},
+			},
+			want:   "sha256",
+			wantOK: true,
+		},
+		"all unborn": {
+			refs: []Reference{{ObjectID: "unborn", Name: "HEAD", Attributes: []string{"symref-target:refs/heads/main"}}},
+		},
+		"not hex": {
+			refs: []Reference{{ObjectID: "zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz", Name: "refs/heads/main"}},
+		},
+		"empty": {},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := ListReferencesResponse{References: tc.refs}.InferObjectFormat()
+			if got != tc.want || ok != tc.wantOK {
+				t.Fatalf("expected (%q, %t), got (%q, %t)", tc.want, tc.wantOK, got, ok)
+			}
+		})
+	}
+}
+
+func TestWantsFromReferences(t *testing.T) {
+	refs := []Reference{
+		{ObjectID: "unborn", Name: "HEAD", Attributes: []string{"symref-target:refs/heads/main"}},
+		{ObjectID: "1", Name: "refs/heads/feature"},
+		{ObjectID: "2", Name: "refs/heads/other"},
+		{ObjectID: "1", Name: "refs/tags/v1"},
+	}
+	if got, want := WantsFromReferences(refs), []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if got := WantsFromReferences(nil); got != nil {
+		t.Fatalf("expected nil, got %v", got)
+	}
+}
+
+func TestListReferencesResponseIncludedTags(t *testing.T) {
+	lrs := ListReferencesResponse{References: []Reference{
+		{ObjectID: "1", Name: "refs/heads/main"},
+		{ObjectID: "t1", Name: "refs/tags/v1", Attributes: []string{"peeled:1"}},
+		{ObjectID: "t2", Name: "refs/tags/v2", Attributes: []string{"peeled:2"}},
+		{ObjectID: "1", Name: "refs/tags/lightweight"},
+		{ObjectID: "t3", Name: "refs/notes/annotated", Attributes: []string{"peeled:3"}},
+	}}
+	if got, want := lrs.PeeledTags(), []Reference{lrs.References[1], lrs.References[2]}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	tests := map[string]struct {
+		fetched []string
+		want    []string
+	}{
+		"none": {
+			fetched: []string{"1"},
+		},
+		"one": {
+			fetched: []string{"1", "t1"},
+			want:    []string{"refs/tags/v1"},
+		},
+		"all": {
+			fetched: []string{"t2", "t1", "t3"},
+			want:    []string{"refs/tags/v1", "refs/tags/v2"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var names []string
+			for _, ref := range lrs.IncludedTags(func(objID string) bool {
+				return slices.Contains(tc.fetched, objID)
+			}) {
+				names = append(names, ref.Name)
+			}
+			if !reflect.DeepEqual(names, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, names)
+			}
+		})
+	}
+}
+
+func TestListReferencesResponseFixtures(t *testing.T) {
+	tests := map[string]struct {
+		objectIDLength int
+	}{
+		"git-2.39-sha1.ls-refs": {
+			objectIDLength: 40,
+		},
+		"git-2.39-sha256.ls-refs": {
+			objectIDLength: 64,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			payload, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var lrs ListReferencesResponse
+			if err := lrs.Parse(pktline.NewScanner(bytes.NewReader(payload))); err != nil {
+				t.Fatal(err)
+			}
+			if len(lrs.References) != 3 {
+				t.Fatalf("expected 3 references, got %d", len(lrs.References))
+			}
+			for _, ref := range lrs.References {
+				if len(ref.ObjectID) != tc.objectIDLength {
+					t.Fatalf("expected %d character object ID, got %q", tc.objectIDLength, ref.ObjectID)
+				}
+			}
+			if target, ok := lrs.References[0].SymrefTarget(); !ok || target != "refs/heads/main" {
+				t.Fatalf("expected HEAD to point to refs/heads/main, got %q", target)
+			}
+			if peeled, ok := lrs.References[2].Peeled(); !ok || peeled != lrs.References[1].ObjectID {
+				t.Fatalf("expected tag to peel to %q, got %q", lrs.References[1].ObjectID, peeled)
+			}
+			if !bytes.Equal(lrs.Bytes(), payload) {
+				t.Fatalf("expected %q, got %q", string(payload), string(lrs.Bytes()))
+			}
+		})
+	}
+}
+
+func TestForEachReference(t *testing.T) {
+	payload := ListReferencesResponse{References: []Reference{
+		{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+		{ObjectID: "0000000000000000000000000000000000000002", Name: "refs/heads/next"},
+	}}.Bytes()
+	var names []string
+	if err := ForEachReference(pktline.NewScanner(bytes.NewReader(payload)), func(ref Reference) error {
+		names = append(names, ref.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"refs/heads/main", "refs/heads/next"}) {
+		t.Fatalf("unexpected references: %v", names)
+	}
+
+	stop := errors.New("stop")
+	names = nil
+	if err := ForEachReference(pktline.NewScanner(bytes.NewReader(payload)), func(ref Reference) error {
+		names = append(names, ref.Name)
+		return stop
+	}); !errors.Is(err, stop) {
+		t.Fatalf("expected stop, got %v", err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("expected parsing to stop after the first reference, got %v", names)
+	}
+
+	names = nil
+	if err := ForEachReference(pktline.NewScanner(bytes.NewReader(payload)), func(ref Reference) error {
+		names = append(names, ref.Name)
+		return ErrStopIteration
+	}); err != nil {
+		t.Fatalf("expected nil for ErrStopIteration, got %v", err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("expected parsing to stop after the first reference, got %v", names)
+	}
+}
+
+func TestListReferencesResponseParseInvalid(t *testing.T) {
+	tests := map[string]struct {
+		payload string
+		wantErr string
+	}{
+		"truncated length header": {
+			payload: "00",
+			wantErr: "truncated during ls-refs section: unexpected EOF",
+		},
+		"truncated length header after ref": {
+			payload: "003d0000000000000000000000000000000000000001 refs/heads/main\n00",
+			wantErr: "truncated during ls-refs section: unexpected EOF",
+		},
+		"invalid length header": {
+			payload: "zz00",
+			wantErr: `invalid pkt-line length header during ls-refs section: invalid length prefix: "zz00"`,
+		},
+		"reserved length header": {
+			payload: "0003",
+			wantErr: `invalid pkt-line length header during ls-refs section: invalid length prefix: "0003"`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var lrs ListReferencesResponse
+			err := lrs.Parse(pktline.NewScanner(bytes.NewReader([]byte(tc.payload))))
+			if err == nil {
+				t.Fatalf("expected error, got nil")
+			} else if err.Error() != tc.wantErr {
+				t.Fatalf("expected error %q, got %q", tc.wantErr, err.Error())
+			}
+		})
+	}
+	var lrs ListReferencesResponse
+	if err := lrs.Parse(pktline.NewScanner(bytes.NewReader([]byte("zz00")))); !errors.As(err, new(pktline.ErrInvalidLen)) {
+		t.Fatalf("expected pktline.ErrInvalidLen, got %v", err)
+	}
+}
+
+func TestListReferencesResponseParseLimit(t *testing.T) {
+	payload := ListReferencesResponse{References: []Reference{
+		{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+		{ObjectID: "0000000000000000000000000000000000000002", Name: "refs/heads/next"},
+	}}.Bytes()
+	tests := map[string]struct {
+		maxReferences int
+		want          int
+		wantErr       string
+	}{
+		"unlimited": {
+			want: 2,
+		},
+		"at limit": {
+			maxReferences: 2,
+			want:          2,
+		},
+		"exceeded": {
+			maxReferences: 1,
+			want:          1,
+			wantErr:       "too many references: more than 1",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var lrs ListReferencesResponse
+			err := lrs.ParseLimit(pktline.NewScanner(bytes.NewReader(payload)), tc.maxReferences)
+			if tc.wantErr != "" {
+				if !errors.Is(err, ErrTooManyReferences) {
+					t.Fatalf("expected ErrTooManyReferences, got %v", err)
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if len(lrs.References) != tc.want {
+				t.Fatalf("expected %d references, got %d", tc.want, len(lrs.References))
+			}
+		})
+	}
+}
+
+func TestReferenceText(t *testing.T) {
+	tests := map[string]struct {
+		text    string
+		want    Reference
+		wantErr string
+	}{
+		"plain": {
+			text: "0000000000000000000000000000000000000001 refs/heads/main",
+			want: Reference{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+		},
+		"attributes": {
+			text: "0000000000000000000000000000000000000001 HEAD symref-target:refs/heads/main peeled:0000000000000000000000000000000000000002",
+			want: Reference{
+				ObjectID:   "0000000000000000000000000000000000000001",
+				Name:       "HEAD",
+				Attributes: []string{"symref-target:refs/heads/main", "peeled:0000000000000000000000000000000000000002"},
+			},
+		},
+		"missing name": {
+			text:    "0000000000000000000000000000000000000001",
+			wantErr: "invalid ref: \"0000000000000000000000000000000000000001\\n\"",
+		},
+		"embedded LF": {
+			text:    "0000000000000000000000000000000000000001 refs/heads/main\nrefs/heads/evil",
+			wantErr: "invalid ref name: \"refs/heads/main\\nrefs/heads/evil\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var ref Reference
+			err := ref.UnmarshalText([]byte(tc.text))
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ref, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, ref)
+			}
+			text, err := ref.MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(text) != tc.text {
+				t.Fatalf("expected %q, got %q", tc.text, string(text))
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package protocolv2
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+// LsRemoteOptions configure the behavior of Client.LsRemote, mirroring the git ls-remote flags
+type LsRemoteOptions struct {
+	// Heads limits the output to refs/heads/ (--heads)
+	Heads bool
+	// Tags limits the output to refs/tags/ (--tags)
+	Tags bool
+	// Symref includes a "ref: <target>\t<name>" line before each symbolic ref (--symref)
+	Symref bool
+	// Patterns (if any) limit the output to refs matching any pattern, a pattern matches if it
+	// matches the end of the ref name following a "/" (ex: "main" matches "refs/heads/main")
+	Patterns []string
+}
+
+// LsRemote returns the references of the remote formatted like the output of git ls-remote
+// (without the trailing LF), including the "<oid>\t<tag>^{}" lines of peeled tags
+func (c *Client) LsRemote(ctx context.Context, opts LsRemoteOptions) ([]string, error) {
+	ca, err := c.Capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []string
+	if opts.Tags {
+		prefixes = append(prefixes, "refs/tags/")
+	}
+	if opts.Heads {
+		prefixes = append(prefixes, "refs/heads/")
+	}
+	patterns := make([]*regexp.Regexp, 0, len(opts.Patterns))
+	for _, pattern := range opts.Patterns {
+		patterns = append(patterns, compileTailPattern(pattern))
+	}
+	req, err := BuildLsRefsRequest(LsRefsOptions{
+		Advertisement:   ca,
+		DropUnsupported: true,
+		Symrefs:         true,
+		Peel:            true,
+		Unborn:          true,
+		Prefixes:        prefixes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	if err := c.LsRefsStream(ctx, req, func(ref Reference) error {
+		// Servers may ignore ref-prefix, and unborn refs have no object ID to show
+		if !ref.MatchesPrefixes(prefixes) || ref.ObjectID == "unborn" {
+			return nil
+		}
+		names := []string{ref.Name}
+		peeled, isPeeled := ref.Peeled()
+		if isPeeled {
+			names = append(names, ref.Name+"^{}")
+		}
+		for idx, name := range names {
+			if !matchesAnyTailPattern(patterns, name) {
+				continue
+			}
+			if idx == 1 {
+				lines = append(lines, peeled+"\t"+name)
+				continue
+			}
+			if target, ok := ref.SymrefTarget(); ok && opts.Symref {
+				lines = append(lines, "ref: "+target+"\t"+name)
+			}
+			lines = append(lines, ref.ObjectID+"\t"+name)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// matchesAnyTailPattern returns true if there are no patterns or any pattern matches the name
+func matchesAnyTailPattern(patterns []*regexp.Regexp, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileTailPattern compiles a git ls-remote pattern, which is a wildmatch of "*/<pattern>"
+// against "/<refname>" where "*" and "?" also match "/" (ex: "v*" matches "refs/tags/v1^{}")
+// The leading "/" means the pattern may also match the entire ref name (ex: "HEAD")
+func compileTailPattern(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^(?:.*/)?")
+	for idx := 0; idx < len(pattern); idx++ {
+		switch ch := pattern[idx]; ch {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '\\':
+			if idx+1 < len(pattern) {
+				idx++
+			}
+			sb.WriteString(regexp.QuoteMeta(pattern[idx : idx+1]))
+		case '[':
+			end := strings.IndexByte(pattern[idx+1:], ']')
+			if end <= 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := pattern[idx+1 : idx+1+end]
+			sb.WriteByte('[')
+			if class[0] == '!' || class[0] == '^' {
+				sb.WriteByte('^')
+				class = class[1:]
+			}
+			sb.WriteString(strings.ReplaceAll(class, `\`, `\\`))
+			sb.WriteByte(']')
+			idx += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(pattern[idx : idx+1]))
+		}
+	}
+	sb.WriteByte('$')
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		// An invalid character class can only match literally
+		return regexp.MustCompile("^.*/" + regexp.QuoteMeta(pattern) + "$")
+	}
+	return re
+}
@@ -0,0 +1,110 @@
+package protocolv2
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestClientLsRemote(t *testing.T) {
+	payload, err := os.ReadFile(filepath.Join("testdata", "git-2.39-sha1.ls-refs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, Capabilities{{Key: CapabilityListReferences, Value: "unborn"}}, func(req *CommandRequest, w io.Writer) {
+		w.Write(payload)
+	})
+	// The expected output was recorded from git ls-remote against the same repository
+	tests := map[string]struct {
+		opts LsRemoteOptions
+		want []string
+	}{
+		"default": {
+			want: []string{
+				"ec0fe20996b4c463845498b315d14055fd5d1c99\tHEAD",
+				"ec0fe20996b4c463845498b315d14055fd5d1c99\trefs/heads/main",
+				"78a56c529fcb31c926030826a610d430a1995fba\trefs/tags/v1",
+				"ec0fe20996b4c463845498b315d14055fd5d1c99\trefs/tags/v1^{}",
+			},
+		},
+		"symref": {
+			opts: LsRemoteOptions{Symref: true},
+			want: []string{
+				"ref: refs/heads/main\tHEAD",
+				"ec0fe20996b4c463845498b315d14055fd5d1c99\tHEAD",
+				"ec0fe20996b4c463845498b315d14055fd5d1c99\trefs/heads/main",
+				"78a56c529fcb31c926030826a610d430a1995fba\trefs/tags/v1",
+				"ec0fe20996b4c463845498b315d14055fd5d1c99\trefs/tags/v1^{}",
+			},
+		},
+		"heads": {
+			opts: LsRemoteOptions{Heads: true, Symref: true},
+			want: []string{
+				"ec0fe20996b4c463845498b315d14055fd5d1c99\trefs/heads/main",
+			},
+		},
+		"tags": {
+			opts: LsRemoteOptions{Tags: true},
+			want: []string{
+				"78a56c529fcb31c926030826a610d430a1995fba\trefs/tags/v1",
+				"ec0fe20996b4c463845498b315d14055fd5d1c99\trefs/tags/v1^{}",
+			},
+		},
+		"pattern": {
+			opts: LsRemoteOptions{Patterns: []string{"v*"}},
+			want: []string{
+				"78a56c529fcb31c926030826a610d430a1995fba\trefs/tags/v1",
+				"ec0fe20996b4c463845498b315d14055fd5d1c99\trefs/tags/v1^{}",
+			},
+		},
+		"no match": {
+			opts: LsRemoteOptions{Patterns: []string{"next"}},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := Client{URL: srv.URL}
+			got, err := client.LsRemote(context.Background(), tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCompileTailPattern(t *testing.T) {
+	tests := map[string]struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		"exact tail":          {pattern: "main", name: "refs/heads/main", want: true},
+		"partial component":   {pattern: "ain", name: "refs/heads/main", want: false},
+		"multiple components": {pattern: "heads/main", name: "refs/heads/main", want: true},
+		"star crosses slash":  {pattern: "heads*", name: "refs/heads/main", want: true},
+		"peeled":              {pattern: "v1", name: "refs/tags/v1^{}", want: false},
+		"peeled star":         {pattern: "v*", name: "refs/tags/v1^{}", want: true},
+		"question mark":       {pattern: "v?", name: "refs/tags/v1", want: true},
+		"class":               {pattern: "v[0-9]", name: "refs/tags/v1", want: true},
+		"negated class":       {pattern: "v[!0-9]", name: "refs/tags/v1", want: false},
+		"literal dot":         {pattern: "v1.0", name: "refs/tags/v100", want: false},
+		"escaped star":        {pattern: `v\*`, name: "refs/tags/v*", want: true},
+		"unterminated class":  {pattern: "v[1", name: "refs/tags/v[1", want: true},
+		"HEAD":                {pattern: "HEAD", name: "HEAD", want: true},
+		"full ref name":       {pattern: "refs/heads/main", name: "refs/heads/main", want: true},
+		"partial ref name":    {pattern: "efs/heads/main", name: "refs/heads/main", want: false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := compileTailPattern(tc.pattern).MatchString(tc.name); got != tc.want {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package protocolv2
+
+import (
+	"context"
+	"slices"
+)
+
+// The default number of haves sent in each round of negotiation
+const DefaultHaveBatchSize = 32
+
+// Indicates the server sends the packfile immediately after "ready" without waiting for the
+// client to send "done". This is a protocol v0/v1 capability which has no effect on protocol-v2,
+// where the packfile always follows "ready" in the same response.
+const CapabilityNoDone = "no-done"
+
+// FetchFunc performs a single fetch command-request round-trip (ex: Client.Fetch)
+type FetchFunc func(ctx context.Context, req *CommandRequest) (*FetchResponse, error)
+
+// BatchHaves splits the tips into batches of (at most) batchSize haves
+func BatchHaves(tips []string, batchSize int) [][]string {
+	if len(tips) == 0 {
+		return nil
+	}
+	if batchSize <= 0 {
+		return [][]string{tips}
+	}
+	batches := make([][]string, 0, (len(tips)+batchSize-1)/batchSize)
+	for len(tips) > batchSize {
+		batches = append(batches, tips[:batchSize:batchSize])
+		tips = tips[batchSize:]
+	}
+	return append(batches, tips)
+}
+
+// NegotiationDecision is the next step of a negotiation given the acknowledgments of a response
+type NegotiationDecision int
+
+const (
+	// NegotiationProceed means the packfile follows (the server sent "ready", or the acknowledgments
+	// section was omitted as the request contained "done"), no further haves are needed
+	NegotiationProceed NegotiationDecision = iota
+	// NegotiationContinue means the server acknowledged common objects (ACKs) but is not ready yet,
+	// so the next batch of haves should be sent (re-sending the acknowledged ones)
+	NegotiationContinue
+	// NegotiationDone means the server found nothing in common (NAK), the next batch of haves should
+	// be sent if any remain, otherwise "done" ends the negotiation. With wait-for-done the server
+	// never sends "ready", so the negotiation always ends this way (or with NegotiationContinue).
+	NegotiationDone
+)
+
+// Decision maps the acknowledgments to the next step of the negotiation:
+//   - ready (with or without ACKs): NegotiationProceed
+//   - no acknowledgments section: NegotiationProceed
+//   - ACKs without ready: NegotiationContinue
+//   - NAK: NegotiationDone
+func (a Acknowledgements) Decision() NegotiationDecision {
+	switch {
+	case a.Ready || a.IsZero():
+		return NegotiationProceed
+	case len(a.ACKs) > 0:
+		return NegotiationContinue
+	default:
+		return NegotiationDone
+	}
+}
+
+// NeedsMoreNegotiation returns true if the response contained an acknowledgments section without
+// "ready" and no packfile followed, so another round of haves (or "done") must be sent. This is the
+// predicate which drives a negotiation loop, see Acknowledgements.Decision for the next step.
+// With wait-for-done the server never sends "ready", so it is true for every round until the
+// client sends "done" (after which the acknowledgments section is omitted and the packfile follows).
+func (fr FetchResponse) NeedsMoreNegotiation() bool {
+	return !fr.Acknowledgements.IsZero() && !fr.Acknowledgements.Ready && fr.PackSize == 0
+}
+
+// NegotiationState is the progress of a negotiation which can be persisted (ex: as JSON) so that
+// an interrupted fetch can resume without restarting negotiation. It does not resume the packfile
+// transfer itself, which is always sent in full once negotiation completes.
+type NegotiationState struct {
+	// Common are the object IDs the server acknowledged as common
+	Common []string `json:"common,omitempty"`
+	// Shallow are the commits at the current shallow boundary
+	Shallow []string `json:"shallow,omitempty"`
+}
+
+// addCommon records the object IDs as common (if not already)
+func (ns *NegotiationState) addCommon(objIDs ...string) {
+	for _, objID := range objIDs {
+		if !slices.Contains(ns.Common, objID) {
+			ns.Common = append(ns.Common, objID)
+		}
+	}
+}
+
+// applyShallowInfo updates the shallow boundary from the shallow-info section
+func (ns *NegotiationState) applyShallowInfo(si ShallowInfo, relative bool) error {
+	boundary, err := si.Apply(ns.Shallow, relative)
+	if err != nil {
+		return err
+	}
+	ns.Shallow = boundary
+	return nil
+}
+
+// NegotiateOptions configure the behavior of Negotiate
+type NegotiateOptions struct {
+	// BatchSize is the number of haves sent per round, defaults to DefaultHaveBatchSize
+	BatchSize int
+	// State (if non-nil) is resumed from and updated as negotiation progresses
+	State *NegotiationState
+}
+
+// Negotiate performs the fetch negotiation, sending the haves in batches until the server
+// indicates it is "ready" or the haves are exhausted, at which point "done" is sent.
+// The request must contain the wants (and any other arguments) but no haves or "done".
+// Since each round is stateless, the haves the server acknowledged as common are re-sent.
+func Negotiate(ctx context.Context, fetch FetchFunc, req *CommandRequest, haves []string, opts NegotiateOptions) (*FetchResponse, error) {
+	batchSize := opts.BatchSize
+	if batchSize == 0 {
+		batchSize = DefaultHaveBatchSize
+	}
+	state := opts.State
+	if state == nil {
+		state = &NegotiationState{}
+	}
+	relative := req.Arguments.Has(ArgumentDeepenRelative)
+	// The shallow boundary includes the shallow commits the caller sent in the request, otherwise
+	// a deepen-relative response unshallowing one of them would be rejected as unknown
+	for _, objID := range req.Arguments.GetAll(ArgumentShallow) {
+		if !slices.Contains(state.Shallow, objID) {
+			state.Shallow = append(state.Shallow, objID)
+		}
+	}
+	// Haves already known to be common are sent in every round, there is no need to batch them
+	haves = slices.DeleteFunc(slices.Clone(haves), func(objID string) bool {
+		return slices.Contains(state.Common, objID)
+	})
+	for _, batch := range BatchHaves(haves, batchSize) {
+		resp, err := fetch(ctx, negotiationRound(req, state, batch, false))
+		if err != nil {
+			return nil, err
+		}
+		state.addCommon(resp.Acknowledgements.ACKs...)
+		// The server had enough to build the packfile which followed the acknowledgments, otherwise
+		// the next batch is sent (and "done" once the haves are exhausted)
+		if resp.Acknowledgements.Decision() == NegotiationProceed {
+			if err := state.applyShallowInfo(resp.ShallowInfo, relative); err != nil {
+				return nil, err
+			}
+			return resp, nil
+		}
+	}
+	resp, err := fetch(ctx, negotiationRound(req, state, nil, true))
+	if err != nil {
+		return nil, err
+	}
+	if err := state.applyShallowInfo(resp.ShallowInfo, relative); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// negotiationRound builds the command-request for a single round of negotiation
+func negotiationRound(req *CommandRequest, state *NegotiationState, batch []string, done bool) *CommandRequest {
+	round := req.Clone()
+	for _, objID := range state.Shallow {
+		if !slices.Contains(req.Arguments, CommandArgument{Key: ArgumentShallow, Value: objID}) {
+			round.Arguments = append(round.Arguments, CommandArgument{Key: ArgumentShallow, Value: objID})
+		}
+	}
+	for _, objID := range state.Common {
+		round.Arguments = append(round.Arguments, CommandArgument{Key: ArgumentHave, Value: objID})
+	}
+	for _, objID := range batch {
+		round.Arguments = append(round.Arguments, CommandArgument{Key: ArgumentHave, Value: objID})
+	}
+	if done {
+		round.Arguments = append(round.Arguments, CommandArgument{Key: ArgumentDone})
+	}
+	return round
+}
+
+// HaveWalker is the caller's walk of the local commit-graph (ex: in commit-date order from the
+// local refs) which supplies the haves for a Negotiator
+type HaveWalker interface {
+	// NextHaves returns (up to) the next n object IDs of the walk, or none once it is exhausted
+	NextHaves(n int) []string
+	// MarkCommon is called once for each object the server acknowledged as common, the walk should
+	// skip its ancestors as the server is then known to have them too
+	MarkCommon(objID string)
+}
+
+// Negotiator tracks the haves sent and acknowledged during a negotiation, for callers which drive
+// the rounds themselves (see Negotiate for a complete loop over a fixed list of haves). Each round
+// is built by NextRound and its response passed to Observe, until NextRound returns done. The
+// packfile follows the response to the "done" round, or the response containing "ready".
+type Negotiator struct {
+	walker    HaveWalker
+	batchSize int
+	state     NegotiationState
+	sent      map[string]struct{}
+	ready     bool
+}
+
+// NewNegotiator creates a Negotiator sending batchSize (or DefaultHaveBatchSize if zero) haves from
+// the walker in each round
+func NewNegotiator(walker HaveWalker, batchSize int) *Negotiator {
+	if batchSize == 0 {
+		batchSize = DefaultHaveBatchSize
+	}
+	return &Negotiator{
+		walker:    walker,
+		batchSize: batchSize,
+		sent:      make(map[string]struct{}),
+	}
+}
+
+// NextRound builds the command-request for the next round from req (which must contain the wants
+// but no haves or "done"). Since each round is stateless, the haves acknowledged as common are
+// re-sent along with the next batch from the walker, excluding any already sent. Once the walk is
+// exhausted the round contains "done" (with only the common haves) and done is true, the response
+// to that round contains the packfile. Once the server is "ready" the packfile has already been
+// sent (in the same response) so a nil round is returned with done true, nothing is left to send.
+func (ng *Negotiator) NextRound(req *CommandRequest) (round *CommandRequest, done bool) {
+	if ng.ready {
+		return nil, true
+	}
+	var batch []string
+	for len(batch) < ng.batchSize {
+		haves := ng.walker.NextHaves(ng.batchSize - len(batch))
+		if len(haves) == 0 {
+			break
+		}
+		for _, objID := range haves {
+			if _, ok := ng.sent[objID]; ok {
+				continue
+			}
+			ng.sent[objID] = struct{}{}
+			batch = append(batch, objID)
+		}
+	}
+	done = len(batch) == 0
+	return negotiationRound(req, &ng.state, batch, done), done
+}
+
+// Observe records the acknowledgments of the response to the last round, marking each newly
+// acknowledged object as common in the walker
+func (ng *Negotiator) Observe(resp *FetchResponse) {
+	for _, objID := range resp.Acknowledgements.ACKs {
+		if !slices.Contains(ng.state.Common, objID) {
+			ng.state.addCommon(objID)
+			ng.walker.MarkCommon(objID)
+		}
+	}
+	if resp.Acknowledgements.Ready {
+		ng.ready = true
+	}
+}
+
+// Ready returns true if the server indicated it is "ready" to send the packfile
+// With protocol-v2 the packfile follows the "ready" in the same response, so no further round is
+// needed (NextRound returns a nil round).
+func (ng *Negotiator) Ready() bool {
+	return ng.ready
+}
+
+// Common returns the object IDs the server acknowledged as common so far
+func (ng *Negotiator) Common() []string {
+	return ng.state.Common
+}
@@ -0,0 +1,423 @@
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func TestBatchHaves(t *testing.T) {
+	tests := map[string]struct {
+		tips      []string
+		batchSize int
+		want      [][]string
+	}{
+		"empty": {
+			batchSize: 2,
+		},
+		"unbatched": {
+			tips: []string{"a", "b", "c"},
+			want: [][]string{{"a", "b", "c"}},
+		},
+		"exact": {
+			tips:      []string{"a", "b", "c", "d"},
+			batchSize: 2,
+			want:      [][]string{{"a", "b"}, {"c", "d"}},
+		},
+		"remainder": {
+			tips:      []string{"a", "b", "c"},
+			batchSize: 2,
+			want:      [][]string{{"a", "b"}, {"c"}},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := BatchHaves(tc.tips, tc.batchSize)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// fakeFetch returns a FetchFunc which records each request and replies with the given responses
+func fakeFetch(reqs *[]*CommandRequest, resps ...*FetchResponse) FetchFunc {
+	return func(ctx context.Context, req *CommandRequest) (*FetchResponse, error) {
+		resp := resps[len(*reqs)]
+		*reqs = append(*reqs, req)
+		return resp, nil
+	}
+}
+
+func TestAcknowledgementsDecision(t *testing.T) {
+	tests := map[string]struct {
+		acks Acknowledgements
+		want NegotiationDecision
+	}{
+		"ready": {
+			acks: Acknowledgements{ACKs: []string{"a"}, Ready: true},
+			want: NegotiationProceed,
+		},
+		"omitted": {
+			want: NegotiationProceed,
+		},
+		"acks": {
+			acks: Acknowledgements{ACKs: []string{"a", "b"}},
+			want: NegotiationContinue,
+		},
+		"nak": {
+			acks: Acknowledgements{NAK: true},
+			want: NegotiationDone,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.acks.Decision(); got != tc.want {
+				t.Fatalf("expected %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFetchResponseNeedsMoreNegotiation(t *testing.T) {
+	tests := map[string]struct {
+		resp FetchResponse
+		want bool
+	}{
+		"acks": {
+			resp: FetchResponse{Acknowledgements: Acknowledgements{ACKs: []string{"a"}}},
+			want: true,
+		},
+		"nak": {
+			resp: FetchResponse{Acknowledgements: Acknowledgements{NAK: true}},
+			want: true,
+		},
+		"ready": {
+			resp: FetchResponse{Acknowledgements: Acknowledgements{ACKs: []string{"a"}, Ready: true}, PackSize: 32},
+			want: false,
+		},
+		"done": {
+			resp: FetchResponse{PackSize: 32},
+			want: false,
+		},
+		"packfile without ready": {
+			resp: FetchResponse{Acknowledgements: Acknowledgements{ACKs: []string{"a"}}, PackSize: 32},
+			want: false,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.resp.NeedsMoreNegotiation(); got != tc.want {
+				t.Fatalf("expected %t, got %t", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	req := &CommandRequest{
+		Command: CapabilityFetch,
+		Arguments: CommandArguments{
+			{Key: ArgumentWant, Value: "w"},
+		},
+	}
+	tests := map[string]struct {
+		haves []string
+		resps []*FetchResponse
+		want  []CommandArguments
+	}{
+		"clone": {
+			resps: []*FetchResponse{{}},
+			want: []CommandArguments{
+				{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentDone}},
+			},
+		},
+		"ready": {
+			haves: []string{"a", "b", "c"},
+			resps: []*FetchResponse{
+				{Acknowledgements: Acknowledgements{ACKs: []string{"a"}}},
+				{Acknowledgements: Acknowledgements{ACKs: []string{"c"}, Ready: true}},
+			},
+			want: []CommandArguments{
+				{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "a"}, {Key: ArgumentHave, Value: "b"}},
+				{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "a"}, {Key: ArgumentHave, Value: "c"}},
+			},
+		},
+		"exhausted": {
+			haves: []string{"a", "b", "c"},
+			resps: []*FetchResponse{
+				{Acknowledgements: Acknowledgements{NAK: true}},
+				{Acknowledgements: Acknowledgements{ACKs: []string{"c"}}},
+				{},
+			},
+			want: []CommandArguments{
+				{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "a"}, {Key: ArgumentHave, Value: "b"}},
+				{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "c"}},
+				{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "c"}, {Key: ArgumentDone}},
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var reqs []*CommandRequest
+			if _, err := Negotiate(context.Background(), fakeFetch(&reqs, tc.resps...), req, tc.haves, NegotiateOptions{BatchSize: 2}); err != nil {
+				t.Fatal(err)
+			}
+			if len(reqs) != len(tc.want) {
+				t.Fatalf("expected %d rounds, got %d", len(tc.want), len(reqs))
+			}
+			for idx, round := range reqs {
+				if !reflect.DeepEqual(round.Arguments, tc.want[idx]) {
+					t.Fatalf("round %d: expected %v, got %v", idx, tc.want[idx], round.Arguments)
+				}
+			}
+		})
+	}
+}
+
+func TestNegotiateReadyPackfile(t *testing.T) {
+	req := &CommandRequest{
+		Command:   CapabilityFetch,
+		Arguments: CommandArguments{{Key: ArgumentWant, Value: "w"}},
+	}
+	// The packfile follows "ready" in the same response, so it must be written exactly once
+	var packfile bytes.Buffer
+	var rounds int
+	fetch := func(ctx context.Context, round *CommandRequest) (*FetchResponse, error) {
+		rounds++
+		if rounds == 1 {
+			return &FetchResponse{Acknowledgements: Acknowledgements{NAK: true}}, nil
+		}
+		packfile.WriteString("PACK")
+		return &FetchResponse{Acknowledgements: Acknowledgements{ACKs: []string{"c"}, Ready: true}, PackSize: 4}, nil
+	}
+	resp, err := Negotiate(context.Background(), fetch, req, []string{"a", "b", "c", "d", "e"}, NegotiateOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rounds != 2 {
+		t.Fatalf("expected 2 rounds, got %d", rounds)
+	}
+	if resp.PackSize != 4 || packfile.String() != "PACK" {
+		t.Fatalf("expected a single packfile, got %q", packfile.String())
+	}
+}
+
+func TestNegotiateShallowFromRequest(t *testing.T) {
+	req := &CommandRequest{
+		Command: CapabilityFetch,
+		Arguments: CommandArguments{
+			{Key: ArgumentWant, Value: "w"},
+			{Key: ArgumentShallow, Value: "s1"},
+			{Key: ArgumentShallow, Value: "s2"},
+			{Key: ArgumentDeepen, Value: "1"},
+			{Key: ArgumentDeepenRelative},
+		},
+	}
+	state := &NegotiationState{}
+	var reqs []*CommandRequest
+	resps := []*FetchResponse{
+		{ShallowInfo: ShallowInfo{Shallow: []Shallow{{ObjectID: "s0"}}, Unshallow: []Unshallow{{ObjectID: "s1"}}}},
+	}
+	if _, err := Negotiate(context.Background(), fakeFetch(&reqs, resps...), req, nil, NegotiateOptions{State: state}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state.Shallow, []string{"s2", "s0"}) {
+		t.Fatalf("unexpected shallow boundary: %v", state.Shallow)
+	}
+	// The shallow commits of the request are not duplicated in the round
+	if got := reqs[0].Arguments.GetAll(ArgumentShallow); !reflect.DeepEqual(got, []string{"s1", "s2"}) {
+		t.Fatalf("unexpected shallow arguments: %v", got)
+	}
+}
+
+func TestNegotiateClient(t *testing.T) {
+	var rounds []CommandArguments
+	srv := newTestServer(t, Capabilities{{Key: CapabilityFetch}}, func(req *CommandRequest, w io.Writer) {
+		rounds = append(rounds, req.Arguments)
+		if !req.Arguments.Has(ArgumentDone) {
+			// Acknowledge the last have without "ready", so the client must continue
+			haves := req.Arguments.GetAll(ArgumentHave)
+			w.Write(pktline.AppendFlushPkt(Acknowledgements{ACKs: haves[len(haves)-1:]}.Append(nil)))
+			return
+		}
+		io.WriteString(w, "000dpackfile\n0009\x01PACK0000")
+	})
+	client := Client{URL: srv.URL}
+	req := &CommandRequest{
+		Command: CapabilityFetch,
+		Arguments: CommandArguments{
+			{Key: ArgumentWant, Value: "w"},
+		},
+	}
+	var packfile bytes.Buffer
+	resp, err := Negotiate(context.Background(), func(ctx context.Context, req *CommandRequest) (*FetchResponse, error) {
+		return client.Fetch(ctx, req, &packfile)
+	}, req, []string{"a", "b", "c"}, NegotiateOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each stateless round re-sends the wants and the haves acknowledged as common
+	want := []CommandArguments{
+		{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "a"}, {Key: ArgumentHave, Value: "b"}},
+		{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "b"}, {Key: ArgumentHave, Value: "c"}},
+		{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "b"}, {Key: ArgumentHave, Value: "c"}, {Key: ArgumentDone}},
+	}
+	if !reflect.DeepEqual(rounds, want) {
+		t.Fatalf("expected rounds %v, got %v", want, rounds)
+	}
+	if packfile.String() != "PACK" || resp.PackSize != 4 {
+		t.Fatalf("unexpected packfile: %q", packfile.String())
+	}
+}
+
+func TestNegotiateState(t *testing.T) {
+	req := &CommandRequest{
+		Command: CapabilityFetch,
+		Arguments: CommandArguments{
+			{Key: ArgumentWant, Value: "w"},
+		},
+	}
+	state := &NegotiationState{}
+	var reqs []*CommandRequest
+	interrupted := func(ctx context.Context, req *CommandRequest) (*FetchResponse, error) {
+		if len(reqs) == 1 {
+			return nil, errors.New("connection reset")
+		}
+		reqs = append(reqs, req)
+		return &FetchResponse{Acknowledgements: Acknowledgements{ACKs: []string{"a"}}}, nil
+	}
+	if _, err := Negotiate(context.Background(), interrupted, req, []string{"a", "b", "c", "d"}, NegotiateOptions{BatchSize: 2, State: state}); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+
+	// Round-trip the state as it would be persisted between attempts
+	b, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"common":["a"]}` {
+		t.Fatalf("unexpected state: %s", string(b))
+	}
+	var resumed NegotiationState
+	if err := json.Unmarshal(b, &resumed); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs = nil
+	resps := []*FetchResponse{
+		{Acknowledgements: Acknowledgements{NAK: true}},
+		{Acknowledgements: Acknowledgements{ACKs: []string{"d"}}},
+		{ShallowInfo: ShallowInfo{Shallow: []Shallow{{ObjectID: "s"}}}},
+	}
+	if _, err := Negotiate(context.Background(), fakeFetch(&reqs, resps...), req, []string{"a", "b", "c", "d"}, NegotiateOptions{BatchSize: 2, State: &resumed}); err != nil {
+		t.Fatal(err)
+	}
+	want := []CommandArguments{
+		{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "a"}, {Key: ArgumentHave, Value: "b"}, {Key: ArgumentHave, Value: "c"}},
+		{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "a"}, {Key: ArgumentHave, Value: "d"}},
+		{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "a"}, {Key: ArgumentHave, Value: "d"}, {Key: ArgumentDone}},
+	}
+	for idx, round := range reqs {
+		if !reflect.DeepEqual(round.Arguments, want[idx]) {
+			t.Fatalf("round %d: expected %v, got %v", idx, want[idx], round.Arguments)
+		}
+	}
+	if !reflect.DeepEqual(resumed, NegotiationState{Common: []string{"a", "d"}, Shallow: []string{"s"}}) {
+		t.Fatalf("unexpected state: %v", resumed)
+	}
+}
+
+// linearWalker walks a linear history (newest first), skipping the ancestors of common commits
+type linearWalker struct {
+	commits []string
+}
+
+func (lw *linearWalker) NextHaves(n int) []string {
+	haves := lw.commits[:min(n, len(lw.commits))]
+	lw.commits = lw.commits[len(haves):]
+	return haves
+}
+
+func (lw *linearWalker) MarkCommon(objID string) {
+	// Every remaining commit is an ancestor of a common commit (in a linear history)
+	lw.commits = nil
+}
+
+func TestNegotiator(t *testing.T) {
+	req := &CommandRequest{
+		Command: CapabilityFetch,
+		Arguments: CommandArguments{
+			{Key: ArgumentWant, Value: "w"},
+		},
+	}
+	tests := map[string]struct {
+		resps      []*FetchResponse
+		want       []CommandArguments
+		wantCommon []string
+		wantReady  bool
+	}{
+		"ready": {
+			resps: []*FetchResponse{
+				{Acknowledgements: Acknowledgements{NAK: true}},
+				{Acknowledgements: Acknowledgements{ACKs: []string{"c3"}, Ready: true}},
+			},
+			want: []CommandArguments{
+				{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "c5"}, {Key: ArgumentHave, Value: "c4"}},
+				{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "c3"}, {Key: ArgumentHave, Value: "c2"}},
+			},
+			wantCommon: []string{"c3"},
+			wantReady:  true,
+		},
+		"pruned": {
+			resps: []*FetchResponse{
+				{Acknowledgements: Acknowledgements{ACKs: []string{"c4"}}},
+				{},
+			},
+			want: []CommandArguments{
+				{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "c5"}, {Key: ArgumentHave, Value: "c4"}},
+				// The ancestors of c4 are skipped, so the walk is exhausted
+				{{Key: ArgumentWant, Value: "w"}, {Key: ArgumentHave, Value: "c4"}, {Key: ArgumentDone}},
+			},
+			wantCommon: []string{"c4"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ng := NewNegotiator(&linearWalker{commits: []string{"c5", "c4", "c3", "c2", "c1"}}, 2)
+			var rounds []*CommandRequest
+			for _, resp := range tc.resps {
+				round, done := ng.NextRound(req)
+				rounds = append(rounds, round)
+				ng.Observe(resp)
+				if done || ng.Ready() {
+					break
+				}
+			}
+			if len(rounds) != len(tc.want) {
+				t.Fatalf("expected %d rounds, got %d", len(tc.want), len(rounds))
+			}
+			for idx, round := range rounds {
+				if !reflect.DeepEqual(round.Arguments, tc.want[idx]) {
+					t.Fatalf("round %d: expected %v, got %v", idx, tc.want[idx], round.Arguments)
+				}
+			}
+			if !reflect.DeepEqual(ng.Common(), tc.wantCommon) {
+				t.Fatalf("expected common %v, got %v", tc.wantCommon, ng.Common())
+			}
+			if ng.Ready() != tc.wantReady {
+				t.Fatalf("expected ready %t, got %t", tc.wantReady, ng.Ready())
+			}
+			// Once ready the packfile was sent with the "ready", so nothing is left to send
+			if round, done := ng.NextRound(req); tc.wantReady && (round != nil || !done) {
+				t.Fatalf("expected no round once ready, got %v", round.Arguments)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package protocolv2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+const (
+	// Requests the size of each object.
+	ArgumentSize = "size"
+	// Indicates to the server an object which the client wants to obtain
+	// information for.
+	ArgumentOID = "oid"
+)
+
+// ObjectInfoOptions are the typed arguments for an object-info command-request
+type ObjectInfoOptions struct {
+	// Advertisement (if non-nil) is used to validate the server supports the requested features
+	Advertisement *CapabilityAdvertisement
+	// Capabilities to include in the command-request
+	Capabilities Capabilities
+	// Size requests the size of each object
+	Size bool
+	// ObjectIDs are the objects to obtain information for
+	ObjectIDs []string
+	// Filter limits the information to objects matching the filter-spec. This is not
+	// supported by git itself, so it requires the server to advertise object-info=filter.
+	Filter string
+}
+
+// BuildObjectInfoRequest constructs an object-info command-request from the given options
+func BuildObjectInfoRequest(opts ObjectInfoOptions) (*CommandRequest, error) {
+	if len(opts.ObjectIDs) == 0 {
+		return nil, errors.New("at least one oid is required")
+	}
+	if opts.Filter != "" && (opts.Advertisement == nil || !opts.Advertisement.SupportsFeature(CapabilityObjectInfo, ArgumentFilter)) {
+		return nil, errors.New("filter requires the server to advertise object-info=filter")
+	}
+	req := &CommandRequest{
+		Command:      CapabilityObjectInfo,
+		Capabilities: opts.Capabilities,
+	}
+	if opts.Size {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentSize})
+	}
+	if opts.Filter != "" {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentFilter, Value: opts.Filter})
+	}
+	for _, objID := range opts.ObjectIDs {
+		req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentOID, Value: objID})
+	}
+	return req, nil
+}
+
+// obj-info = obj-id SP obj-size
+type ObjectInfo struct {
+	ObjectID string
+	// Size is nil if the size was not requested or the object is missing, in which case
+	// git sends an empty obj-size (ex: "<oid> ")
+	Size *int64
+}
+
+// https://git-scm.com/docs/protocol-v2#_object_info
+// output = info flush-pkt
+// info = PKT-LINE(attrs LF) *PKT-LINE(obj-info LF)
+type ObjectInfoResponse struct {
+	// attrs = attr | attrs SP attrs
+	Attributes []string
+	Objects    []ObjectInfo
+}
+
+// Append the response pkt-lines to the given slice
+func (oir ObjectInfoResponse) Append(b []byte) []byte {
+	b = pktline.AppendString(b, strings.Join(oir.Attributes, " ")+"\n")
+	hasSize := slices.Contains(oir.Attributes, ArgumentSize)
+	for _, oi := range oir.Objects {
+		line := oi.ObjectID
+		if hasSize {
+			line += " "
+			if oi.Size != nil {
+				line += strconv.FormatInt(*oi.Size, 10)
+			}
+		}
+		b = pktline.AppendString(b, line+"\n")
+	}
+	b = pktline.AppendFlushPkt(b)
+	return b
+}
+
+// Bytes returns the response pkt-lines as a slice
+func (oir ObjectInfoResponse) Bytes() []byte {
+	return oir.Append(nil)
+}
+
+// Parse populates the fields from a given pkt-line scanner
+// The trailing LF of each pkt-line is optional, git omits it
+func (oir *ObjectInfoResponse) Parse(scanner *pktline.Scanner) error {
+	line, err := scanner.Scan()
+	if err != nil {
+		return truncated("object-info", err)
+	}
+	oir.Attributes = strings.Fields(string(bytes.TrimSuffix(line, []byte("\n"))))
+	hasSize := slices.Contains(oir.Attributes, ArgumentSize)
+	for {
+		line, err := scanner.Scan()
+		if err != nil {
+			if errors.Is(err, pktline.ErrFlushPkt) {
+				return nil
+			}
+			return truncated("object-info", err)
+		}
+		objID, size, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+		if len(objID) == 0 {
+			return fmt.Errorf("invalid obj-info: %q", string(line))
+		}
+		oi := ObjectInfo{ObjectID: string(objID)}
+		if hasSize {
+			if !ok {
+				return fmt.Errorf("invalid obj-info: %q", string(line))
+			}
+			// An empty obj-size indicates the object is missing
+			if len(size) > 0 {
+				n, err := strconv.ParseInt(string(size), 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid obj-info: %q", string(line))
+				}
+				oi.Size = &n
+			}
+		}
+		oir.Objects = append(oir.Objects, oi)
+	}
+}
@@ -0,0 +1,159 @@
+package protocolv2
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func TestBuildObjectInfoRequest(t *testing.T) {
+	withFilter := &CapabilityAdvertisement{Capabilities: Capabilities{{Key: CapabilityObjectInfo, Value: "size filter"}}}
+	withoutFilter := &CapabilityAdvertisement{Capabilities: Capabilities{{Key: CapabilityObjectInfo, Value: "size"}}}
+	tests := map[string]struct {
+		opts    ObjectInfoOptions
+		want    CommandArguments
+		wantErr string
+	}{
+		"size": {
+			opts: ObjectInfoOptions{Size: true, ObjectIDs: []string{"a", "b"}},
+			want: CommandArguments{
+				{Key: ArgumentSize},
+				{Key: ArgumentOID, Value: "a"},
+				{Key: ArgumentOID, Value: "b"},
+			},
+		},
+		"empty": {
+			opts:    ObjectInfoOptions{Size: true},
+			wantErr: "at least one oid is required",
+		},
+		"filter": {
+			opts: ObjectInfoOptions{Advertisement: withFilter, Size: true, Filter: "blob:none", ObjectIDs: []string{"a"}},
+			want: CommandArguments{
+				{Key: ArgumentSize},
+				{Key: ArgumentFilter, Value: "blob:none"},
+				{Key: ArgumentOID, Value: "a"},
+			},
+		},
+		"filter unsupported": {
+			opts:    ObjectInfoOptions{Advertisement: withoutFilter, Size: true, Filter: "blob:none", ObjectIDs: []string{"a"}},
+			wantErr: "filter requires the server to advertise object-info=filter",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := BuildObjectInfoRequest(tc.opts)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(req.Arguments, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, req.Arguments)
+			}
+		})
+	}
+}
+
+func TestObjectInfoRequestRoundTrip(t *testing.T) {
+	req, err := BuildObjectInfoRequest(ObjectInfoOptions{
+		Size:      true,
+		ObjectIDs: []string{"0000000000000000000000000000000000000001", "0000000000000000000000000000000000000002"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got CommandRequest
+	if err := got.Parse(pktline.NewScanner(bytes.NewReader(req.Bytes()))); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, req) {
+		t.Fatalf("expected %v, got %v", req, got)
+	}
+}
+
+func TestObjectInfoResponse(t *testing.T) {
+	size := func(n int64) *int64 {
+		return &n
+	}
+	tests := map[string]struct {
+		payload   string
+		want      ObjectInfoResponse
+		roundTrip bool
+	}{
+		"size": {
+			payload: "0009size\n" +
+				"00300000000000000000000000000000000000000001 42\n" +
+				"00310000000000000000000000000000000000000002 100\n" +
+				"0000",
+			want: ObjectInfoResponse{
+				Attributes: []string{ArgumentSize},
+				Objects: []ObjectInfo{
+					{ObjectID: "0000000000000000000000000000000000000001", Size: size(42)},
+					{ObjectID: "0000000000000000000000000000000000000002", Size: size(100)},
+				},
+			},
+			roundTrip: true,
+		},
+		"missing": {
+			payload: "0009size\n" +
+				"00300000000000000000000000000000000000000001 42\n" +
+				"002e0000000000000000000000000000000000000002 \n" +
+				"0000",
+			want: ObjectInfoResponse{
+				Attributes: []string{ArgumentSize},
+				Objects: []ObjectInfo{
+					{ObjectID: "0000000000000000000000000000000000000001", Size: size(42)},
+					{ObjectID: "0000000000000000000000000000000000000002"},
+				},
+			},
+			roundTrip: true,
+		},
+		"no size": {
+			payload: "0005\n" +
+				"002d0000000000000000000000000000000000000001\n" +
+				"0000",
+			want: ObjectInfoResponse{
+				Attributes: []string{},
+				Objects: []ObjectInfo{
+					{ObjectID: "0000000000000000000000000000000000000001"},
+				},
+			},
+			roundTrip: true,
+		},
+		// Recorded from git 2.39, which omits the trailing LF
+		"git": {
+			payload: "0008size" +
+				"0030ec0fe20996b4c463845498b315d14055fd5d1c99 139" +
+				"002d0000000000000000000000000000000000000001 " +
+				"0000",
+			want: ObjectInfoResponse{
+				Attributes: []string{ArgumentSize},
+				Objects: []ObjectInfo{
+					{ObjectID: "ec0fe20996b4c463845498b315d14055fd5d1c99", Size: size(139)},
+					{ObjectID: "0000000000000000000000000000000000000001"},
+				},
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var oir ObjectInfoResponse
+			if err := oir.Parse(pktline.NewScanner(bytes.NewReader([]byte(tc.payload)))); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(oir, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, oir)
+			}
+			if tc.roundTrip && !bytes.Equal(oir.Bytes(), []byte(tc.payload)) {
+				t.Fatalf("expected payload to match, got %q", string(oir.Bytes()))
+			}
+		})
+	}
+}
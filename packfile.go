@@ -0,0 +1,129 @@
+package protocolv2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"io"
+)
+
+// The size of the packfile header ("PACK", version and number of objects)
+const packHeaderSize = 12
+
+// objectFormatSize returns the size (in bytes) of an object ID in the given object-format
+func objectFormatSize(objectFormat string) int {
+	if objectFormat == "sha256" {
+		return sha256.Size
+	}
+	return sha1.Size
+}
+
+// objectFormatOf returns the object-format implied by the length of a hex-encoded object ID
+func objectFormatOf(objID string) (string, bool) {
+	if !isObjectID([]byte(objID)) {
+		return "", false
+	}
+	if len(objID) == 2*sha256.Size {
+		return "sha256", true
+	}
+	return "sha1", true
+}
+
+// packHasher computes the trailing checksum of a packfile as it is streamed
+// The hash (and so the size of the trailer) is that of the object-format of the fetch, as it is not
+// known from the packfile itself. The last bytes which may be the trailer are held back.
+type packHasher struct {
+	hash hash.Hash
+	tail []byte
+}
+
+// newPackHasher creates a packHasher for the given object-format (defaulting to "sha1" if empty)
+func newPackHasher(objectFormat string) *packHasher {
+	h := sha1.New()
+	if objectFormat == "sha256" {
+		h = sha256.New()
+	}
+	return &packHasher{
+		hash: h,
+		tail: make([]byte, 0, 2*h.Size()),
+	}
+}
+
+// Write implements the io.Writer interface
+func (ph *packHasher) Write(p []byte) (int, error) {
+	for data := p; len(data) > 0; {
+		n := min(len(data), cap(ph.tail)-len(ph.tail))
+		ph.tail = append(ph.tail, data[:n]...)
+		data = data[n:]
+		if excess := len(ph.tail) - ph.hash.Size(); excess > 0 && len(ph.tail) == cap(ph.tail) {
+			ph.hash.Write(ph.tail[:excess])
+			ph.tail = append(ph.tail[:0], ph.tail[excess:]...)
+		}
+	}
+	return len(p), nil
+}
+
+// Sum returns the packfile trailer if it matches the checksum of the packfile (otherwise nil)
+func (ph *packHasher) Sum() []byte {
+	if len(ph.tail) < ph.hash.Size() {
+		return nil
+	}
+	body, trailer := ph.tail[:len(ph.tail)-ph.hash.Size()], ph.tail[len(ph.tail)-ph.hash.Size():]
+	ph.hash.Write(body)
+	if sum := ph.hash.Sum(nil); bytes.Equal(sum, trailer) {
+		return sum
+	}
+	return nil
+}
+
+// bufferPackfile wraps the packfile writer in a bufio.Writer of the given size (if positive and the
+// writer is non-nil), returning the flush which must be called once the response is parsed
+// The sideband-1 payloads are at most 65515 bytes (often far less), so buffering them avoids a
+// syscall per pkt-line when writing to an *os.File.
+func bufferPackfile(packfile io.Writer, size int) (io.Writer, func() error) {
+	if size <= 0 || packfile == nil {
+		return packfile, func() error { return nil }
+	}
+	bw := bufio.NewWriterSize(packfile, size)
+	return bw, bw.Flush
+}
+
+// PackTee passes the packfile through to a destination (ex: between FetchResponse.Parse and a custom
+// indexer), tracking the offset of the next byte so the offset of each object is known as it streams
+// without buffering the packfile. The objects themselves are not parsed.
+type PackTee struct {
+	w      io.Writer
+	offset int64
+	hasher *packHasher
+}
+
+// NewPackTee creates a PackTee writing to w (if non-nil) for a packfile of the given object-format
+// (ex: the Client.NegotiatedObjectFormat, defaulting to "sha1" if empty)
+func NewPackTee(w io.Writer, objectFormat string) *PackTee {
+	return &PackTee{w: w, hasher: newPackHasher(objectFormat)}
+}
+
+// Write implements the io.Writer interface, only the bytes accepted by the destination are counted
+func (pt *PackTee) Write(p []byte) (int, error) {
+	n := len(p)
+	var err error
+	if pt.w != nil {
+		n, err = pt.w.Write(p)
+	}
+	pt.hasher.Write(p[:n])
+	pt.offset += int64(n)
+	return n, err
+}
+
+// Offset returns the number of bytes written so far, the offset of the next byte of the packfile
+func (pt *PackTee) Offset() int64 {
+	return pt.offset
+}
+
+// Sum returns the trailing checksum of the packfile if it matches the checksum (of the object-format)
+// of the preceding bytes, otherwise nil. It must only be called once, after the packfile is complete.
+func (pt *PackTee) Sum() []byte {
+	return pt.hasher.Sum()
+}
@@ -0,0 +1,83 @@
+package protocolv2
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+// shortWriter accepts at most n bytes in total
+type shortWriter struct {
+	n int
+}
+
+func (sw *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > sw.n {
+		p = p[:sw.n]
+		sw.n = 0
+		return len(p), io.ErrShortWrite
+	}
+	sw.n -= len(p)
+	return len(p), nil
+}
+
+func TestPackTee(t *testing.T) {
+	tests := map[string]struct {
+		objectFormat string
+	}{
+		"git-2.39-sha1.fetch": {
+			objectFormat: "sha1",
+		},
+		"git-2.39-sha256.fetch": {
+			objectFormat: "sha256",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			payload, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var packfile bytes.Buffer
+			tee := NewPackTee(&packfile, tc.objectFormat)
+			var fr FetchResponse
+			if err := fr.ParseObjectFormat(pktline.NewScanner(bytes.NewReader(payload)), tc.objectFormat, tee, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			if tee.Offset() != int64(packfile.Len()) || tee.Offset() != fr.PackSize {
+				t.Fatalf("expected offset %d, got %d", packfile.Len(), tee.Offset())
+			}
+			if sum := tee.Sum(); sum == nil || !bytes.Equal(sum, fr.PackHash) {
+				t.Fatalf("expected checksum %x, got %x", fr.PackHash, sum)
+			}
+		})
+	}
+
+	// Only the bytes accepted by the destination are counted
+	tee := NewPackTee(&shortWriter{n: 6}, "sha1")
+	if n, err := tee.Write([]byte("PACK")); n != 4 || err != nil {
+		t.Fatalf("expected 4 bytes, got %d (%v)", n, err)
+	}
+	if n, err := tee.Write([]byte("\x00\x00\x00\x02")); n != 2 || err != io.ErrShortWrite {
+		t.Fatalf("expected a short write of 2 bytes, got %d (%v)", n, err)
+	}
+	if tee.Offset() != 6 {
+		t.Fatalf("expected offset 6, got %d", tee.Offset())
+	}
+	if sum := tee.Sum(); sum != nil {
+		t.Fatalf("expected no checksum for an incomplete packfile, got %x", sum)
+	}
+
+	// Without a destination the packfile is only counted
+	tee = NewPackTee(nil, "sha1")
+	if _, err := tee.Write([]byte("PACK")); err != nil {
+		t.Fatal(err)
+	}
+	if tee.Offset() != 4 {
+		t.Fatalf("expected offset 4, got %d", tee.Offset())
+	}
+}
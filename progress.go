@@ -0,0 +1,53 @@
+package protocolv2
+
+import (
+	"bytes"
+	"io"
+)
+
+// ProgressFilterFunc decides whether a line of progress (including its trailing CR or LF) is forwarded
+type ProgressFilterFunc func(line []byte) bool
+
+// progressFilter forwards the progress lines accepted by the filter to the underlying writer
+// git terminates progress lines with CR when updating in place (ex: percentages) or LF when done
+type progressFilter struct {
+	w      io.Writer
+	filter ProgressFilterFunc
+	buf    []byte
+}
+
+// NewProgressFilter returns a writer forwarding each progress line (sideband-2) to w only if the
+// filter returns true. A line split across writes is buffered until it is terminated, Close
+// forwards a final unterminated line (ex: the response ended mid-line) but does not close w.
+func NewProgressFilter(w io.Writer, filter ProgressFilterFunc) io.WriteCloser {
+	return &progressFilter{w: w, filter: filter}
+}
+
+// Write implements the io.Writer interface
+func (pf *progressFilter) Write(p []byte) (int, error) {
+	pf.buf = append(pf.buf, p...)
+	for {
+		idx := bytes.IndexAny(pf.buf, "\r\n")
+		if idx == -1 {
+			return len(p), nil
+		}
+		line := pf.buf[:idx+1]
+		if pf.filter(line) {
+			if _, err := pf.w.Write(line); err != nil {
+				return len(p), err
+			}
+		}
+		pf.buf = pf.buf[idx+1:]
+	}
+}
+
+// Close implements the io.Closer interface
+func (pf *progressFilter) Close() error {
+	line := pf.buf
+	pf.buf = nil
+	if len(line) == 0 || !pf.filter(line) {
+		return nil
+	}
+	_, err := pf.w.Write(line)
+	return err
+}
@@ -0,0 +1,60 @@
+package protocolv2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProgressFilter(t *testing.T) {
+	writes := []string{
+		"Enumerating objects: 5, done.\n",
+		"Counting objects:  20% (1/5)\rCounting objects:  40% (2/5)\r",
+		"Counting objects: 100% (5/5)\rCounting obj",
+		"ects: 100% (5/5), done.\n",
+		"Total 5 (delta 0), reused 0 (delta 0), pack-reused 0\n",
+		"Indexing objects: 5",
+	}
+	tests := map[string]struct {
+		filter     ProgressFilterFunc
+		want       string
+		wantClosed string
+	}{
+		"everything": {
+			filter:     func(line []byte) bool { return true },
+			want:       "Enumerating objects: 5, done.\nCounting objects:  20% (1/5)\rCounting objects:  40% (2/5)\rCounting objects: 100% (5/5)\rCounting objects: 100% (5/5), done.\nTotal 5 (delta 0), reused 0 (delta 0), pack-reused 0\n",
+			wantClosed: "Indexing objects: 5",
+		},
+		"without percentages": {
+			filter:     func(line []byte) bool { return !bytes.HasSuffix(line, []byte("\r")) },
+			want:       "Enumerating objects: 5, done.\nCounting objects: 100% (5/5), done.\nTotal 5 (delta 0), reused 0 (delta 0), pack-reused 0\n",
+			wantClosed: "Indexing objects: 5",
+		},
+		"done only": {
+			filter: func(line []byte) bool { return bytes.HasSuffix(line, []byte("done.\n")) },
+			want:   "Enumerating objects: 5, done.\nCounting objects: 100% (5/5), done.\n",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewProgressFilter(&buf, tc.filter)
+			for _, write := range writes {
+				if n, err := w.Write([]byte(write)); err != nil {
+					t.Fatal(err)
+				} else if n != len(write) {
+					t.Fatalf("expected %d bytes written, got %d", len(write), n)
+				}
+			}
+			if buf.String() != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, buf.String())
+			}
+			// The unterminated final line is only forwarded once closed
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if want := tc.want + tc.wantClosed; buf.String() != want {
+				t.Fatalf("expected %q after close, got %q", want, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package protocolv2
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// rateLimitedWriter throttles writes to the underlying (optional) writer using a token bucket
+// Tokens are the bytes which may be written, the bucket holds (and refills) one second of tokens
+type rateLimitedWriter struct {
+	ctx    context.Context
+	w      io.Writer
+	rate   int64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(context.Context, time.Duration) error
+}
+
+// NewRateLimitedWriter returns a writer which caps the throughput to w at bytesPerSecond, blocking
+// writes until the bytes are permitted (or the context is cancelled). Since the fetch response is
+// parsed synchronously, throttling the packfile writer also applies backpressure to the network.
+// If w is nil the writes are discarded after being throttled. If bytesPerSecond is not positive
+// the writes are not throttled.
+func NewRateLimitedWriter(ctx context.Context, w io.Writer, bytesPerSecond int64) io.Writer {
+	if bytesPerSecond <= 0 {
+		if w == nil {
+			return io.Discard
+		}
+		return w
+	}
+	return newRateLimitedWriter(ctx, w, bytesPerSecond, time.Now, sleepContext)
+}
+
+// newRateLimitedWriter implements NewRateLimitedWriter with an injectable clock
+func newRateLimitedWriter(ctx context.Context, w io.Writer, bytesPerSecond int64, now func() time.Time, sleep func(context.Context, time.Duration) error) *rateLimitedWriter {
+	return &rateLimitedWriter{
+		ctx:    ctx,
+		w:      w,
+		rate:   bytesPerSecond,
+		tokens: float64(bytesPerSecond),
+		last:   now(),
+		now:    now,
+		sleep:  sleep,
+	}
+}
+
+// sleepContext sleeps for the given duration or until the context is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// wait blocks until n bytes may be written
+// The bucket may go into debt, which is repaid by the time spent sleeping
+func (rlw *rateLimitedWriter) wait(n int) error {
+	now := rlw.now()
+	rlw.tokens += now.Sub(rlw.last).Seconds() * float64(rlw.rate)
+	if rlw.tokens > float64(rlw.rate) {
+		rlw.tokens = float64(rlw.rate)
+	}
+	rlw.last = now
+	rlw.tokens -= float64(n)
+	if rlw.tokens >= 0 {
+		return nil
+	}
+	return rlw.sleep(rlw.ctx, time.Duration(-rlw.tokens/float64(rlw.rate)*float64(time.Second)))
+}
+
+// Write implements the io.Writer interface
+// Writes larger than the bucket are split so that no burst exceeds one second of throughput
+func (rlw *rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(int64(len(p)), rlw.rate)]
+		if err := rlw.wait(len(chunk)); err != nil {
+			return written, err
+		}
+		if rlw.w == nil {
+			written += len(chunk)
+		} else {
+			n, err := rlw.w.Write(chunk)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,84 @@
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedWriter(t *testing.T) {
+	tests := map[string]struct {
+		rate   int64
+		writes []int
+		idle   time.Duration
+		want   []time.Duration
+	}{
+		"within burst": {
+			rate:   10,
+			writes: []int{4, 6},
+		},
+		"split write": {
+			rate:   10,
+			writes: []int{25},
+			want:   []time.Duration{time.Second, 500 * time.Millisecond},
+		},
+		"debt": {
+			rate:   10,
+			writes: []int{10, 5, 5},
+			want:   []time.Duration{500 * time.Millisecond, 500 * time.Millisecond},
+		},
+		"refilled while idle": {
+			rate:   10,
+			writes: []int{10, 10},
+			idle:   time.Second,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clock := time.Unix(0, 0)
+			var slept []time.Duration
+			var buf bytes.Buffer
+			rlw := newRateLimitedWriter(context.Background(), &buf, tc.rate, func() time.Time {
+				return clock
+			}, func(ctx context.Context, d time.Duration) error {
+				slept = append(slept, d)
+				clock = clock.Add(d)
+				return nil
+			})
+			var total int
+			for _, size := range tc.writes {
+				n, err := rlw.Write(make([]byte, size))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != size {
+					t.Fatalf("expected %d bytes written, got %d", size, n)
+				}
+				total += n
+				clock = clock.Add(tc.idle)
+			}
+			if buf.Len() != total {
+				t.Fatalf("expected %d bytes in the underlying writer, got %d", total, buf.Len())
+			}
+			if !reflect.DeepEqual(slept, tc.want) {
+				t.Fatalf("expected sleeps %v, got %v", tc.want, slept)
+			}
+		})
+	}
+}
+
+func TestRateLimitedWriterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := NewRateLimitedWriter(ctx, nil, 10)
+	n, err := w.Write(make([]byte, 15))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if n != 10 {
+		t.Fatalf("expected the first 10 bytes to be written, got %d", n)
+	}
+}
@@ -0,0 +1,192 @@
+package protocolv2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+const (
+	// If advertised by git-receive-pack, indicates the server supports push options sent after the
+	// command-list. The client requests it by including the capability in the command-list.
+	CapabilityPushOptions = "push-options"
+	// The receive-pack server advertises this capability if it can silence its progress output.
+	// The client requests it to suppress the progress of the server (ex: for "git push --quiet").
+	CapabilityQuiet = "quiet"
+	// The receive-pack server advertises this capability if it can send a report of the status of
+	// each ref update (ex: "ok refs/heads/main" or "ng refs/heads/main non-fast-forward").
+	CapabilityReportStatus = "report-status"
+	// Like report-status, but the report is extended with the "option" lines describing how each
+	// ref was actually updated (ex: when a proc-receive hook rewrote the ref name or object ID).
+	CapabilityReportStatusV2 = "report-status-v2"
+)
+
+// receivePackCapabilities are the capabilities (besides push-options) the client may only request if advertised
+var receivePackCapabilities = []string{CapabilityQuiet, CapabilityReportStatus, CapabilityReportStatusV2}
+
+// command = old-id SP new-id SP name
+type ReceivePackCommand struct {
+	OldID string
+	NewID string
+	Name  string
+}
+
+// String implements the fmt.Stringer interface
+func (rpc ReceivePackCommand) String() string {
+	return rpc.OldID + " " + rpc.NewID + " " + rpc.Name
+}
+
+// Parse populates the fields from a given command (without the pkt-line framing)
+func (rpc *ReceivePackCommand) Parse(line []byte) error {
+	fields := strings.SplitN(string(bytes.TrimSuffix(line, []byte("\n"))), " ", 3)
+	if len(fields) != 3 || fields[0] == "" || fields[1] == "" || fields[2] == "" {
+		return fmt.Errorf("invalid command: %q", string(line))
+	}
+	rpc.OldID, rpc.NewID, rpc.Name = fields[0], fields[1], fields[2]
+	return nil
+}
+
+// https://git-scm.com/docs/pack-protocol#_reference_update_request_and_packfile_transfer
+// update-requests = command-list [push-options]
+// command-list = PKT-LINE(command NUL capability-list) *PKT-LINE(command) flush-pkt
+// push-options = *PKT-LINE(push-option) flush-pkt
+//
+// git-receive-pack only supports protocol v0/v1, so the capability-list is space separated.
+// The packfile (if any) follows the request and is not part of it.
+type ReceivePackRequest struct {
+	Commands     []ReceivePackCommand
+	Capabilities []string
+	PushOptions  []string
+}
+
+// AddPushOption adds a push option (ex: "ci.skip"), requesting the push-options capability
+func (rpr *ReceivePackRequest) AddPushOption(option string) {
+	if !slices.Contains(rpr.Capabilities, CapabilityPushOptions) {
+		rpr.Capabilities = append(rpr.Capabilities, CapabilityPushOptions)
+	}
+	rpr.PushOptions = append(rpr.PushOptions, option)
+}
+
+// Validate returns an error if the request is not valid for a server with the advertised capabilities
+func (rpr ReceivePackRequest) Validate(advertised []string) error {
+	if len(rpr.Commands) == 0 {
+		return errors.New("at least one command is required")
+	}
+	if slices.Contains(rpr.Capabilities, CapabilityPushOptions) && !slices.Contains(advertised, CapabilityPushOptions) {
+		return errors.New("push options require the server to advertise " + CapabilityPushOptions)
+	}
+	for _, capability := range rpr.Capabilities {
+		if slices.Contains(receivePackCapabilities, capability) && !slices.Contains(advertised, capability) {
+			return fmt.Errorf("%s requires the server to advertise it", capability)
+		}
+	}
+	for _, option := range rpr.PushOptions {
+		if strings.ContainsAny(option, "\n\x00") {
+			return fmt.Errorf("invalid push option: %q", option)
+		}
+	}
+	return nil
+}
+
+// ReceivePackOptions are the typed capabilities of a receive-pack request
+type ReceivePackOptions struct {
+	// Advertised (if non-nil) are the capabilities of the receive-pack server used to validate the request
+	Advertised []string
+	// Commands are the ref updates
+	Commands []ReceivePackCommand
+	// ReportStatusV2 requests the report-status-v2 report, taking precedence over ReportStatus
+	ReportStatusV2 bool
+	// ReportStatus requests the report-status report
+	ReportStatus bool
+	// Quiet suppresses the progress output of the server
+	Quiet bool
+	// PushOptions are sent after the command-list, requesting the push-options capability
+	PushOptions []string
+}
+
+// BuildReceivePackRequest constructs a receive-pack request from the given options, the requested
+// capabilities are framed in the first command (after a NUL) in the order git sends them
+func BuildReceivePackRequest(opts ReceivePackOptions) (*ReceivePackRequest, error) {
+	rpr := &ReceivePackRequest{Commands: opts.Commands}
+	if opts.ReportStatusV2 {
+		rpr.Capabilities = append(rpr.Capabilities, CapabilityReportStatusV2)
+	} else if opts.ReportStatus {
+		rpr.Capabilities = append(rpr.Capabilities, CapabilityReportStatus)
+	}
+	if opts.Quiet {
+		rpr.Capabilities = append(rpr.Capabilities, CapabilityQuiet)
+	}
+	for _, option := range opts.PushOptions {
+		rpr.AddPushOption(option)
+	}
+	if opts.Advertised != nil {
+		if err := rpr.Validate(opts.Advertised); err != nil {
+			return nil, err
+		}
+	}
+	return rpr, nil
+}
+
+// Append the request pkt-lines to the given slice
+func (rpr ReceivePackRequest) Append(b []byte) []byte {
+	for idx, cmd := range rpr.Commands {
+		if idx == 0 {
+			b = pktline.AppendString(b, cmd.String()+"\x00"+strings.Join(rpr.Capabilities, " "))
+		} else {
+			b = pktline.AppendString(b, cmd.String())
+		}
+	}
+	b = pktline.AppendFlushPkt(b)
+	if slices.Contains(rpr.Capabilities, CapabilityPushOptions) {
+		for _, option := range rpr.PushOptions {
+			b = pktline.AppendString(b, option)
+		}
+		b = pktline.AppendFlushPkt(b)
+	}
+	return b
+}
+
+// Bytes returns the request pkt-lines as a slice
+func (rpr ReceivePackRequest) Bytes() []byte {
+	return rpr.Append(nil)
+}
+
+// Parse populates the fields from a given pkt-line scanner
+func (rpr *ReceivePackRequest) Parse(scanner *pktline.Scanner) error {
+	for {
+		line, err := scanner.Scan()
+		if err != nil {
+			if errors.Is(err, pktline.ErrFlushPkt) {
+				break
+			}
+			return truncated("command-list", err)
+		}
+		if len(rpr.Commands) == 0 {
+			var caps []byte
+			line, caps, _ = bytes.Cut(line, []byte("\x00"))
+			rpr.Capabilities = strings.Fields(string(caps))
+		}
+		var cmd ReceivePackCommand
+		if err := cmd.Parse(line); err != nil {
+			return err
+		}
+		rpr.Commands = append(rpr.Commands, cmd)
+	}
+	if !slices.Contains(rpr.Capabilities, CapabilityPushOptions) {
+		return nil
+	}
+	for {
+		line, err := scanner.Scan()
+		if err != nil {
+			if errors.Is(err, pktline.ErrFlushPkt) {
+				return nil
+			}
+			return truncated("push-options", err)
+		}
+		rpr.PushOptions = append(rpr.PushOptions, string(bytes.TrimSuffix(line, []byte("\n"))))
+	}
+}
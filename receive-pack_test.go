@@ -0,0 +1,143 @@
+package protocolv2
+
+import (
+	"bytes"
+	"reflect"
+	"slices"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func TestReceivePackRequest(t *testing.T) {
+	zero := "0000000000000000000000000000000000000000"
+	one := "0000000000000000000000000000000000000001"
+	rpr := ReceivePackRequest{
+		Commands: []ReceivePackCommand{
+			{OldID: zero, NewID: one, Name: "refs/heads/main"},
+			{OldID: one, NewID: zero, Name: "refs/heads/old"},
+		},
+		Capabilities: []string{"report-status"},
+	}
+	rpr.AddPushOption("ci.skip")
+	rpr.AddPushOption("merge_request.create")
+
+	want := "0080" + zero + " " + one + " refs/heads/main\x00report-status push-options" +
+		"0064" + one + " " + zero + " refs/heads/old" +
+		"0000" +
+		"000bci.skip" +
+		"0018merge_request.create" +
+		"0000"
+	if got := string(rpr.Bytes()); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	var parsed ReceivePackRequest
+	if err := parsed.Parse(pktline.NewScanner(bytes.NewReader([]byte(want)))); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, rpr) {
+		t.Fatalf("expected %+v, got %+v", rpr, parsed)
+	}
+}
+
+func TestReceivePackRequestValidate(t *testing.T) {
+	cmd := ReceivePackCommand{OldID: "a", NewID: "b", Name: "refs/heads/main"}
+	tests := map[string]struct {
+		rpr        ReceivePackRequest
+		advertised []string
+		wantErr    string
+	}{
+		"no commands": {
+			wantErr: "at least one command is required",
+		},
+		"push options advertised": {
+			rpr:        ReceivePackRequest{Commands: []ReceivePackCommand{cmd}, Capabilities: []string{CapabilityPushOptions}, PushOptions: []string{"ci.skip"}},
+			advertised: []string{"report-status", CapabilityPushOptions},
+		},
+		"push options not advertised": {
+			rpr:        ReceivePackRequest{Commands: []ReceivePackCommand{cmd}, Capabilities: []string{CapabilityPushOptions}, PushOptions: []string{"ci.skip"}},
+			advertised: []string{"report-status"},
+			wantErr:    "push options require the server to advertise push-options",
+		},
+		"invalid push option": {
+			rpr:        ReceivePackRequest{Commands: []ReceivePackCommand{cmd}, Capabilities: []string{CapabilityPushOptions}, PushOptions: []string{"ci.skip\n"}},
+			advertised: []string{CapabilityPushOptions},
+			wantErr:    "invalid push option: \"ci.skip\\n\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.rpr.Validate(tc.advertised)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBuildReceivePackRequest(t *testing.T) {
+	cmd := ReceivePackCommand{OldID: "0000000000000000000000000000000000000000", NewID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"}
+	advertised := []string{CapabilityReportStatus, CapabilityReportStatusV2, CapabilityQuiet, CapabilityPushOptions, "agent=git/2.39.5"}
+	tests := map[string]struct {
+		opts     ReceivePackOptions
+		wantCaps []string
+		wantErr  string
+	}{
+		"none": {
+			opts: ReceivePackOptions{Advertised: advertised, Commands: []ReceivePackCommand{cmd}},
+		},
+		"report-status-v2 and quiet": {
+			opts:     ReceivePackOptions{Advertised: advertised, Commands: []ReceivePackCommand{cmd}, ReportStatusV2: true, ReportStatus: true, Quiet: true},
+			wantCaps: []string{CapabilityReportStatusV2, CapabilityQuiet},
+		},
+		"report-status with push options": {
+			opts:     ReceivePackOptions{Advertised: advertised, Commands: []ReceivePackCommand{cmd}, ReportStatus: true, PushOptions: []string{"ci.skip"}},
+			wantCaps: []string{CapabilityReportStatus, CapabilityPushOptions},
+		},
+		"without advertisement": {
+			opts:     ReceivePackOptions{Commands: []ReceivePackCommand{cmd}, Quiet: true},
+			wantCaps: []string{CapabilityQuiet},
+		},
+		"quiet not advertised": {
+			opts:    ReceivePackOptions{Advertised: []string{CapabilityReportStatus}, Commands: []ReceivePackCommand{cmd}, ReportStatus: true, Quiet: true},
+			wantErr: "quiet requires the server to advertise it",
+		},
+		"report-status-v2 not advertised": {
+			opts:    ReceivePackOptions{Advertised: []string{CapabilityReportStatus}, Commands: []ReceivePackCommand{cmd}, ReportStatusV2: true},
+			wantErr: "report-status-v2 requires the server to advertise it",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rpr, err := BuildReceivePackRequest(tc.opts)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rpr.Capabilities, tc.wantCaps) {
+				t.Fatalf("expected capabilities %v, got %v", tc.wantCaps, rpr.Capabilities)
+			}
+			var parsed ReceivePackRequest
+			if err := parsed.Parse(pktline.NewScanner(bytes.NewReader(rpr.Bytes()))); err != nil {
+				t.Fatal(err)
+			}
+			// An empty capability-list is parsed as an empty (rather than nil) slice
+			if !slices.Equal(parsed.Commands, rpr.Commands) || !slices.Equal(parsed.Capabilities, rpr.Capabilities) || !slices.Equal(parsed.PushOptions, rpr.PushOptions) {
+				t.Fatalf("expected %+v, got %+v", *rpr, parsed)
+			}
+		})
+	}
+}
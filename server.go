@@ -0,0 +1,250 @@
+package protocolv2
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+// The maximum payload of a sideband pkt-line (LARGE_PACKET_DATA_MAX minus the sideband byte)
+const MaxSideBandPayload = 65516 - 1
+
+// PackfileWriter frames the data written to it as sideband-1 pkt-lines
+type PackfileWriter struct {
+	w    io.Writer
+	size int
+	buf  []byte
+}
+
+// NewPackfileWriter returns a PackfileWriter that writes to w
+func NewPackfileWriter(w io.Writer) *PackfileWriter {
+	return NewPackfileWriterSize(w, MaxSideBandPayload)
+}
+
+// NewPackfileWriterSize returns a PackfileWriter that splits the data into pkt-lines with
+// (at most) size bytes of payload, defaulting to MaxSideBandPayload if out of range
+func NewPackfileWriterSize(w io.Writer, size int) *PackfileWriter {
+	if size <= 0 || size > MaxSideBandPayload {
+		size = MaxSideBandPayload
+	}
+	return &PackfileWriter{w: w, size: size}
+}
+
+// Write implements the io.Writer interface
+func (pw *PackfileWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p[:min(len(p), pw.size)]
+		pw.buf = pktline.AppendLength(pw.buf[:0], 1+len(chunk))
+		pw.buf = append(pw.buf, byte(SideBandPack))
+		pw.buf = append(pw.buf, chunk...)
+		if _, err := pw.w.Write(pw.buf); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// FetchHandler produces the response sections and packfile for a fetch command-request
+// The filter argument (if any) is passed in its encoded form, as sent by the client, the handler
+// must call SplitFilterSpec to decode the sub-filters of a "combine:" filter-spec (as git does).
+type FetchHandler func(req *CommandRequest) (*FetchResponse, io.Reader, error)
+
+// ServeFetchOptions configure the behavior of ServeFetch
+// A filter-spec is always validated but never decoded by ServeFetch, see FetchHandler
+type ServeFetchOptions struct {
+	// Strict rejects any argument not in FetchArguments, by default they are
+	// ignored for forward compatibility with newer clients.
+	Strict bool
+	// ChunkSize is the maximum packfile payload of each pkt-line, defaults to MaxSideBandPayload
+	ChunkSize int
+}
+
+// ServeFetch writes the response to a fetch command-request using the given handler
+// If the request is rejected an error-line is written and the *ServerError is returned
+func ServeFetch(w io.Writer, req *CommandRequest, opts ServeFetchOptions, handler FetchHandler) error {
+	if req.Command != CapabilityFetch {
+		return serveError(w, fmt.Sprintf("fetch: unexpected command %q", req.Command))
+	}
+	if opts.Strict {
+		for _, arg := range req.Arguments {
+			if !slices.Contains(FetchArguments, arg.Key) {
+				return serveError(w, fmt.Sprintf("fetch: unexpected argument %q", arg.Key))
+			}
+		}
+	}
+	// Reject a malformed filter-spec up front, the handler receives it encoded and must use
+	// SplitFilterSpec to decode it
+	if spec, ok := req.Arguments.Get(ArgumentFilter); ok {
+		if _, err := SplitFilterSpec(spec); err != nil {
+			return serveError(w, "fetch: "+err.Error())
+		}
+	}
+	resp, packfile, err := handler(req)
+	if err != nil {
+		return serveError(w, err.Error())
+	}
+	for _, wr := range resp.WantedRefs {
+		if err := wr.Validate(); err != nil {
+			return serveError(w, "fetch: "+err.Error())
+		}
+	}
+	if _, err := w.Write(resp.Bytes()); err != nil {
+		return err
+	}
+	// Without "ready" (ex: a NAK or ACKs to continue negotiating) the response was terminated after
+	// the acknowledgments section, the packfile (if any) is only sent once the client is done
+	if !resp.Acknowledgements.IsZero() && !resp.Acknowledgements.Ready {
+		return nil
+	}
+	if packfile != nil {
+		if _, err := io.Copy(NewPackfileWriterSize(w, opts.ChunkSize), packfile); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(pktline.AppendFlushPkt(nil)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LsRefsHandler produces the references for an ls-refs command-request
+type LsRefsHandler func(req *CommandRequest) (*ListReferencesResponse, error)
+
+// ServeLsRefsOptions configure the behavior of ServeLsRefs
+type ServeLsRefsOptions struct {
+	// AllowedRefPrefixes (if non-empty) restricts the references a client may list (ex: only
+	// "refs/heads/"), the requested ref-prefix arguments are intersected with them before calling
+	// the handler and the references it returns are filtered, as a handler MAY ignore ref-prefix.
+	AllowedRefPrefixes []string
+	// RejectDisallowed returns an error if a requested ref-prefix does not intersect the allowed
+	// ref-prefixes, by default it is dropped
+	RejectDisallowed bool
+}
+
+// allowedRefPrefixes intersects the requested ref-prefixes with the allowed ref-prefixes, a requested
+// ref-prefix is kept if it is under an allowed ref-prefix (ex: "refs/heads/main" under "refs/heads/")
+// otherwise it is narrowed to the allowed ref-prefixes under it (ex: "refs/" to "refs/heads/").
+// No requested ref-prefixes requests every reference, so the allowed ref-prefixes are returned.
+func allowedRefPrefixes(requested, allowed []string) (prefixes, disallowed []string) {
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+	for _, prefix := range requested {
+		var intersects bool
+		for _, allow := range allowed {
+			var narrowed string
+			switch {
+			case strings.HasPrefix(prefix, allow):
+				narrowed = prefix
+			case strings.HasPrefix(allow, prefix):
+				narrowed = allow
+			default:
+				continue
+			}
+			intersects = true
+			if !slices.Contains(prefixes, narrowed) {
+				prefixes = append(prefixes, narrowed)
+			}
+		}
+		if !intersects {
+			disallowed = append(disallowed, prefix)
+		}
+	}
+	return prefixes, disallowed
+}
+
+// ServeLsRefs writes the response to an ls-refs command-request using the given handler
+// If the request is rejected an error-line is written and the *ServerError is returned
+func ServeLsRefs(w io.Writer, req *CommandRequest, opts ServeLsRefsOptions, handler LsRefsHandler) error {
+	if req.Command != CapabilityListReferences {
+		return serveError(w, fmt.Sprintf("ls-refs: unexpected command %q", req.Command))
+	}
+	var prefixes []string
+	if len(opts.AllowedRefPrefixes) > 0 {
+		var disallowed []string
+		prefixes, disallowed = allowedRefPrefixes(req.Arguments.GetAll(ArgumentRefPrefix), opts.AllowedRefPrefixes)
+		if len(disallowed) > 0 && opts.RejectDisallowed {
+			return serveError(w, fmt.Sprintf("ls-refs: disallowed ref-prefix %q", disallowed[0]))
+		}
+		// Every requested ref-prefix was dropped, an ls-refs without any would list every reference
+		if len(prefixes) == 0 {
+			if _, err := w.Write(ListReferencesResponse{}.Bytes()); err != nil {
+				return err
+			}
+			return nil
+		}
+		// Pass the handler a copy of the request with the intersected ref-prefixes
+		restricted := *req
+		restricted.Arguments = slices.DeleteFunc(slices.Clone(req.Arguments), func(arg CommandArgument) bool {
+			return arg.Key == ArgumentRefPrefix
+		})
+		for _, prefix := range prefixes {
+			restricted.Arguments = append(restricted.Arguments, CommandArgument{Key: ArgumentRefPrefix, Value: prefix})
+		}
+		req = &restricted
+	}
+	resp, err := handler(req)
+	if err != nil {
+		return serveError(w, err.Error())
+	}
+	filtered := resp.Filter(prefixes)
+	for _, ref := range filtered.References {
+		if err := ref.Validate(); err != nil {
+			return serveError(w, "ls-refs: "+err.Error())
+		}
+	}
+	if _, err := w.Write(filtered.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ObjectSizeFunc returns the size of the given object, or false if it is missing
+type ObjectSizeFunc func(objID string) (int64, bool)
+
+// ServeObjectInfo writes the response to an object-info command-request using the given sizing callback
+// Missing objects are included with an empty obj-size, matching git
+// If the request is rejected an error-line is written and the *ServerError is returned
+func ServeObjectInfo(w io.Writer, req *CommandRequest, size ObjectSizeFunc) error {
+	if req.Command != CapabilityObjectInfo {
+		return serveError(w, fmt.Sprintf("object-info: unexpected command %q", req.Command))
+	}
+	var resp ObjectInfoResponse
+	for _, arg := range req.Arguments {
+		switch arg.Key {
+		case ArgumentSize:
+			if !slices.Contains(resp.Attributes, ArgumentSize) {
+				resp.Attributes = append(resp.Attributes, ArgumentSize)
+			}
+		case ArgumentOID:
+			resp.Objects = append(resp.Objects, ObjectInfo{ObjectID: arg.Value})
+		default:
+			return serveError(w, fmt.Sprintf("object-info: unexpected argument %q", arg.Key))
+		}
+	}
+	if slices.Contains(resp.Attributes, ArgumentSize) {
+		for idx, oi := range resp.Objects {
+			if n, ok := size(oi.ObjectID); ok {
+				resp.Objects[idx].Size = &n
+			}
+		}
+	}
+	if _, err := w.Write(resp.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// serveError writes the error-line to w and returns it as an error
+func serveError(w io.Writer, message string) error {
+	se := &ServerError{Message: message}
+	if _, err := w.Write(se.Bytes()); err != nil {
+		return err
+	}
+	return se
+}
@@ -0,0 +1,386 @@
+package protocolv2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func TestServeFetch(t *testing.T) {
+	req := &CommandRequest{
+		Command: CapabilityFetch,
+		Arguments: CommandArguments{
+			{Key: ArgumentWant, Value: "0000000000000000000000000000000000000001"},
+			{Key: "unknown-argument"},
+			{Key: ArgumentDone},
+		},
+	}
+	handler := func(req *CommandRequest) (*FetchResponse, io.Reader, error) {
+		return &FetchResponse{}, strings.NewReader("PACK"), nil
+	}
+	tests := map[string]struct {
+		opts    ServeFetchOptions
+		want    string
+		wantErr string
+	}{
+		"lenient": {
+			want: "000dpackfile\n0009\x01PACK0000",
+		},
+		"strict": {
+			opts:    ServeFetchOptions{Strict: true},
+			want:    "0035ERR fetch: unexpected argument \"unknown-argument\"",
+			wantErr: "ERR fetch: unexpected argument \"unknown-argument\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := ServeFetch(&buf, req, tc.opts, handler)
+			if tc.wantErr != "" {
+				var se *ServerError
+				if !errors.As(err, &se) {
+					t.Fatalf("expected *ServerError, got %v", err)
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, buf.String())
+			}
+		})
+	}
+}
+
+func TestServeFetchAcknowledgments(t *testing.T) {
+	req := &CommandRequest{
+		Command: CapabilityFetch,
+		Arguments: CommandArguments{
+			{Key: ArgumentWant, Value: "0000000000000000000000000000000000000001"},
+			{Key: ArgumentHave, Value: "0000000000000000000000000000000000000002"},
+		},
+	}
+	tests := map[string]struct {
+		acks Acknowledgements
+		want string
+	}{
+		"nak": {
+			acks: Acknowledgements{NAK: true},
+			want: "0014acknowledgments\n0008NAK\n0000",
+		},
+		"acks without ready": {
+			acks: Acknowledgements{ACKs: []string{"0000000000000000000000000000000000000002"}},
+			want: "0014acknowledgments\n0031ACK 0000000000000000000000000000000000000002\n0000",
+		},
+		"ready": {
+			acks: Acknowledgements{ACKs: []string{"0000000000000000000000000000000000000002"}, Ready: true},
+			want: "0014acknowledgments\n0031ACK 0000000000000000000000000000000000000002\n000aready\n0001000dpackfile\n0009\x01PACK0000",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			// The packfile is only sent after "ready", otherwise the client continues negotiating
+			if err := ServeFetch(&buf, req, ServeFetchOptions{}, func(req *CommandRequest) (*FetchResponse, io.Reader, error) {
+				return &FetchResponse{Acknowledgements: tc.acks}, strings.NewReader("PACK"), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, buf.String())
+			}
+			var fr FetchResponse
+			if err := fr.Parse(pktline.NewScanner(&buf), io.Discard, nil); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fr.Acknowledgements, tc.acks) {
+				t.Fatalf("expected %+v, got %+v", tc.acks, fr.Acknowledgements)
+			}
+		})
+	}
+}
+
+func TestServeFetchRoundTrip(t *testing.T) {
+	req := &CommandRequest{
+		Command: CapabilityFetch,
+		Arguments: CommandArguments{
+			{Key: ArgumentWant, Value: "0000000000000000000000000000000000000001"},
+			{Key: ArgumentDone},
+		},
+	}
+	packfile := bytes.Repeat([]byte("PACK"), MaxSideBandPayload)
+	var buf bytes.Buffer
+	if err := ServeFetch(&buf, req, ServeFetchOptions{Strict: true}, func(req *CommandRequest) (*FetchResponse, io.Reader, error) {
+		return &FetchResponse{}, bytes.NewReader(packfile), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	var fr FetchResponse
+	if err := fr.Parse(pktline.NewScanner(&buf), &got, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), packfile) {
+		t.Fatalf("expected packfile to match")
+	}
+}
+
+func TestServeFetchFilter(t *testing.T) {
+	tests := map[string]struct {
+		filter  string
+		wantErr string
+	}{
+		"combine": {
+			filter: CombineFilterSpecs("blob:none", "sparse:oid=main:path with spaces"),
+		},
+		"malformed": {
+			filter:  "combine:blob:none+sparse:oid=main~",
+			wantErr: "ERR fetch: must escape char in sub-filter-spec: '~'",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := &CommandRequest{
+				Command: CapabilityFetch,
+				Arguments: CommandArguments{
+					{Key: ArgumentFilter, Value: tc.filter},
+					{Key: ArgumentDone},
+				},
+			}
+			var got []string
+			err := ServeFetch(io.Discard, req, ServeFetchOptions{}, func(req *CommandRequest) (*FetchResponse, io.Reader, error) {
+				spec, _ := req.Arguments.Get(ArgumentFilter)
+				var err error
+				got, err = SplitFilterSpec(spec)
+				return &FetchResponse{}, nil, err
+			})
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"blob:none", "sparse:oid=main:path with spaces"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestPackfileWriter(t *testing.T) {
+	tests := map[string]struct {
+		size int
+		want []int
+	}{
+		"default": {
+			want: []int{MaxSideBandPayload, MaxSideBandPayload, 10},
+		},
+		"small": {
+			size: 50000,
+			want: []int{50000, 50000, 31040},
+		},
+		"too large": {
+			size: MaxSideBandPayload + 1,
+			want: []int{MaxSideBandPayload, MaxSideBandPayload, 10},
+		},
+	}
+	payload := bytes.Repeat([]byte{'x'}, 2*MaxSideBandPayload+10)
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if n, err := NewPackfileWriterSize(&buf, tc.size).Write(payload); err != nil {
+				t.Fatal(err)
+			} else if n != len(payload) {
+				t.Fatalf("expected %d bytes written, got %d", len(payload), n)
+			}
+			scanner := pktline.NewScanner(&buf)
+			var got []int
+			var data []byte
+			for {
+				line, err := scanner.Scan()
+				if errors.Is(err, io.EOF) {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				sideband, chunk := pktline.SideBand(line)
+				if sideband != pktline.SideBandPackData {
+					t.Fatalf("unexpected sideband: %v", sideband)
+				}
+				got = append(got, len(chunk))
+				data = append(data, chunk...)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected chunks %v, got %v", tc.want, got)
+			}
+			if !bytes.Equal(data, payload) {
+				t.Fatalf("expected payload to match")
+			}
+		})
+	}
+}
+
+func TestServeObjectInfo(t *testing.T) {
+	sizes := map[string]int64{
+		"0000000000000000000000000000000000000001": 42,
+	}
+	sizeOf := func(objID string) (int64, bool) {
+		n, ok := sizes[objID]
+		return n, ok
+	}
+	tests := map[string]struct {
+		req     *CommandRequest
+		want    string
+		wantErr string
+	}{
+		"size": {
+			req: &CommandRequest{
+				Command: CapabilityObjectInfo,
+				Arguments: CommandArguments{
+					{Key: ArgumentSize},
+					{Key: ArgumentOID, Value: "0000000000000000000000000000000000000001"},
+					{Key: ArgumentOID, Value: "0000000000000000000000000000000000000002"},
+				},
+			},
+			want: "0009size\n" +
+				"00300000000000000000000000000000000000000001 42\n" +
+				"002e0000000000000000000000000000000000000002 \n" +
+				"0000",
+		},
+		"unexpected argument": {
+			req: &CommandRequest{
+				Command:   CapabilityObjectInfo,
+				Arguments: CommandArguments{{Key: "type"}},
+			},
+			want:    "002fERR object-info: unexpected argument \"type\"",
+			wantErr: "ERR object-info: unexpected argument \"type\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := ServeObjectInfo(&buf, tc.req, sizeOf)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, buf.String())
+			}
+		})
+	}
+}
+
+func TestServeLsRefs(t *testing.T) {
+	oid := "0000000000000000000000000000000000000001"
+	// The handler ignores ref-prefix (as a server MAY), so ServeLsRefs must filter the references
+	var gotPrefixes []string
+	handler := func(req *CommandRequest) (*ListReferencesResponse, error) {
+		gotPrefixes = req.Arguments.GetAll(ArgumentRefPrefix)
+		return &ListReferencesResponse{References: []Reference{
+			{ObjectID: oid, Name: "HEAD"},
+			{ObjectID: oid, Name: "refs/heads/main"},
+			{ObjectID: oid, Name: "refs/tags/v1"},
+		}}, nil
+	}
+	main := "003d" + oid + " refs/heads/main\n"
+	tests := map[string]struct {
+		prefixes     []string
+		opts         ServeLsRefsOptions
+		want         string
+		wantPrefixes []string
+		wantErr      string
+	}{
+		"unrestricted": {
+			prefixes:     []string{"refs/heads/"},
+			want:         "0032" + oid + " HEAD\n" + main + "003a" + oid + " refs/tags/v1\n0000",
+			wantPrefixes: []string{"refs/heads/"},
+		},
+		"allowed": {
+			prefixes:     []string{"refs/heads/main"},
+			opts:         ServeLsRefsOptions{AllowedRefPrefixes: []string{"refs/heads/"}},
+			want:         main + "0000",
+			wantPrefixes: []string{"refs/heads/main"},
+		},
+		"no ref-prefix": {
+			opts:         ServeLsRefsOptions{AllowedRefPrefixes: []string{"refs/heads/"}},
+			want:         main + "0000",
+			wantPrefixes: []string{"refs/heads/"},
+		},
+		"narrowed": {
+			prefixes:     []string{"refs/"},
+			opts:         ServeLsRefsOptions{AllowedRefPrefixes: []string{"refs/heads/"}},
+			want:         main + "0000",
+			wantPrefixes: []string{"refs/heads/"},
+		},
+		"disallowed": {
+			prefixes: []string{"refs/tags/"},
+			opts:     ServeLsRefsOptions{AllowedRefPrefixes: []string{"refs/heads/"}},
+			want:     "0000",
+		},
+		"disallowed rejected": {
+			prefixes: []string{"refs/tags/"},
+			opts:     ServeLsRefsOptions{AllowedRefPrefixes: []string{"refs/heads/"}, RejectDisallowed: true},
+			want:     "0033ERR ls-refs: disallowed ref-prefix \"refs/tags/\"",
+			wantErr:  "ERR ls-refs: disallowed ref-prefix \"refs/tags/\"",
+		},
+		"mixed": {
+			prefixes:     []string{"HEAD", "refs/heads/", "refs/tags/"},
+			opts:         ServeLsRefsOptions{AllowedRefPrefixes: []string{"refs/heads/"}},
+			want:         main + "0000",
+			wantPrefixes: []string{"refs/heads/"},
+		},
+		"mixed rejected": {
+			prefixes: []string{"refs/heads/", "refs/tags/"},
+			opts:     ServeLsRefsOptions{AllowedRefPrefixes: []string{"refs/heads/"}, RejectDisallowed: true},
+			want:     "0033ERR ls-refs: disallowed ref-prefix \"refs/tags/\"",
+			wantErr:  "ERR ls-refs: disallowed ref-prefix \"refs/tags/\"",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			gotPrefixes = nil
+			req := &CommandRequest{Command: CapabilityListReferences}
+			for _, prefix := range tc.prefixes {
+				req.Arguments = append(req.Arguments, CommandArgument{Key: ArgumentRefPrefix, Value: prefix})
+			}
+			var buf bytes.Buffer
+			err := ServeLsRefs(&buf, req, tc.opts, handler)
+			if tc.wantErr != "" {
+				var se *ServerError
+				if !errors.As(err, &se) {
+					t.Fatalf("expected *ServerError, got %v", err)
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, buf.String())
+			}
+			if !reflect.DeepEqual(gotPrefixes, tc.wantPrefixes) {
+				t.Fatalf("expected handler ref-prefixes %v, got %v", tc.wantPrefixes, gotPrefixes)
+			}
+			// The caller's request is never modified
+			if got := req.Arguments.GetAll(ArgumentRefPrefix); len(got) != len(tc.prefixes) {
+				t.Fatalf("expected request ref-prefixes %v, got %v", tc.prefixes, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package protocolv2
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+// Session reads successive command responses from a stateful connection (ex: SSH or git://)
+// Unlike smart HTTP where each response is a separate HTTP body, the responses share one stream
+type Session struct {
+	// Logger (if non-nil) receives debug events for each response section
+	Logger *slog.Logger
+	// Writer (if non-nil) is the stream command-requests are sent to (ex: the stdin of git-upload-pack)
+	// It is only required by Clone, otherwise the session is read-only
+	Writer io.Writer
+	// UnknownSideBand (if non-nil) receives the pkt-lines of sideband channels other than 1-3 (including
+	// the leading sideband byte) instead of failing the fetch, use io.Discard to silently drop them
+	UnknownSideBand io.Writer
+	// PackfileBufferSize (if positive) buffers the packfile written by ReadFetchResponse in a
+	// bufio.Writer of this size, reducing the number of small writes (ex: syscalls to an *os.File)
+	PackfileBufferSize int
+
+	r             *bufio.Reader
+	scanner       *pktline.Scanner
+	advertisement *CapabilityAdvertisement
+}
+
+// NewSession creates a Session reading from the given stream
+func NewSession(r io.Reader) *Session {
+	var s Session
+	s.Reset(r)
+	return &s
+}
+
+// Reset discards the state of the session (including the cached capability-advertisement) and
+// switches to reading from the given stream, such as after reconnecting
+func (s *Session) Reset(r io.Reader) {
+	s.r = bufio.NewReader(r)
+	s.scanner = pktline.NewScanner(s.r)
+	s.advertisement = nil
+}
+
+// Capabilities returns the capability-advertisement of the server, which is sent once upon
+// connecting and applies to every subsequent command of the session. The first call reads it from
+// the stream (so it must precede any command response), subsequent calls return it cached. Stateless
+// transports (ex: Client) cache the advertisement likewise, as capabilities do not change mid-session.
+func (s *Session) Capabilities() (*CapabilityAdvertisement, error) {
+	if s.advertisement != nil {
+		return s.advertisement, nil
+	}
+	var ca CapabilityAdvertisement
+	if err := ca.Parse(s.scanner); err != nil {
+		return nil, err
+	}
+	s.advertisement = &ca
+	return s.advertisement, nil
+}
+
+// objectFormat returns the object-format of the advertisement (if read), servers which do not
+// advertise an object-format use SHA-1
+func (s *Session) objectFormat() string {
+	if s.advertisement != nil {
+		if objectFormat, ok := s.advertisement.Capabilities.Get(CapabilityObjectFormat); ok {
+			return objectFormat
+		}
+	}
+	return "sha1"
+}
+
+// Scanner returns the pkt-line scanner used to parse the next response
+func (s *Session) Scanner() *pktline.Scanner {
+	return s.scanner
+}
+
+// More returns true if another command response follows on the stream
+// It blocks until at least one byte is available or the stream is closed
+func (s *Session) More() (bool, error) {
+	if _, err := s.r.Peek(1); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// ReadFetchResponse parses the next response on the stream as a fetch response
+func (s *Session) ReadFetchResponse(packfile io.Writer, progress io.Writer) (*FetchResponse, error) {
+	var fr FetchResponse
+	packfile, flush := bufferPackfile(packfile, s.PackfileBufferSize)
+	err := fr.parse(s.scanner, s.objectFormat(), packfile, progress, s.UnknownSideBand, loggerOrDiscard(s.Logger))
+	// The buffered packfile is flushed even if parsing failed, as it would have been written unbuffered
+	if flushErr := flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fr, nil
+}
+
+// cloneRefPrefixes are the ref-prefix arguments git clone sends, HEAD for the default branch plus
+// every branch and tag (for tag following)
+var cloneRefPrefixes = []string{"HEAD", "refs/heads/", "refs/tags/"}
+
+// Clone lists the references with ls-refs (as git clone does) then fetches every object they point
+// to, reading the capability-advertisement once and sending both command-requests on the same
+// connection. If no references are listed (an empty repository) nothing is fetched and the
+// FetchResponse is nil.
+//
+// On stateless smart HTTP there is no connection to reuse, so the equivalent is Client.LsRefs
+// followed by Client.Fetch of a BuildCloneRequest which costs two round trips (plus the request for
+// the capability-advertisement).
+func (s *Session) Clone(ctx context.Context, opts CloneOptions, packfile io.Writer, progress io.Writer) (*ListReferencesResponse, *FetchResponse, error) {
+	if s.Writer == nil {
+		return nil, nil, errors.New("clone requires a session Writer")
+	}
+	ca, err := s.Capabilities()
+	if err != nil {
+		return nil, nil, err
+	}
+	lsRefs, err := BuildLsRefsRequest(LsRefsOptions{
+		Advertisement:   ca,
+		DropUnsupported: true,
+		Capabilities:    opts.Capabilities,
+		Symrefs:         true,
+		Peel:            true,
+		Unborn:          true,
+		Prefixes:        cloneRefPrefixes,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.send(ctx, ca, lsRefs); err != nil {
+		return nil, nil, err
+	}
+	var lrs ListReferencesResponse
+	if err := lrs.Parse(s.scanner); err != nil {
+		return nil, nil, err
+	}
+	// Servers MAY ignore ref-prefix, so only the requested references are wanted
+	tips := WantsFromReferences(lrs.Filter(cloneRefPrefixes).References)
+	if len(tips) == 0 {
+		return &lrs, nil, nil
+	}
+	fetch, err := BuildCloneRequest(tips, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.send(ctx, ca, fetch); err != nil {
+		return nil, nil, err
+	}
+	fr, err := s.ReadFetchResponse(packfile, progress)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &lrs, fr, nil
+}
+
+// send writes the command-request to the Writer if the server supports the command
+func (s *Session) send(ctx context.Context, ca *CapabilityAdvertisement, req *CommandRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !ca.SupportsCommand(req.Command) {
+		return fmt.Errorf("%w: %s", ErrCommandNotSupported, req.Command)
+	}
+	_, err := req.WriteTo(s.Writer)
+	return err
+}
@@ -0,0 +1,274 @@
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func TestSessionMore(t *testing.T) {
+	payload := newFetchPayload()
+	session := NewSession(bytes.NewReader(append(payload, payload...)))
+	for idx := range 2 {
+		if more, err := session.More(); err != nil {
+			t.Fatal(err)
+		} else if !more {
+			t.Fatalf("response %d: expected more, got none", idx)
+		}
+		var fr FetchResponse
+		if err := fr.Parse(session.Scanner(), io.Discard, io.Discard); err != nil {
+			t.Fatalf("response %d: %v", idx, err)
+		}
+	}
+	if more, err := session.More(); err != nil {
+		t.Fatal(err)
+	} else if more {
+		t.Fatalf("expected no more responses")
+	}
+}
+
+func TestSessionLogger(t *testing.T) {
+	var logs bytes.Buffer
+	session := NewSession(bytes.NewReader(newFetchPayload()))
+	session.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if _, err := session.ReadFetchResponse(io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{"shallow-info", "packfile"} {
+		if !strings.Contains(logs.String(), "section="+section) {
+			t.Fatalf("expected %s section to be logged, got %q", section, logs.String())
+		}
+	}
+}
+
+func TestSessionCapabilities(t *testing.T) {
+	advertisement := CapabilityAdvertisement{Capabilities: Capabilities{{Key: CapabilityFetch, Value: "shallow"}}}.Bytes()
+	session := NewSession(bytes.NewReader(append(advertisement, newFetchPayload()...)))
+	ca, err := session.Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.SupportsFeature(CapabilityFetch, "shallow") {
+		t.Fatalf("expected fetch=shallow, got %v", ca.Capabilities)
+	}
+	// The cached advertisement is returned without reading the stream
+	if cached, err := session.Capabilities(); err != nil {
+		t.Fatal(err)
+	} else if cached != ca {
+		t.Fatalf("expected the cached advertisement")
+	}
+	if _, err := session.ReadFetchResponse(io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reconnecting invalidates the cache
+	advertisement = CapabilityAdvertisement{Capabilities: Capabilities{{Key: CapabilityFetch}}}.Bytes()
+	session.Reset(bytes.NewReader(advertisement))
+	if ca, err := session.Capabilities(); err != nil {
+		t.Fatal(err)
+	} else if ca.SupportsFeature(CapabilityFetch, "shallow") {
+		t.Fatalf("expected the advertisement to be re-read, got %v", ca.Capabilities)
+	}
+}
+
+func TestSessionClone(t *testing.T) {
+	advertisement := CapabilityAdvertisement{Capabilities: Capabilities{
+		{Key: CapabilityListReferences, Value: "unborn"},
+		{Key: CapabilityFetch, Value: "shallow"},
+	}}.Bytes()
+	tests := map[string]struct {
+		refs         ListReferencesResponse
+		wantRequests string
+		wantFetch    bool
+	}{
+		"clone": {
+			refs: ListReferencesResponse{References: []Reference{
+				{ObjectID: "0000000000000000000000000000000000000001", Name: "HEAD", Attributes: []string{"symref-target:refs/heads/main"}},
+				{ObjectID: "0000000000000000000000000000000000000001", Name: "refs/heads/main"},
+				{ObjectID: "0000000000000000000000000000000000000002", Name: "refs/pull/1/head"},
+			}},
+			wantRequests: "0014command=ls-refs\n0001000bsymrefs0008peel000aunborn0013ref-prefix HEAD001aref-prefix refs/heads/0019ref-prefix refs/tags/0000" +
+				"0012command=fetch\n0001000dofs-delta0031want 00000000000000000000000000000000000000010008done0000",
+			wantFetch: true,
+		},
+		"empty repository": {
+			refs: ListReferencesResponse{References: []Reference{
+				{ObjectID: "unborn", Name: "HEAD", Attributes: []string{"symref-target:refs/heads/main"}},
+			}},
+			wantRequests: "0014command=ls-refs\n0001000bsymrefs0008peel000aunborn0013ref-prefix HEAD001aref-prefix refs/heads/0019ref-prefix refs/tags/0000",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			stream := append(append(slices.Clip(advertisement), tc.refs.Bytes()...), newFetchPayload()...)
+			var requests, packfile bytes.Buffer
+			session := NewSession(bytes.NewReader(stream))
+			session.Writer = &requests
+			lrs, fr, err := session.Clone(context.Background(), CloneOptions{OFSDelta: true}, &packfile, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(lrs.References) != len(tc.refs.References) {
+				t.Fatalf("expected %d references, got %d", len(tc.refs.References), len(lrs.References))
+			}
+			if requests.String() != tc.wantRequests {
+				t.Fatalf("expected requests %q, got %q", tc.wantRequests, requests.String())
+			}
+			if (fr != nil) != tc.wantFetch {
+				t.Fatalf("expected fetch response %v, got %v", tc.wantFetch, fr)
+			}
+			if tc.wantFetch && packfile.String() != "PACK" {
+				t.Fatalf("unexpected packfile: %q", packfile.String())
+			}
+		})
+	}
+
+	session := NewSession(bytes.NewReader(advertisement))
+	if _, _, err := session.Clone(context.Background(), CloneOptions{}, io.Discard, io.Discard); err == nil {
+		t.Fatalf("expected error, got nil")
+	} else if err.Error() != "clone requires a session Writer" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSessionUnknownSideBand(t *testing.T) {
+	var b []byte
+	b = pktline.AppendString(b, "packfile\n")
+	b = pktline.AppendString(b, "\x04future extension")
+	b = pktline.AppendString(b, "\x01PACK")
+	b = pktline.AppendFlushPkt(b)
+	tests := map[string]struct {
+		unknownSideBand io.Writer
+		wantErr         string
+	}{
+		"strict": {
+			wantErr: "unexpected sideband channel 4 (unknown)",
+		},
+		"discard": {
+			unknownSideBand: io.Discard,
+		},
+		"writer": {
+			unknownSideBand: &bytes.Buffer{},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var packfile bytes.Buffer
+			session := NewSession(bytes.NewReader(b))
+			session.UnknownSideBand = tc.unknownSideBand
+			_, err := session.ReadFetchResponse(&packfile, io.Discard)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if packfile.String() != "PACK" {
+				t.Fatalf("unexpected packfile: %q", packfile.String())
+			}
+			if buf, ok := tc.unknownSideBand.(*bytes.Buffer); ok && buf.String() != "\x04future extension" {
+				t.Fatalf("unexpected unknown sideband: %q", buf.String())
+			}
+		})
+	}
+}
+
+// failingWriter returns an error for every write
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestSessionPackfileBufferSize(t *testing.T) {
+	tests := map[string]struct {
+		bufferSize int
+		packfile   io.Writer
+		wantErr    string
+	}{
+		"unbuffered": {
+			packfile: &bytes.Buffer{},
+		},
+		"buffered": {
+			bufferSize: 64 * 1024,
+			packfile:   &bytes.Buffer{},
+		},
+		"buffered without packfile": {
+			bufferSize: 64 * 1024,
+		},
+		"unbuffered write error": {
+			packfile: failingWriter{},
+			wantErr:  "disk full",
+		},
+		"buffered flush error": {
+			bufferSize: 64 * 1024,
+			packfile:   failingWriter{},
+			wantErr:    "disk full",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			session := NewSession(bytes.NewReader(newFetchPayload()))
+			session.PackfileBufferSize = tc.bufferSize
+			_, err := session.ReadFetchResponse(tc.packfile, io.Discard)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				} else if err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %q", tc.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if buf, ok := tc.packfile.(*bytes.Buffer); ok && buf.String() != "PACK" {
+				t.Fatalf("unexpected packfile: %q", buf.String())
+			}
+		})
+	}
+}
+
+func BenchmarkSessionPackfileBufferSize(b *testing.B) {
+	// A packfile section of 4 MiB in 1 KiB pkt-lines
+	var payload []byte
+	payload = pktline.AppendString(payload, "packfile\n")
+	payload = pktline.AppendString(payload, "\x01PACK")
+	chunk := append([]byte{byte(pktline.SideBandPackData)}, bytes.Repeat([]byte{'x'}, 1024)...)
+	for range 4096 {
+		payload = pktline.AppendBytes(payload, chunk)
+	}
+	payload = pktline.AppendFlushPkt(payload)
+	for _, bufferSize := range []int{0, 64 * 1024} {
+		b.Run(fmt.Sprintf("buffer=%d", bufferSize), func(b *testing.B) {
+			f, err := os.CreateTemp(b.TempDir(), "*.pack")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.Close()
+			b.SetBytes(int64(len(payload)))
+			for range b.N {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				session := NewSession(bytes.NewReader(payload))
+				session.PackfileBufferSize = bufferSize
+				if _, err := session.ReadFetchResponse(f, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
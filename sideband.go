@@ -0,0 +1,36 @@
+package protocolv2
+
+// SideBand is the channel of a multiplexed pkt-line of the packfile section, identified by its first byte
+type SideBand byte
+
+const (
+	// SideBandPack carries the packfile data
+	SideBandPack SideBand = 1
+	// SideBandProgress carries progress messages (ex: "Enumerating objects: 1, done."), a pkt-line
+	// without a payload is a keepalive sent while the server is preparing the packfile
+	SideBandProgress SideBand = 2
+	// SideBandError carries a fatal error message, after which the response ends
+	SideBandError SideBand = 3
+)
+
+// String implements the fmt.Stringer interface, returning "unknown" for any other channel
+func (sb SideBand) String() string {
+	switch sb {
+	case SideBandPack:
+		return "pack"
+	case SideBandProgress:
+		return "progress"
+	case SideBandError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// label is String but returns "keepalive" for a progress pkt-line without a payload
+func (sb SideBand) label(data []byte) string {
+	if sb == SideBandProgress && len(data) == 0 {
+		return "keepalive"
+	}
+	return sb.String()
+}
@@ -0,0 +1,52 @@
+package protocolv2
+
+import "testing"
+
+func TestSideBandString(t *testing.T) {
+	tests := map[string]struct {
+		sideband  SideBand
+		data      string
+		want      string
+		wantLabel string
+	}{
+		"pack": {
+			sideband:  SideBandPack,
+			data:      "PACK",
+			want:      "pack",
+			wantLabel: "pack",
+		},
+		"progress": {
+			sideband:  SideBandProgress,
+			data:      "Enumerating objects: 1, done.\n",
+			want:      "progress",
+			wantLabel: "progress",
+		},
+		"keepalive": {
+			sideband:  SideBandProgress,
+			want:      "progress",
+			wantLabel: "keepalive",
+		},
+		"error": {
+			sideband:  SideBandError,
+			data:      "access denied",
+			want:      "error",
+			wantLabel: "error",
+		},
+		"unknown": {
+			sideband:  4,
+			data:      "future extension",
+			want:      "unknown",
+			wantLabel: "unknown",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.sideband.String(); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+			if got := tc.sideband.label([]byte(tc.data)); got != tc.wantLabel {
+				t.Fatalf("expected label %q, got %q", tc.wantLabel, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package protocolv2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+// The services of the smart-HTTP transport, which name both the info/refs advertisement
+// (/info/refs?service=<service>) and the endpoint command-requests are POSTed to (/<service>)
+const (
+	// ServiceUploadPack serves fetches (and ls-refs and the other protocol-v2 commands)
+	ServiceUploadPack = "git-upload-pack"
+	// ServiceReceivePack serves pushes
+	ServiceReceivePack = "git-receive-pack"
+)
+
+var (
+	// ErrUnexpectedService is returned when the smart-HTTP preamble names a different service
+	ErrUnexpectedService = errors.New("unexpected service in smart-http preamble")
+	// ErrMissingFlushPkt is returned when the smart-HTTP preamble is not terminated by a flush-pkt
+	ErrMissingFlushPkt = errors.New("expected flush-pkt after smart-http preamble")
+)
+
+// ParseSmartHTTPPreamble consumes the smart-HTTP preamble from a given pkt-line scanner
+// smart-http-preamble = PKT-LINE("# service=" service LF) flush-pkt
+func ParseSmartHTTPPreamble(scanner *pktline.Scanner, expectedService string) error {
+	line, err := scanner.Scan()
+	if err != nil {
+		return err
+	}
+	remaining, ok := bytes.CutSuffix(line, []byte("\n"))
+	if !ok {
+		return fmt.Errorf("invalid smart-http preamble: %q", string(line))
+	}
+	service, ok := bytes.CutPrefix(remaining, []byte("# service="))
+	if !ok {
+		return fmt.Errorf("invalid smart-http preamble: %q", string(line))
+	}
+	if string(service) != expectedService {
+		return fmt.Errorf("%w: %q", ErrUnexpectedService, string(service))
+	}
+	if line, err := scanner.Scan(); !errors.Is(err, pktline.ErrFlushPkt) {
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrMissingFlushPkt, err)
+		}
+		return fmt.Errorf("%w: %q", ErrMissingFlushPkt, string(line))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package protocolv2
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func TestParseSmartHTTPPreamble(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		wantErr error
+	}{
+		"valid": {
+			input: "001e# service=git-upload-pack\n0000",
+		},
+		"wrong service": {
+			input:   "001f# service=git-receive-pack\n0000",
+			wantErr: ErrUnexpectedService,
+		},
+		"missing flush": {
+			input:   "001e# service=git-upload-pack\n000eversion 2\n",
+			wantErr: ErrMissingFlushPkt,
+		},
+		"truncated flush": {
+			input:   "001e# service=git-upload-pack\n",
+			wantErr: ErrMissingFlushPkt,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			scanner := pktline.NewScanner(strings.NewReader(tc.input))
+			err := ParseSmartHTTPPreamble(scanner, "git-upload-pack")
+			if tc.wantErr == nil && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			} else if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
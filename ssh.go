@@ -0,0 +1,60 @@
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// closerFunc adapts a function to the io.Closer interface
+type closerFunc func() error
+
+// Close implements the io.Closer interface
+func (fn closerFunc) Close() error {
+	return fn()
+}
+
+// shellQuote quotes the argument for the remote shell the same way git does (sq_quote_buf)
+func shellQuote(arg string) string {
+	var sb strings.Builder
+	sb.WriteByte('\'')
+	for idx := 0; idx < len(arg); idx++ {
+		switch c := arg[idx]; c {
+		case '\'', '!':
+			sb.WriteString("'\\")
+			sb.WriteByte(c)
+			sb.WriteByte('\'')
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
+
+// DialSSH runs git-upload-pack for the repository at path on host (ex: git@github.com) using the
+// ssh binary, requesting protocol-v2 via the GIT_PROTOCOL environment variable. The server must
+// accept it (AcceptEnv GIT_PROTOCOL), otherwise Capabilities fails as it will respond with v0.
+func DialSSH(ctx context.Context, host string, path string) (*StreamTransport, error) {
+	cmd := exec.CommandContext(ctx, "ssh", "-o", "SendEnv=GIT_PROTOCOL", host, "git-upload-pack "+shellQuote(path))
+	cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+GitProtocolHeader(""))
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	st := NewStreamTransport(stdout, stdin)
+	st.closer = closerFunc(func() error {
+		return errors.Join(stdin.Close(), cmd.Wait())
+	})
+	return st, nil
+}
@@ -0,0 +1,30 @@
+package protocolv2
+
+import "testing"
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]struct {
+		arg  string
+		want string
+	}{
+		"plain": {
+			arg:  "bored-engineer/git-protocol-v2.git",
+			want: "'bored-engineer/git-protocol-v2.git'",
+		},
+		"quote": {
+			arg:  "it's",
+			want: `'it'\''s'`,
+		},
+		"bang": {
+			arg:  "wow!",
+			want: `'wow'\!''`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := shellQuote(tc.arg); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
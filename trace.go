@@ -0,0 +1,73 @@
+package protocolv2
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// packetTracer writes each pkt-line written to it in git's GIT_TRACE_PACKET format
+// (ex: "packet:          git> command=ls-refs"), buffering partial pkt-lines between writes.
+// The trace is not redacted, it may contain sensitive data such as ref names or credentials.
+type packetTracer struct {
+	w         io.Writer
+	direction byte
+	buf       []byte
+}
+
+// newPacketTracer creates a packetTracer for the given direction ('<' received, '>' sent)
+func newPacketTracer(w io.Writer, direction byte) *packetTracer {
+	return &packetTracer{w: w, direction: direction}
+}
+
+// trace writes a single trace line for the given (already formatted) packet
+func (pt *packetTracer) trace(packet string) {
+	fmt.Fprintf(pt.w, "packet: %12s%c %s\n", "git", pt.direction, packet)
+}
+
+// Write implements the io.Writer interface, it never returns an error
+func (pt *packetTracer) Write(p []byte) (int, error) {
+	pt.buf = append(pt.buf, p...)
+	for len(pt.buf) >= 4 {
+		length, err := strconv.ParseUint(string(pt.buf[:4]), 16, 16)
+		if err != nil {
+			// Not pkt-line framed, there is no way to recover so trace the remainder as-is
+			pt.trace(escapePacket(pt.buf))
+			pt.buf = nil
+			break
+		}
+		if length < 4 {
+			pt.trace(string(pt.buf[:4]))
+			pt.buf = pt.buf[4:]
+			continue
+		}
+		if len(pt.buf) < int(length) {
+			break
+		}
+		pt.trace(escapePacket(pt.buf[4:length]))
+		pt.buf = pt.buf[length:]
+	}
+	// Avoid retaining the (potentially large) backing array once drained
+	if len(pt.buf) == 0 {
+		pt.buf = nil
+	}
+	return len(p), nil
+}
+
+// escapePacket formats the pkt-line payload like git, without the trailing LF and with
+// unprintable bytes escaped as octal
+func escapePacket(payload []byte) string {
+	if n := len(payload); n > 0 && payload[n-1] == '\n' {
+		payload = payload[:n-1]
+	}
+	var sb strings.Builder
+	for _, c := range payload {
+		if c >= 0x20 && c < 0x7f {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "\\%o", c)
+		}
+	}
+	return sb.String()
+}
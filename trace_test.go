@@ -0,0 +1,49 @@
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPacketTracer(t *testing.T) {
+	payload := "000eversion 2\n0000" + "000dpackfile\n0009\x01PACK0001"
+	want := "packet:          git< version 2\n" +
+		"packet:          git< 0000\n" +
+		"packet:          git< packfile\n" +
+		"packet:          git< \\1PACK\n" +
+		"packet:          git< 0001\n"
+	// Split the writes at every offset to exercise the buffering of partial pkt-lines
+	for split := range len(payload) {
+		var trace bytes.Buffer
+		pt := newPacketTracer(&trace, '<')
+		pt.Write([]byte(payload[:split]))
+		pt.Write([]byte(payload[split:]))
+		if trace.String() != want {
+			t.Fatalf("split %d: expected %q, got %q", split, want, trace.String())
+		}
+	}
+}
+
+func TestClientTrace(t *testing.T) {
+	srv := newTestServer(t, Capabilities{{Key: CapabilityListReferences}}, func(req *CommandRequest, w io.Writer) {
+		w.Write(ListReferencesResponse{}.Bytes())
+	})
+	var trace bytes.Buffer
+	client := Client{URL: srv.URL, Trace: &trace}
+	if _, err := client.LsRefs(context.Background(), &CommandRequest{Command: CapabilityListReferences}); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"packet:          git< # service=git-upload-pack",
+		"packet:          git< ls-refs",
+		"packet:          git> command=ls-refs",
+		"packet:          git> 0001",
+	} {
+		if !strings.Contains(trace.String(), line+"\n") {
+			t.Fatalf("expected trace to contain %q, got %q", line, trace.String())
+		}
+	}
+}
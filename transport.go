@@ -0,0 +1,103 @@
+package protocolv2
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+// Transport performs command-requests against a remote repository
+type Transport interface {
+	// Capabilities returns the capability-advertisement of the server
+	Capabilities(ctx context.Context) (*CapabilityAdvertisement, error)
+	// Command sends the command-request, returning the response which the caller must close
+	// On a stateful transport the response must be fully read before the next command is sent
+	Command(ctx context.Context, req *CommandRequest) (io.ReadCloser, error)
+}
+
+var (
+	_ Transport = (*Client)(nil)
+	_ Transport = (*StreamTransport)(nil)
+)
+
+// StreamTransport implements protocol-v2 over a single stateful stream (ex: the stdin/stdout of
+// git-upload-pack over SSH). The server sends the capability-advertisement immediately upon
+// connecting, with no "# service=" preamble, which is read before any command is sent.
+type StreamTransport struct {
+	// Trace (if non-nil) receives every pkt-line sent and received in git's GIT_TRACE_PACKET format
+	// The trace is not redacted, it may contain sensitive data such as ref names
+	Trace io.Writer
+
+	r      *bufio.Reader
+	w      io.Writer
+	closer io.Closer
+
+	mu            sync.Mutex
+	advertisement *CapabilityAdvertisement
+}
+
+// NewStreamTransport creates a StreamTransport reading responses from r and writing requests to w
+func NewStreamTransport(r io.Reader, w io.Writer) *StreamTransport {
+	return &StreamTransport{
+		r: bufio.NewReader(r),
+		w: w,
+	}
+}
+
+// Capabilities returns the capability-advertisement of the server
+// The first call reads the advertisement from the stream, subsequent calls return it cached
+func (st *StreamTransport) Capabilities(ctx context.Context) (*CapabilityAdvertisement, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.advertisement != nil {
+		return st.advertisement, nil
+	}
+	var ca CapabilityAdvertisement
+	if err := ca.Parse(pktline.NewScanner(st.reader())); err != nil {
+		return nil, err
+	}
+	st.advertisement = &ca
+	return st.advertisement, nil
+}
+
+// Command sends the command-request, returning the response
+// Closing the response does not close the underlying stream
+func (st *StreamTransport) Command(ctx context.Context, req *CommandRequest) (io.ReadCloser, error) {
+	ca, err := st.Capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ca.SupportsCommand(req.Command) {
+		return nil, fmt.Errorf("%w: %s", ErrCommandNotSupported, req.Command)
+	}
+	if st.Trace != nil {
+		newPacketTracer(st.Trace, '>').Write(req.Bytes())
+	}
+	if _, err := st.w.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(st.reader()), nil
+}
+
+// reader returns the stream, which is traced if requested
+// The pkt-line scanner never reads beyond the current pkt-line, so only consumed data is traced
+func (st *StreamTransport) reader() io.Reader {
+	if st.Trace != nil {
+		return io.TeeReader(st.r, newPacketTracer(st.Trace, '<'))
+	}
+	return st.r
+}
+
+// Close ends the session with a flush-pkt and closes the underlying connection (if any)
+func (st *StreamTransport) Close() error {
+	_, err := st.w.Write(pktline.AppendFlushPkt(nil))
+	if st.closer != nil {
+		return errors.Join(err, st.closer.Close())
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	pktline "github.com/bored-engineer/git-pkt-line"
+)
+
+func TestStreamTransport(t *testing.T) {
+	// Recorded from git-upload-pack over SSH, there is no "# service=" preamble
+	stream := "000eversion 2\n" +
+		"0015agent=git/2.43.0\n" +
+		"0013ls-refs=unborn\n" +
+		"0000" +
+		"003d0000000000000000000000000000000000000001 refs/heads/main\n" +
+		"0000"
+	var requests bytes.Buffer
+	st := NewStreamTransport(bytes.NewReader([]byte(stream)), &requests)
+	ca, err := st.Capabilities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ca.Capabilities, Capabilities{
+		{Key: "agent", Value: "git/2.43.0"},
+		{Key: "ls-refs", Value: "unborn"},
+	}) {
+		t.Fatalf("unexpected capabilities: %v", ca.Capabilities)
+	}
+	if requests.Len() != 0 {
+		t.Fatalf("unexpected request before command: %q", requests.String())
+	}
+
+	if _, err := st.Command(context.Background(), &CommandRequest{Command: CapabilityFetch}); !errors.Is(err, ErrCommandNotSupported) {
+		t.Fatalf("expected ErrCommandNotSupported, got %v", err)
+	}
+	req := &CommandRequest{Command: CapabilityListReferences}
+	body, err := st.Command(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	var resp ListReferencesResponse
+	if err := resp.Parse(pktline.NewScanner(body)); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.References) != 1 || resp.References[0].Name != "refs/heads/main" {
+		t.Fatalf("unexpected references: %v", resp.References)
+	}
+	if requests.String() != string(req.Bytes()) {
+		t.Fatalf("expected request %q, got %q", string(req.Bytes()), requests.String())
+	}
+
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(requests.Bytes(), []byte("0000")) {
+		t.Fatalf("expected flush-pkt on close, got %q", requests.String())
+	}
+}